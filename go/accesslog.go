@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// ベンチマーク時に出力が増えないよう既定では無効
+var enableAccessLog = false
+
+func accessLogMiddleware() echo.MiddlewareFunc {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			err := next(c)
+			if err != nil {
+				// エラーレスポンスはerrorResponseHandlerに任せる
+				c.Error(err)
+			}
+
+			attrs := []slog.Attr{
+				slog.String("method", c.Request().Method),
+				slog.String("path", c.Request().URL.Path),
+				slog.Int("status", c.Response().Status),
+				slog.Duration("duration", time.Since(start)),
+			}
+			if sess, err := session.Get(defaultSessionIDKey, c); err == nil {
+				if userID, ok := sess.Values[defaultUserIDKey].(int64); ok {
+					attrs = append(attrs, slog.Int64("user_id", userID))
+				}
+			}
+			logger.LogAttrs(c.Request().Context(), slog.LevelInfo, "access", attrs...)
+			return nil
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/sync/errgroup"
+)
+
+// 管理者として扱うユーザ名 (未設定の場合は誰も管理者にならない)
+var adminUsername = ""
+
+type NGWordFrequency struct {
+	Word  string `json:"word" db:"word"`
+	Count int64  `json:"count" db:"count"`
+}
+
+func verifyAdminSession(c echo.Context) error {
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	username, _ := sess.Values[defaultUsernameKey].(string)
+	if adminUsername == "" || username != adminUsername {
+		return echo.NewHTTPError(http.StatusForbidden, "admin only")
+	}
+
+	return nil
+}
+
+type ReservationUtilization struct {
+	StartAt     int64   `json:"start_at"`
+	EndAt       int64   `json:"end_at"`
+	Capacity    int64   `json:"capacity"`
+	Reserved    int64   `json:"reserved"`
+	Utilization float64 `json:"utilization"`
+}
+
+// 予約枠の利用率を日または週ごとに集計する
+// GET /api/admin/reservation/utilization?bucket=day|week
+func getReservationUtilizationHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyAdminSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	var bucketSeconds int64
+	switch c.QueryParam("bucket") {
+	case "", "day":
+		bucketSeconds = 24 * 60 * 60
+	case "week":
+		bucketSeconds = 7 * 24 * 60 * 60
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "bucket query parameter must be day or week")
+	}
+
+	var slots []*ReservationSlotModel
+	if err := dbConn.SelectContext(ctx, &slots, "SELECT * FROM reservation_slots ORDER BY start_at ASC"); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+	}
+
+	utilizations := []ReservationUtilization{}
+	for _, slot := range slots {
+		startAt := slot.StartAt - slot.StartAt%bucketSeconds
+		if len(utilizations) == 0 || utilizations[len(utilizations)-1].StartAt != startAt {
+			utilizations = append(utilizations, ReservationUtilization{
+				StartAt: startAt,
+				EndAt:   startAt + bucketSeconds,
+			})
+		}
+		u := &utilizations[len(utilizations)-1]
+		u.Capacity += slot.Capacity
+		if slot.Capacity > slot.Slot {
+			u.Reserved += slot.Capacity - slot.Slot
+		}
+	}
+
+	for i := range utilizations {
+		if utilizations[i].Capacity > 0 {
+			utilizations[i].Utilization = float64(utilizations[i].Reserved) / float64(utilizations[i].Capacity) * 100
+		}
+	}
+
+	return c.JSON(http.StatusOK, utilizations)
+}
+
+// NGワード一覧で一度に返す最大件数
+const maxTopNGWordsLimit = 100
+
+// 全配信で多く登録されているNGワード一覧
+// GET /api/admin/ngwords/top
+func getTopNGWordsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyAdminSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	limit := 10
+	if c.QueryParam("limit") != "" {
+		v, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || v < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be non-negative integer")
+		}
+		limit = v
+	}
+	if limit > maxTopNGWordsLimit {
+		limit = maxTopNGWordsLimit
+	}
+
+	frequencies := []NGWordFrequency{}
+	if err := dbConn.SelectContext(ctx, &frequencies, "SELECT word, COUNT(*) AS count FROM ng_words GROUP BY word ORDER BY count DESC, word ASC LIMIT ?", limit); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG word frequencies: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, frequencies)
+}
+
+// 手動でユーザーのサブドメインをDNSから削除する
+// DELETE /api/admin/subdomain/:username
+func deleteSubdomainHandler(c echo.Context) error {
+	if err := verifyAdminSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	username := c.Param("username")
+	if !removeSubdomain(userSubdomain(username)) {
+		return echo.NewHTTPError(http.StatusNotFound, "subdomain not found")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+type PlatformStatistics struct {
+	UsersCount        int64 `json:"users_count"`
+	LivestreamsCount  int64 `json:"livestreams_count"`
+	TotalLivecomments int64 `json:"total_livecomments"`
+	TotalReactions    int64 `json:"total_reactions"`
+	TotalTip          int64 `json:"total_tip"`
+	TotalReports      int64 `json:"total_reports"`
+}
+
+// サービス全体の集計 (管理者のみ)
+// GET /api/admin/stats
+func getPlatformStatisticsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyAdminSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	var stats PlatformStatistics
+	// 各集計は互いに独立しているので並行に投げる
+	eg, egCtx := errgroup.WithContext(ctx)
+	for _, q := range []struct {
+		dest  *int64
+		name  string
+		query string
+	}{
+		{&stats.UsersCount, "users", "SELECT COUNT(*) FROM users"},
+		{&stats.LivestreamsCount, "livestreams", "SELECT COUNT(*) FROM livestreams"},
+		{&stats.TotalLivecomments, "livecomments", "SELECT COUNT(*) FROM livecomments WHERE hidden = FALSE"},
+		{&stats.TotalReactions, "reactions", "SELECT COUNT(*) FROM reactions"},
+		{&stats.TotalTip, "tips", "SELECT IFNULL(SUM(tip), 0) FROM livecomments WHERE hidden = FALSE"},
+		{&stats.TotalReports, "livecomment_reports", "SELECT COUNT(*) FROM livecomment_reports"},
+	} {
+		q := q
+		eg.Go(func() error {
+			if err := readDB().GetContext(egCtx, q.dest, q.query); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to count "+q.name+": "+err.Error())
+			}
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, stats)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/go-json-experiment/json"
+	"github.com/labstack/echo/v4"
+)
+
+// 管理者としてログインしている状態でハンドラを呼ぶ
+func serveAsAdmin(t *testing.T, h echo.HandlerFunc, method, target, body string, params ...string) (int, string) {
+	t.Helper()
+	prev := adminUsername
+	adminUsername = "test-admin"
+	t.Cleanup(func() { adminUsername = prev })
+
+	code, resBody, err := serveWithSession(map[any]any{defaultUserIDKey: int64(1), defaultUsernameKey: adminUsername}, h, method, target, body, params...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code, resBody
+}
+
+func TestGetTopNGWordsLimit(t *testing.T) {
+	f := setupHandlerTest(t)
+	var gotLimit driver.Value
+	f.on("FROM ng_words GROUP BY word", func(args []driver.Value) fakeResponse {
+		gotLimit = args[0]
+		return rowsOf(NGWordFrequency{Word: "spam", Count: 2})
+	})
+
+	tests := []struct {
+		query     string
+		wantCode  int
+		wantLimit int64
+	}{
+		{"", http.StatusOK, 10},
+		{"limit=3", http.StatusOK, 3},
+		{"limit=0", http.StatusOK, 0},
+		{"limit=100000", http.StatusOK, maxTopNGWordsLimit},
+		{"limit=-1", http.StatusBadRequest, 0},
+		{"limit=abc", http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		gotLimit = nil
+		code, _ := serveAsAdmin(t, getTopNGWordsHandler, http.MethodGet, "/api/admin/ngwords/top?"+tt.query, "")
+		if code != tt.wantCode {
+			t.Errorf("%q: status = %d, want %d", tt.query, code, tt.wantCode)
+			continue
+		}
+		if tt.wantCode == http.StatusOK && gotLimit != tt.wantLimit {
+			t.Errorf("%q: LIMIT = %v, want %d", tt.query, gotLimit, tt.wantLimit)
+		}
+	}
+}
+
+func TestGetTopNGWordsOrderByFrequency(t *testing.T) {
+	setupTestDB(t)
+	for _, word := range []string{"beta", "alpha", "gamma", "beta", "alpha", "beta"} {
+		if _, err := dbConn.Exec("INSERT INTO ng_words (user_id, livestream_id, word, created_at) VALUES (1, 1, ?, 0)", word); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	code, body := serveAsAdmin(t, getTopNGWordsHandler, http.MethodGet, "/api/admin/ngwords/top?limit=2", "")
+	if code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+	var frequencies []NGWordFrequency
+	if err := json.Unmarshal([]byte(body), &frequencies); err != nil {
+		t.Fatal(err)
+	}
+	want := []NGWordFrequency{{Word: "beta", Count: 3}, {Word: "alpha", Count: 2}}
+	if len(frequencies) != len(want) || frequencies[0] != want[0] || frequencies[1] != want[1] {
+		t.Errorf("frequencies = %+v, want %+v", frequencies, want)
+	}
+}
+
+func fakePlatformStatistics(f *fakeDB) {
+	f.value("SELECT COUNT(*) FROM users", "COUNT(*)", int64(10))
+	f.value("SELECT COUNT(*) FROM livestreams", "COUNT(*)", int64(20))
+	f.value("SELECT COUNT(*) FROM livecomments WHERE hidden = FALSE", "COUNT(*)", int64(30))
+	f.value("SELECT COUNT(*) FROM reactions", "COUNT(*)", int64(40))
+	f.value("SELECT IFNULL(SUM(tip), 0) FROM livecomments WHERE hidden = FALSE", "IFNULL(SUM(tip), 0)", int64(500))
+	f.value("SELECT COUNT(*) FROM livecomment_reports", "COUNT(*)", int64(6))
+}
+
+func TestGetPlatformStatistics(t *testing.T) {
+	f := setupHandlerTest(t)
+	fakePlatformStatistics(f)
+
+	code, body := serveAsAdmin(t, getPlatformStatisticsHandler, http.MethodGet, "/api/admin/stats", "")
+	if code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+	var stats PlatformStatistics
+	if err := json.Unmarshal([]byte(body), &stats); err != nil {
+		t.Fatal(err)
+	}
+	want := PlatformStatistics{UsersCount: 10, LivestreamsCount: 20, TotalLivecomments: 30, TotalReactions: 40, TotalTip: 500, TotalReports: 6}
+	if stats != want {
+		t.Errorf("stats = %+v, want %+v", stats, want)
+	}
+	// 集計ごとに1クエリ
+	if n := f.count("SELECT"); n != 6 {
+		t.Errorf("ran %d queries, want 6", n)
+	}
+}
+
+func TestGetPlatformStatisticsAdminOnly(t *testing.T) {
+	f := setupHandlerTest(t)
+	fakePlatformStatistics(f)
+	prev := adminUsername
+	adminUsername = "test-admin"
+	t.Cleanup(func() { adminUsername = prev })
+
+	code, _, err := serveWithSession(map[any]any{defaultUserIDKey: int64(2), defaultUsernameKey: "not-admin"}, getPlatformStatisticsHandler, http.MethodGet, "/api/admin/stats", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusForbidden {
+		t.Errorf("status = %d, want %d", code, http.StatusForbidden)
+	}
+	if q := f.lastQuery(); q != "" {
+		t.Errorf("query = %s, want none for a non-admin", q)
+	}
+}
+
+func TestGetPlatformStatisticsQueryError(t *testing.T) {
+	f := setupHandlerTest(t)
+	fakePlatformStatistics(f)
+	f.on("SELECT COUNT(*) FROM reactions", func([]driver.Value) fakeResponse {
+		return fakeResponse{err: errors.New("reactions is gone")}
+	})
+
+	code, body := serveAsAdmin(t, getPlatformStatisticsHandler, http.MethodGet, "/api/admin/stats", "")
+	if code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", code, http.StatusInternalServerError)
+	}
+	if !strings.Contains(body, "failed to count reactions") {
+		t.Errorf("message = %q, want the failed aggregate", body)
+	}
+}
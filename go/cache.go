@@ -1,10 +1,27 @@
 package main
 
-import "sync"
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/sync/singleflight"
+)
 
 type cache[K comparable, V any] struct {
 	sync.RWMutex
-	items map[K]V
+	items  map[K]V
+	hits   atomic.Int64
+	misses atomic.Int64
+	// 他のサーバに同じキーの破棄を伝えるためのフック
+	onInvalidate func(key K)
+	group        singleflight.Group
+
+	// LRUモードのときだけ使う (maxEntries == 0 なら上限なし)
+	maxEntries int
+	recency    *list.List
+	elements   map[K]*list.Element
 }
 
 func NewCache[K comparable, V any]() *cache[K, V] {
@@ -15,28 +32,143 @@ func NewCache[K comparable, V any]() *cache[K, V] {
 	return c
 }
 
+// NewLRUCache はmaxEntriesを超えたら最も長く使われていないエントリを捨てる
+func NewLRUCache[K comparable, V any](maxEntries int) *cache[K, V] {
+	c := NewCache[K, V]()
+	c.maxEntries = maxEntries
+	c.recency = list.New()
+	c.elements = make(map[K]*list.Element)
+	return c
+}
+
 func (c *cache[K, V]) Set(key K, value V) {
 	c.Lock()
 	c.items[key] = value
+	if c.maxEntries > 0 {
+		if el, ok := c.elements[key]; ok {
+			c.recency.MoveToFront(el)
+		} else {
+			c.elements[key] = c.recency.PushFront(key)
+		}
+		if c.recency.Len() > c.maxEntries {
+			oldest := c.recency.Back()
+			c.removeElement(oldest.Value.(K))
+		}
+	}
 	c.Unlock()
 }
 
 func (c *cache[K, V]) Get(key K) (V, bool) {
-	c.RLock()
-	v, found := c.items[key]
-	c.RUnlock()
+	var (
+		v     V
+		found bool
+	)
+	if c.maxEntries > 0 {
+		// 参照順を更新するので書き込みロックが必要
+		c.Lock()
+		v, found = c.items[key]
+		if found {
+			c.recency.MoveToFront(c.elements[key])
+		}
+		c.Unlock()
+	} else {
+		c.RLock()
+		v, found = c.items[key]
+		c.RUnlock()
+	}
+	if found {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
 	return v, found
 }
 
+// GetOrSet はキャッシュになければfで値を求めて載せる
+// 同じキーへの同時のミスではfは一度だけ呼ばれる
+func (c *cache[K, V]) GetOrSet(key K, f func() (V, error)) (V, error) {
+	if v, ok := c.Get(key); ok {
+		return v, nil
+	}
+
+	v, err, _ := c.group.Do(fmt.Sprint(key), func() (interface{}, error) {
+		if v, ok := c.Get(key); ok {
+			return v, nil
+		}
+		v, err := f()
+		if err != nil {
+			return nil, err
+		}
+		c.Set(key, v)
+		return v, nil
+	})
+	if err != nil {
+		var zero V
+		return zero, err
+	}
+	return v.(V), nil
+}
+
 func (c *cache[K, V]) Init() {
 	c.Lock()
 	c.items = make(map[K]V)
+	if c.maxEntries > 0 {
+		c.recency.Init()
+		c.elements = make(map[K]*list.Element)
+	}
+	c.Unlock()
+}
+
+// Replace は中身をitemsに丸ごと入れ替える
+// InitしてからSetし直すと途中で空のキャッシュが見えてしまうので、一度のロックで差し替える
+func (c *cache[K, V]) Replace(items map[K]V) {
+	c.Lock()
+	c.items = items
+	if c.maxEntries > 0 {
+		c.recency.Init()
+		c.elements = make(map[K]*list.Element, len(items))
+		for k := range items {
+			c.elements[k] = c.recency.PushFront(k)
+		}
+	}
 	c.Unlock()
 }
 
 func (c *cache[K, V]) Delete(key K) {
+	c.deleteLocal(key)
+	c.Invalidate(key)
+}
+
+func (c *cache[K, V]) deleteLocal(key K) {
 	c.Lock()
+	c.removeElement(key)
+	c.Unlock()
+}
+
+// ロックを取った状態で呼ぶ
+func (c *cache[K, V]) removeElement(key K) {
 	delete(c.items, key)
+	if c.maxEntries > 0 {
+		if el, ok := c.elements[key]; ok {
+			c.recency.Remove(el)
+			delete(c.elements, key)
+		}
+	}
+}
+
+// Invalidate は自分のエントリは残したまま、他のサーバに同じキーを破棄させる
+func (c *cache[K, V]) Invalidate(key K) {
+	c.RLock()
+	f := c.onInvalidate
+	c.RUnlock()
+	if f != nil {
+		f(key)
+	}
+}
+
+func (c *cache[K, V]) SetInvalidateHook(f func(key K)) {
+	c.Lock()
+	c.onInvalidate = f
 	c.Unlock()
 }
 
@@ -49,3 +181,25 @@ func (c *cache[K, V]) All() []V {
 	c.RUnlock()
 	return values
 }
+
+func (c *cache[K, V]) Len() int {
+	c.RLock()
+	n := len(c.items)
+	c.RUnlock()
+	return n
+}
+
+// Keys は呼び出し側で変更しても影響がないようにコピーを返す
+func (c *cache[K, V]) Keys() []K {
+	c.RLock()
+	keys := make([]K, 0, len(c.items))
+	for k := range c.items {
+		keys = append(keys, k)
+	}
+	c.RUnlock()
+	return keys
+}
+
+func (c *cache[K, V]) HitsMisses() (int64, int64) {
+	return c.hits.Load(), c.misses.Load()
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheGetOrSetRunsLoaderOnce(t *testing.T) {
+	c := NewCache[int64, string]()
+
+	var calls atomic.Int64
+	release := make(chan struct{})
+	loader := func() (string, error) {
+		calls.Add(1)
+		// 他のゴルーチンが揃ってミスするまで待たせる
+		<-release
+		return "value", nil
+	}
+
+	const n = 100
+	var (
+		wg      sync.WaitGroup
+		started sync.WaitGroup
+	)
+	results := make([]string, n)
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		started.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			started.Done()
+			results[i], errs[i] = c.GetOrSet(1, loader)
+		}(i)
+	}
+	started.Wait()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := calls.Load(); got != 1 {
+		t.Errorf("loader ran %d times, want 1", got)
+	}
+	for i := range results {
+		if errs[i] != nil || results[i] != "value" {
+			t.Errorf("GetOrSet #%d = (%q, %v), want (%q, nil)", i, results[i], errs[i], "value")
+		}
+	}
+	if v, ok := c.Get(1); !ok || v != "value" {
+		t.Errorf("Get after GetOrSet = (%q, %v), want (%q, true)", v, ok, "value")
+	}
+}
+
+func TestCacheGetOrSetDoesNotCacheErrors(t *testing.T) {
+	c := NewCache[int64, string]()
+
+	wantErr := errors.New("load failed")
+	if _, err := c.GetOrSet(1, func() (string, error) { return "", wantErr }); !errors.Is(err, wantErr) {
+		t.Fatalf("GetOrSet error = %v, want %v", err, wantErr)
+	}
+	if _, ok := c.Get(1); ok {
+		t.Fatal("failed load was cached")
+	}
+	if v, err := c.GetOrSet(1, func() (string, error) { return "value", nil }); err != nil || v != "value" {
+		t.Fatalf("GetOrSet after failure = (%q, %v), want (%q, nil)", v, err, "value")
+	}
+}
+
+func TestCacheInvalidateKeepsLocalEntry(t *testing.T) {
+	c := NewCache[int64, string]()
+	var invalidated []int64
+	c.SetInvalidateHook(func(key int64) { invalidated = append(invalidated, key) })
+
+	c.Set(1, "a")
+	c.Invalidate(1)
+	if _, ok := c.Get(1); !ok {
+		t.Error("Invalidate removed the local entry")
+	}
+
+	c.Delete(1)
+	if _, ok := c.Get(1); ok {
+		t.Error("Delete did not remove the local entry")
+	}
+	if len(invalidated) != 2 {
+		t.Errorf("invalidate hook ran %d times, want 2", len(invalidated))
+	}
+}
+
+func TestLRUCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := NewLRUCache[int64, string](2)
+
+	c.Set(1, "a")
+	c.Set(2, "b")
+	// 1を参照したので、次に追い出されるのは2
+	if _, ok := c.Get(1); !ok {
+		t.Fatal("1 is missing")
+	}
+	c.Set(3, "c")
+
+	if _, ok := c.Get(2); ok {
+		t.Error("2 was not evicted")
+	}
+	for _, key := range []int64{1, 3} {
+		if _, ok := c.Get(key); !ok {
+			t.Errorf("%d was evicted", key)
+		}
+	}
+	if got := c.Len(); got != 2 {
+		t.Errorf("Len() = %d, want 2", got)
+	}
+
+	// Setし直しても参照順が更新される
+	c.Set(1, "a2")
+	c.Set(4, "d")
+	if _, ok := c.Get(3); ok {
+		t.Error("3 was not evicted")
+	}
+	if v, ok := c.Get(1); !ok || v != "a2" {
+		t.Errorf("Get(1) = (%q, %v), want (%q, true)", v, ok, "a2")
+	}
+}
+
+func TestLRUCacheDeleteRemovesRecency(t *testing.T) {
+	c := NewLRUCache[int64, string](2)
+
+	c.Set(1, "a")
+	c.Set(2, "b")
+	c.Delete(1)
+
+	if _, ok := c.Get(1); ok {
+		t.Error("1 is still in the map")
+	}
+	if _, ok := c.elements[1]; ok {
+		t.Error("1 is still in the recency index")
+	}
+	if got := c.recency.Len(); got != 1 {
+		t.Errorf("recency.Len() = %d, want 1", got)
+	}
+
+	// 削除した分の空きがあるので、2は追い出されない
+	c.Set(3, "c")
+	if _, ok := c.Get(2); !ok {
+		t.Error("2 was evicted after Delete freed a slot")
+	}
+}
+
+func TestLRUCacheReplace(t *testing.T) {
+	c := NewLRUCache[int64, string](2)
+	c.Set(1, "a")
+	c.Replace(map[int64]string{2: "b", 3: "c"})
+
+	if _, ok := c.Get(1); ok {
+		t.Error("1 survived Replace")
+	}
+	if got := c.recency.Len(); got != 2 {
+		t.Errorf("recency.Len() = %d, want 2", got)
+	}
+}
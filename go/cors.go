@@ -0,0 +1,15 @@
+package main
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// corsAllowOriginsに含まれるオリジンからのリクエストだけを許可する
+// セッションクッキーを送れるようにcredentialsを許可する
+func corsMiddleware() echo.MiddlewareFunc {
+	return middleware.CORSWithConfig(middleware.CORSConfig{
+		AllowOrigins:     corsAllowOrigins,
+		AllowCredentials: true,
+	})
+}
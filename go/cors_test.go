@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestCORSMiddleware(t *testing.T) {
+	prev := corsAllowOrigins
+	corsAllowOrigins = []string{"https://allowed.u.isucon.dev"}
+	t.Cleanup(func() { corsAllowOrigins = prev })
+
+	e := echo.New()
+	e.Use(corsMiddleware())
+	e.GET("/api/tag", func(c echo.Context) error { return c.NoContent(http.StatusOK) })
+
+	tests := []struct {
+		name       string
+		method     string
+		origin     string
+		wantOrigin string
+	}{
+		{"allowed origin", http.MethodGet, "https://allowed.u.isucon.dev", "https://allowed.u.isucon.dev"},
+		{"preflight from allowed origin", http.MethodOptions, "https://allowed.u.isucon.dev", "https://allowed.u.isucon.dev"},
+		{"other origin", http.MethodGet, "https://evil.example.com", ""},
+		{"preflight from other origin", http.MethodOptions, "https://evil.example.com", ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/api/tag", nil)
+		req.Header.Set(echo.HeaderOrigin, tt.origin)
+		if tt.method == http.MethodOptions {
+			req.Header.Set(echo.HeaderAccessControlRequestMethod, http.MethodPost)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		if got := rec.Header().Get(echo.HeaderAccessControlAllowOrigin); got != tt.wantOrigin {
+			t.Errorf("%s: Access-Control-Allow-Origin = %q, want %q", tt.name, got, tt.wantOrigin)
+		}
+		// 許可したオリジンにはクッキー付きのリクエストも許す
+		wantCredentials := ""
+		if tt.wantOrigin != "" {
+			wantCredentials = "true"
+		}
+		if got := rec.Header().Get(echo.HeaderAccessControlAllowCredentials); got != wantCredentials {
+			t.Errorf("%s: Access-Control-Allow-Credentials = %q, want %q", tt.name, got, wantCredentials)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestCSRFMiddleware(t *testing.T) {
+	e := echo.New()
+	e.Use(csrfMiddleware())
+	e.GET("/api/csrf", getCSRFTokenHandler)
+	e.POST("/api/livestream/reservation", func(c echo.Context) error { return c.NoContent(http.StatusCreated) })
+	e.POST("/api/initialize", func(c echo.Context) error { return c.NoContent(http.StatusOK) })
+	e.HTTPErrorHandler = func(err error, c echo.Context) {
+		var he *echo.HTTPError
+		if errors.As(err, &he) {
+			c.NoContent(he.Code)
+		}
+	}
+
+	// トークンなしのPOSTは拒否される
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/livestream/reservation", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("POST without token: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	// 初期化は対象外
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/initialize", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("POST /api/initialize: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	// 発行したトークンとクッキーを送れば通る
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/csrf", nil))
+	cookies := rec.Result().Cookies()
+	if len(cookies) == 0 {
+		t.Fatal("GET /api/csrf did not set a cookie")
+	}
+	token := cookies[0].Value
+
+	req := httptest.NewRequest(http.MethodPost, "/api/livestream/reservation", nil)
+	req.Header.Set(csrfHeaderName, token)
+	req.AddCookie(cookies[0])
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Errorf("POST with token: status = %d, want %d", rec.Code, http.StatusCreated)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+type livestreamTagsLoaderKey struct{}
+
+// リクエスト内で取得した配信ごとのタグIDを覚えておく
+// ネストしたfillで同じ配信のタグを何度も引かないようにするため
+type livestreamTagsLoader struct {
+	mu     sync.Mutex
+	tagIDs map[int64][]int64
+}
+
+func livestreamTagsLoaderMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			loader := &livestreamTagsLoader{tagIDs: map[int64][]int64{}}
+			ctx := context.WithValue(c.Request().Context(), livestreamTagsLoaderKey{}, loader)
+			c.SetRequest(c.Request().WithContext(ctx))
+			return next(c)
+		}
+	}
+}
+
+// リクエストに紐づくローダを返す。ミドルウェアを通っていない場合はその場限りのローダを返す
+func livestreamTagsLoaderFrom(ctx context.Context) *livestreamTagsLoader {
+	if loader, ok := ctx.Value(livestreamTagsLoaderKey{}).(*livestreamTagsLoader); ok {
+		return loader
+	}
+	return &livestreamTagsLoader{tagIDs: map[int64][]int64{}}
+}
+
+// 配信IDごとのタグIDを返す
+// livestreamTagsCacheにもない配信IDの分だけを1回のIN句でまとめて取得する
+func (l *livestreamTagsLoader) load(ctx context.Context, db *sqlx.DB, livestreamIDs []int64) (map[int64][]int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var missingIDs []int64
+	for _, livestreamID := range livestreamIDs {
+		if _, ok := l.tagIDs[livestreamID]; ok {
+			continue
+		}
+		if tagIDs, ok := livestreamTagsCache.Get(livestreamID); ok {
+			l.tagIDs[livestreamID] = tagIDs
+			continue
+		}
+		missingIDs = append(missingIDs, livestreamID)
+	}
+
+	if len(missingIDs) > 0 {
+		var livestreamTagModels []*LivestreamTagModel
+		query, params, err := sqlx.In("SELECT * FROM livestream_tags WHERE livestream_id IN (?)", missingIDs)
+		if err != nil {
+			return nil, err
+		}
+		query = db.Rebind(query)
+		spanCtx, span := tracer.Start(ctx, "SELECT livestream_tags")
+		err = db.SelectContext(spanCtx, &livestreamTagModels, query, params...)
+		span.End()
+		if err != nil {
+			return nil, err
+		}
+
+		// タグのない配信も取得済みとして覚えておく
+		fetched := make(map[int64][]int64, len(missingIDs))
+		for _, livestreamID := range missingIDs {
+			fetched[livestreamID] = []int64{}
+		}
+		for _, livestreamTagModel := range livestreamTagModels {
+			fetched[livestreamTagModel.LivestreamID] = append(fetched[livestreamTagModel.LivestreamID], livestreamTagModel.TagID)
+		}
+		for livestreamID, tagIDs := range fetched {
+			l.tagIDs[livestreamID] = tagIDs
+			livestreamTagsCache.Set(livestreamID, tagIDs)
+		}
+	}
+
+	res := make(map[int64][]int64, len(livestreamIDs))
+	for _, livestreamID := range livestreamIDs {
+		res[livestreamID] = l.tagIDs[livestreamID]
+	}
+	return res, nil
+}
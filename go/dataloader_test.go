@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"testing"
+
+	"github.com/go-json-experiment/json"
+)
+
+func TestLivestreamTagsLoaderReusesLoadedTags(t *testing.T) {
+	f := setupHandlerTest(t)
+	f.rows("FROM livestream_tags WHERE livestream_id IN",
+		LivestreamTagModel{ID: 1, LivestreamID: 1, TagID: 10},
+		LivestreamTagModel{ID: 2, LivestreamID: 1, TagID: 11})
+
+	ctx := context.Background()
+	loader := livestreamTagsLoaderFrom(ctx)
+	for i := 0; i < 3; i++ {
+		// 他のサーバからの無効化でキャッシュが消えても、同じリクエストの中では引き直さない
+		livestreamTagsCache.Delete(1)
+		tagIDs, err := loader.load(ctx, dbConn, []int64{1, 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tagIDs[1]) != 2 || len(tagIDs[2]) != 0 {
+			t.Fatalf("tag ids = %v, want 2 tags for livestream 1 and none for 2", tagIDs)
+		}
+	}
+	if n := f.count("FROM livestream_tags"); n != 1 {
+		t.Errorf("livestream_tags queried %d times, want 1", n)
+	}
+}
+
+func TestGetReactionsLoadsTagsOnce(t *testing.T) {
+	f := setupHandlerTest(t)
+	fakeLivecommentTarget(f, LivestreamModel{ID: 1, UserID: 1}, 1)
+	livestreamModelByIdCache.Set(2, LivestreamModel{ID: 2, UserID: 1})
+	livestreamTagsCache.Delete(1)
+	f.rowsWhere("FROM tags WHERE id", "id", TagModel{ID: 10, Name: "tag10"}, TagModel{ID: 11, Name: "tag11"})
+	f.rows("FROM livestream_tags WHERE livestream_id IN",
+		LivestreamTagModel{ID: 1, LivestreamID: 1, TagID: 10},
+		LivestreamTagModel{ID: 2, LivestreamID: 2, TagID: 11})
+	// 2つの配信のリアクションが混ざっていても、タグは1回のIN句でまとめて引く
+	f.rows("SELECT * FROM reactions WHERE livestream_id",
+		ReactionModel{ID: 1, EmojiName: "smile", UserID: 1, LivestreamID: 1},
+		ReactionModel{ID: 2, EmojiName: "heart", UserID: 1, LivestreamID: 1, LivecommentID: sql.NullInt64{Int64: 1, Valid: true}},
+		ReactionModel{ID: 3, EmojiName: "tada", UserID: 1, LivestreamID: 2})
+
+	h := livestreamTagsLoaderMiddleware()(getReactionsHandler)
+	code, body, err := serveAs(1, h, http.MethodGet, "/", "", "livestream_id", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Fatalf("status = %d (%s), want %d", code, body, http.StatusOK)
+	}
+	var reactions []Reaction
+	if err := json.Unmarshal([]byte(body), &reactions); err != nil {
+		t.Fatal(err)
+	}
+	if len(reactions) != 3 || len(reactions[0].Livestream.Tags) != 1 || len(reactions[2].Livestream.Tags) != 1 {
+		t.Fatalf("reactions = %+v, want 3 reactions with their livestream tags", reactions)
+	}
+	if n := f.count("FROM livestream_tags"); n != 1 {
+		t.Errorf("livestream_tags queried %d times, want 1", n)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// この時間以上かかったクエリをログに出す (0なら無効)
+var slowQueryThreshold time.Duration
+
+func useDBHook() bool {
+	return enableMetrics || slowQueryThreshold > 0
+}
+
+func afterQuery(query string, args []driver.NamedValue, elapsed time.Duration) {
+	if enableMetrics {
+		observeDBQuery(query, elapsed)
+	}
+	if slowQueryThreshold > 0 && elapsed >= slowQueryThreshold {
+		log.Printf("slow query (%s): %s %s", elapsed, strings.Join(strings.Fields(query), " "), sanitizeQueryArgs(args))
+	}
+}
+
+// 画像などの大きな値をそのままログに出さないように切り詰める
+func sanitizeQueryArgs(args []driver.NamedValue) string {
+	const maxLen = 64
+	values := make([]string, len(args))
+	for i, arg := range args {
+		switch v := arg.Value.(type) {
+		case []byte:
+			values[i] = fmt.Sprintf("<%d bytes>", len(v))
+		case string:
+			if len(v) > maxLen {
+				v = v[:maxLen] + "..."
+			}
+			values[i] = fmt.Sprintf("%q", v)
+		default:
+			values[i] = fmt.Sprint(v)
+		}
+	}
+	return "[" + strings.Join(values, ", ") + "]"
+}
+
+// クエリの所要時間を計測するためにmysqlドライバのコネクションをラップする
+// メトリクスかスロークエリログが有効な場合だけ使う
+type instrumentedConnector struct {
+	driver.Connector
+}
+
+func (c instrumentedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedConn{Conn: conn}, nil
+}
+
+type instrumentedConn struct {
+	driver.Conn
+}
+
+func (c *instrumentedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	rows, err := queryer.QueryContext(ctx, query, args)
+	afterQuery(query, args, time.Since(start))
+	return rows, err
+}
+
+func (c *instrumentedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	result, err := execer.ExecContext(ctx, query, args)
+	afterQuery(query, args, time.Since(start))
+	return result, err
+}
+
+func (c *instrumentedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return preparer.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c *instrumentedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *instrumentedConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *instrumentedConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *instrumentedConn) IsValid() bool {
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+func (c *instrumentedConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
-	"slices"
 	"sync"
+	"time"
 
 	"github.com/miekg/dns"
 )
@@ -1305,19 +1308,127 @@ var (
 		"satomi130.u.isucon.dev.",
 		"tomoya450.u.isucon.dev.",
 	}
-	subdomains   = defaultSubdomains
+	subdomains   = newSubdomainSet(defaultSubdomains)
 	muSubdomains = sync.RWMutex{}
+
+	dnsServer = &dns.Server{Addr: ":53", Net: "udp"}
 )
 
 func resetSubdomains() {
 	muSubdomains.Lock()
 	defer muSubdomains.Unlock()
-	subdomains = defaultSubdomains
+
+	subdomains = newSubdomainSet(defaultSubdomains)
+}
+
+// 同じ名前を何度登録しても1件になるように集合で持つ
+func newSubdomainSet(names []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		set[name] = struct{}{}
+	}
+	return set
 }
+
+// ユーザー名から登録するサブドメインのFQDNを組み立てる
+func userSubdomain(name string) string {
+	return name + ".u.isucon.dev."
+}
+
 func addSubdomain(subdomain string) {
+	addSubdomains(subdomain)
+}
+
+var (
+	// サブドメイン登録の試行回数と初回の待ち時間 (待ち時間は失敗するたびに倍にする)
+	subdomainRetryAttempts = 3
+	subdomainRetryBackoff  = 50 * time.Millisecond
+
+	// サブドメインを1件登録する (テストで失敗するスタブに差し替えられるように変数にしておく)
+	// 今はプロセス内の集合に足すだけで失敗しないが、PowerDNSのAPIを叩く実装に戻しても再試行の経路はそのまま使える
+	registerSubdomain = func(ctx context.Context, subdomain string) error {
+		addSubdomain(subdomain)
+		return nil
+	}
+)
+
+// サブドメインの登録を指数バックオフで再試行する
+func registerSubdomainWithRetry(ctx context.Context, subdomain string) error {
+	backoff := subdomainRetryBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = registerSubdomain(ctx, subdomain); err == nil {
+			return nil
+		}
+		if attempt >= subdomainRetryAttempts {
+			return fmt.Errorf("failed to register subdomain %s after %d attempts: %w", subdomain, attempt, err)
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// 複数のサブドメインを一度のロックでまとめて登録する
+// 既に登録済みの名前は重複させない
+func addSubdomains(newSubdomains ...string) {
+	muSubdomains.Lock()
+	defer muSubdomains.Unlock()
+	for _, subdomain := range newSubdomains {
+		subdomains[subdomain] = struct{}{}
+	}
+}
+
+// サブドメインを1件削除する。登録されていなかった場合はfalseを返す
+func removeSubdomain(subdomain string) bool {
 	muSubdomains.Lock()
 	defer muSubdomains.Unlock()
-	subdomains = append(subdomains, subdomain)
+	if _, ok := subdomains[subdomain]; !ok {
+		return false
+	}
+	delete(subdomains, subdomain)
+	return true
+}
+
+// サブドメインが登録されているかを返す
+func hasSubdomain(subdomain string) bool {
+	muSubdomains.RLock()
+	defer muSubdomains.RUnlock()
+	_, ok := subdomains[subdomain]
+	return ok
+}
+
+// PowerDNS関連の環境変数を検証し、サブドメインのアドレスを返す
+func validatePowerDNSEnv() (string, error) {
+	subdomainAddr, ok := os.LookupEnv(powerDNSSubdomainAddressEnvKey)
+	if !ok || subdomainAddr == "" {
+		return "", fmt.Errorf("environ %s must be provided", powerDNSSubdomainAddressEnvKey)
+	}
+	if net.ParseIP(subdomainAddr) == nil {
+		return "", fmt.Errorf("environ %s must be an IP address: %q", powerDNSSubdomainAddressEnvKey, subdomainAddr)
+	}
+
+	serverHost, ok := os.LookupEnv(powerDNSServerHostEnvKey)
+	if !ok || serverHost == "" {
+		return "", fmt.Errorf("environ %s must be provided", powerDNSServerHostEnvKey)
+	}
+	u, err := url.Parse(serverHost)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("environ %s must be a URL like http://host:port: %q", powerDNSServerHostEnvKey, serverHost)
+	}
+
+	return subdomainAddr, nil
+}
+
+// IPv6アドレスの場合はAAAAレコードで返す
+func addressRecordType(addr string) string {
+	if ip := net.ParseIP(addr); ip != nil && ip.To4() == nil {
+		return "AAAA"
+	}
+	return "A"
 }
 
 func startDNS() error {
@@ -1325,6 +1436,7 @@ func startDNS() error {
 	if !ok {
 		return errors.New("powerdns subdomain address is not set")
 	}
+	recordType := addressRecordType(subdomainAdder)
 
 	dns.HandleFunc("u.isucon.dev.", func(w dns.ResponseWriter, r *dns.Msg) {
 		m := new(dns.Msg)
@@ -1334,15 +1446,12 @@ func startDNS() error {
 				newRR("u.isucon.dev. 3600 IN NS ns1.u.isucon.dev."),
 			}
 			m.Extra = []dns.RR{
-				newRR("ns1.u.isucon.dev. 3600 IN A " + subdomainAdder),
+				newRR("ns1.u.isucon.dev. 3600 IN " + recordType + " " + subdomainAdder),
 			}
 		} else {
-			muSubdomains.RLock()
-			defer muSubdomains.RUnlock()
-
-			if slices.Contains(subdomains, r.Question[0].Name) {
+			if hasSubdomain(r.Question[0].Name) {
 				m.Answer = []dns.RR{
-					newRR(r.Question[0].Name + " 3600 IN A " + subdomainAdder),
+					newRR(r.Question[0].Name + " 3600 IN " + recordType + " " + subdomainAdder),
 				}
 			} else {
 				return
@@ -1354,8 +1463,7 @@ func startDNS() error {
 
 	fmt.Println(">>>> STARTING DNS SERVER <<<<")
 
-	srv := &dns.Server{Addr: ":53", Net: "udp"}
-	err := srv.ListenAndServe()
+	err := dnsServer.ListenAndServe()
 	if err != nil {
 		println("dns server error", err.Error())
 		return err
@@ -1363,3 +1471,9 @@ func startDNS() error {
 
 	return nil
 }
+
+func stopDNS() {
+	if err := dnsServer.Shutdown(); err != nil {
+		println("dns server shutdown error", err.Error())
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAddSubdomainsBatch(t *testing.T) {
+	resetSubdomains()
+	t.Cleanup(resetSubdomains)
+
+	before := len(subdomains)
+	// 初期データのユーザーはdefaultSubdomainsにも載っているので重複して登録される
+	addSubdomains(defaultSubdomains[0], defaultSubdomains[1], "newuser.u.isucon.dev.", "newuser.u.isucon.dev.")
+
+	if got, want := len(subdomains), before+1; got != want {
+		t.Fatalf("len(subdomains) = %d, want %d", got, want)
+	}
+	if !hasSubdomain("newuser.u.isucon.dev.") {
+		t.Fatal("newuser.u.isucon.dev. is not registered")
+	}
+}
+
+func TestRemoveSubdomainAfterDuplicateAdd(t *testing.T) {
+	resetSubdomains()
+	t.Cleanup(resetSubdomains)
+
+	name := defaultSubdomains[0]
+	addSubdomains(name)
+
+	if !removeSubdomain(name) {
+		t.Fatalf("removeSubdomain(%q) = false, want true", name)
+	}
+	if hasSubdomain(name) {
+		t.Fatalf("%q still resolves after removeSubdomain", name)
+	}
+	if removeSubdomain(name) {
+		t.Fatalf("second removeSubdomain(%q) = true, want false", name)
+	}
+}
+
+func TestResetSubdomainsDoesNotShareDefaults(t *testing.T) {
+	resetSubdomains()
+	t.Cleanup(resetSubdomains)
+
+	name := defaultSubdomains[0]
+	removeSubdomain(name)
+	resetSubdomains()
+
+	if !hasSubdomain(name) {
+		t.Fatalf("%q is missing after resetSubdomains", name)
+	}
+}
+
+func TestValidatePowerDNSEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		addr    string
+		host    string
+		wantErr bool
+	}{
+		{"ipv4", "127.0.0.1", "http://127.0.0.1:8081", false},
+		{"ipv6", "::1", "http://[::1]:8081", false},
+		{"missing address", "", "http://127.0.0.1:8081", true},
+		{"invalid address", "example.com", "http://127.0.0.1:8081", true},
+		{"missing host", "127.0.0.1", "", true},
+		{"invalid host", "127.0.0.1", "127.0.0.1", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(powerDNSSubdomainAddressEnvKey, tt.addr)
+			t.Setenv(powerDNSServerHostEnvKey, tt.host)
+			addr, err := validatePowerDNSEnv()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validatePowerDNSEnv() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && addr != tt.addr {
+				t.Errorf("validatePowerDNSEnv() = %q, want %q", addr, tt.addr)
+			}
+		})
+	}
+}
+
+func TestSubdomainRecord(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"127.0.0.1", "A"},
+		{"::1", "AAAA"},
+		{"2001:db8::1", "AAAA"},
+	}
+	for _, tt := range tests {
+		recordType := addressRecordType(tt.addr)
+		if recordType != tt.want {
+			t.Errorf("addressRecordType(%q) = %q, want %q", tt.addr, recordType, tt.want)
+		}
+		name := userSubdomain("test")
+		rr := newRR(name + " 3600 IN " + recordType + " " + tt.addr)
+		if rr == nil {
+			t.Fatalf("newRR returned nil for %s %s", recordType, tt.addr)
+		}
+		if rr.Header().Name != "test.u.isucon.dev." || rr.Header().Ttl != 3600 {
+			t.Errorf("record header = %+v, want test.u.isucon.dev. with ttl 3600", rr.Header())
+		}
+	}
+}
+
+// 指定した回数だけ失敗してから成功するサブドメイン登録のスタブに差し替える
+func stubRegisterSubdomain(t *testing.T, failures int) *int {
+	t.Helper()
+	prevRegister, prevAttempts, prevBackoff := registerSubdomain, subdomainRetryAttempts, subdomainRetryBackoff
+	t.Cleanup(func() {
+		registerSubdomain, subdomainRetryAttempts, subdomainRetryBackoff = prevRegister, prevAttempts, prevBackoff
+	})
+	subdomainRetryBackoff = time.Millisecond
+
+	calls := 0
+	registerSubdomain = func(ctx context.Context, subdomain string) error {
+		calls++
+		if calls <= failures {
+			return errors.New("powerdns is unavailable")
+		}
+		addSubdomain(subdomain)
+		return nil
+	}
+	return &calls
+}
+
+func TestRegisterSubdomainWithRetryRecovers(t *testing.T) {
+	resetSubdomains()
+	t.Cleanup(resetSubdomains)
+	calls := stubRegisterSubdomain(t, 2)
+	subdomainRetryAttempts = 3
+
+	name := userSubdomain("retry")
+	if err := registerSubdomainWithRetry(context.Background(), name); err != nil {
+		t.Fatalf("registerSubdomainWithRetry() error = %v, want nil", err)
+	}
+	if *calls != 3 {
+		t.Errorf("registerSubdomain ran %d times, want 3", *calls)
+	}
+	if !hasSubdomain(name) {
+		t.Errorf("%q is not registered", name)
+	}
+}
+
+func TestRegisterSubdomainWithRetryGivesUp(t *testing.T) {
+	resetSubdomains()
+	t.Cleanup(resetSubdomains)
+	calls := stubRegisterSubdomain(t, 10)
+	subdomainRetryAttempts = 2
+
+	name := userSubdomain("retry")
+	if err := registerSubdomainWithRetry(context.Background(), name); err == nil {
+		t.Fatal("registerSubdomainWithRetry() error = nil, want an error")
+	}
+	if *calls != 2 {
+		t.Errorf("registerSubdomain ran %d times, want 2", *calls)
+	}
+	if hasSubdomain(name) {
+		t.Errorf("%q is registered after every attempt failed", name)
+	}
+}
+
+func TestRegisterSubdomainWithRetryStopsOnCancel(t *testing.T) {
+	calls := stubRegisterSubdomain(t, 10)
+	subdomainRetryAttempts = 5
+	subdomainRetryBackoff = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := registerSubdomainWithRetry(ctx, userSubdomain("retry")); !errors.Is(err, context.Canceled) {
+		t.Fatalf("registerSubdomainWithRetry() error = %v, want context.Canceled", err)
+	}
+	if *calls != 1 {
+		t.Errorf("registerSubdomain ran %d times, want 1", *calls)
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// MySQLなしでハンドラを動かすためのdatabase/sqlドライバ
+// クエリに含まれる文字列ごとに返す結果を登録しておき、実行されたクエリを記録する
+type fakeDB struct {
+	mu        sync.Mutex
+	rules     []fakeRule
+	queries   []string
+	commitErr error
+	// クエリごとに待たせる時間 (タイムアウトの確認用)
+	delay     time.Duration
+	commits   int
+	rollbacks int
+}
+
+type fakeRule struct {
+	substr string
+	fn     func(args []driver.Value) fakeResponse
+}
+
+type fakeResponse struct {
+	columns      []string
+	rows         [][]driver.Value
+	lastInsertID int64
+	rowsAffected int64
+	err          error
+}
+
+// dbConnを差し替える。テストが終わったら元に戻す
+func useFakeDB(t testing.TB) *fakeDB {
+	t.Helper()
+	f := &fakeDB{}
+	conn := sqlx.NewDb(sql.OpenDB(f), "mysql")
+	prevDB, prevReplica := dbConn, replicaConn
+	dbConn, replicaConn = conn, nil
+	t.Cleanup(func() {
+		dbConn, replicaConn = prevDB, prevReplica
+		closePreparedStmts(conn)
+		conn.Close()
+	})
+	return f
+}
+
+// キャッシュと集計値を空にして、テストが終わったらもう一度空にする
+func resetCaches(t testing.TB) {
+	t.Helper()
+	reset := func() {
+		initCaches()
+		globalRanking.invalidate()
+		globalPopularTags.invalidate()
+		globalEmojiTally.mu.Lock()
+		globalEmojiTally.counts = map[int64]map[string]int64{}
+		globalEmojiTally.mu.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+// ハンドラのテストで使うDB、キャッシュ、アイコンの置き場所をテストごとに用意する
+func setupHandlerTest(t testing.TB) *fakeDB {
+	t.Helper()
+	f := useFakeDB(t)
+	resetCaches(t)
+	prevDir := iconDir
+	iconDir = t.TempDir() + string(filepath.Separator)
+	t.Cleanup(func() { iconDir = prevDir })
+	return f
+}
+
+// substrを含むクエリにfnの結果を返す。後から登録したものが優先される
+func (f *fakeDB) on(substr string, fn func(args []driver.Value) fakeResponse) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rules = append(f.rules, fakeRule{substr: substr, fn: fn})
+}
+
+// substrを含むクエリにrowsOfで作った行を返す
+func (f *fakeDB) rows(substr string, models ...any) {
+	res := rowsOf(models...)
+	f.on(substr, func([]driver.Value) fakeResponse { return res })
+}
+
+// substrを含むクエリに、column列が1つ目の引数と一致する行だけを返す
+func (f *fakeDB) rowsWhere(substr string, column string, models ...any) {
+	all := rowsOf(models...)
+	f.on(substr, func(args []driver.Value) fakeResponse {
+		res := fakeResponse{columns: all.columns}
+		for _, row := range all.rows {
+			for i, name := range all.columns {
+				if name == column && len(args) > 0 && row[i] == args[0] {
+					res.rows = append(res.rows, row)
+				}
+			}
+		}
+		return res
+	})
+}
+
+// substrを含むクエリに1列の値を返す (COUNTなど)
+func (f *fakeDB) value(substr string, column string, v driver.Value) {
+	f.on(substr, func([]driver.Value) fakeResponse {
+		return fakeResponse{columns: []string{column}, rows: [][]driver.Value{{v}}}
+	})
+}
+
+// substrを含む更新系のクエリを成功させる
+func (f *fakeDB) exec(substr string, lastInsertID int64) {
+	f.on(substr, func([]driver.Value) fakeResponse {
+		return fakeResponse{lastInsertID: lastInsertID, rowsAffected: 1}
+	})
+}
+
+// substrを含むクエリが実行された回数
+func (f *fakeDB) count(substr string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, q := range f.queries {
+		if strings.Contains(q, substr) {
+			n++
+		}
+	}
+	return n
+}
+
+// 最後に実行されたクエリ
+func (f *fakeDB) lastQuery() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.queries) == 0 {
+		return ""
+	}
+	return f.queries[len(f.queries)-1]
+}
+
+func (f *fakeDB) respond(ctx context.Context, query string, args []driver.NamedValue) (fakeResponse, error) {
+	f.mu.Lock()
+	f.queries = append(f.queries, query)
+	delay := f.delay
+	var rule *fakeRule
+	for i := len(f.rules) - 1; i >= 0; i-- {
+		if strings.Contains(query, f.rules[i].substr) {
+			rule = &f.rules[i]
+			break
+		}
+	}
+	f.mu.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-ctx.Done():
+			return fakeResponse{}, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+	if rule == nil {
+		return fakeResponse{}, errors.New("fakedb: unexpected query: " + query)
+	}
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	res := rule.fn(values)
+	return res, res.err
+}
+
+// 構造体のdbタグを列名にして行を作る
+func rowsOf(models ...any) fakeResponse {
+	var res fakeResponse
+	for i, m := range models {
+		v := reflect.ValueOf(m)
+		row := make([]driver.Value, 0, v.NumField())
+		for j := 0; j < v.NumField(); j++ {
+			tag := v.Type().Field(j).Tag.Get("db")
+			if tag == "" {
+				continue
+			}
+			if i == 0 {
+				res.columns = append(res.columns, tag)
+			}
+			row = append(row, driverValue(v.Field(j)))
+		}
+		res.rows = append(res.rows, row)
+	}
+	return res
+}
+
+func driverValue(v reflect.Value) driver.Value {
+	if valuer, ok := v.Interface().(driver.Valuer); ok {
+		dv, _ := valuer.Value()
+		return dv
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int()
+	case reflect.Bool:
+		return v.Bool()
+	case reflect.String:
+		return v.String()
+	default:
+		return v.Interface()
+	}
+}
+
+func (f *fakeDB) Connect(context.Context) (driver.Conn, error) { return &fakeConn{db: f}, nil }
+func (f *fakeDB) Driver() driver.Driver                        { return fakeDriver{f} }
+
+type fakeDriver struct{ db *fakeDB }
+
+func (d fakeDriver) Open(string) (driver.Conn, error) { return &fakeConn{db: d.db}, nil }
+
+type fakeConn struct{ db *fakeDB }
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{conn: c, query: query}, nil
+}
+func (c *fakeConn) Close() error              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) { return &fakeTx{db: c.db}, nil }
+
+func (c *fakeConn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	return &fakeTx{db: c.db}, nil
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	res, err := c.db.respond(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{columns: res.columns, rows: res.rows}, nil
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	res, err := c.db.respond(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	return fakeResult{lastInsertID: res.lastInsertID, rowsAffected: res.rowsAffected}, nil
+}
+
+type fakeStmt struct {
+	conn  *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.conn.ExecContext(context.Background(), s.query, namedValues(args))
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.conn.QueryContext(context.Background(), s.query, namedValues(args))
+}
+
+func (s *fakeStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	return s.conn.ExecContext(ctx, s.query, args)
+}
+
+func (s *fakeStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	return s.conn.QueryContext(ctx, s.query, args)
+}
+
+func namedValues(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, v := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: v}
+	}
+	return named
+}
+
+type fakeTx struct{ db *fakeDB }
+
+func (tx *fakeTx) Commit() error {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+	if tx.db.commitErr != nil {
+		tx.db.rollbacks++
+		return tx.db.commitErr
+	}
+	tx.db.commits++
+	return nil
+}
+
+func (tx *fakeTx) Rollback() error {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+	tx.db.rollbacks++
+	return nil
+}
+
+type fakeResult struct {
+	lastInsertID int64
+	rowsAffected int64
+}
+
+func (r fakeResult) LastInsertId() (int64, error) { return r.lastInsertID, nil }
+func (r fakeResult) RowsAffected() (int64, error) { return r.rowsAffected, nil }
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+	next    int
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.next])
+	r.next++
+	return nil
+}
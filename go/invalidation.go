@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/go-json-experiment/json"
+	"github.com/go-json-experiment/json/jsontext"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// 複数台構成のときだけRedis経由でキャッシュの破棄を伝搬する
+const cacheInvalidationChannel = "isupipe:cache-invalidation"
+
+var (
+	redisAddress = ""
+	// 自分がpublishしたメッセージを無視するための識別子
+	instanceID = uuid.NewString()
+)
+
+type cacheInvalidationMessage struct {
+	Origin string         `json:"origin"`
+	Cache  string         `json:"cache"`
+	Key    jsontext.Value `json:"key"`
+}
+
+type invalidatable interface {
+	deleteLocalEncoded(key []byte) error
+}
+
+func (c *cache[K, V]) deleteLocalEncoded(key []byte) error {
+	var k K
+	if err := json.Unmarshal(key, &k); err != nil {
+		return err
+	}
+	c.deleteLocal(k)
+	return nil
+}
+
+func setInvalidateHook[K comparable, V any](rdb *redis.Client, name string, c *cache[K, V]) {
+	c.SetInvalidateHook(func(key K) {
+		encodedKey, err := json.Marshal(key)
+		if err != nil {
+			log.Printf("failed to encode cache key: %v", err)
+			return
+		}
+		msg, err := json.Marshal(cacheInvalidationMessage{
+			Origin: instanceID,
+			Cache:  name,
+			Key:    encodedKey,
+		})
+		if err != nil {
+			log.Printf("failed to encode cache invalidation: %v", err)
+			return
+		}
+		if err := rdb.Publish(context.Background(), cacheInvalidationChannel, msg).Err(); err != nil {
+			log.Printf("failed to publish cache invalidation: %v", err)
+		}
+	})
+}
+
+func startCacheInvalidation(ctx context.Context) error {
+	rdb := redis.NewClient(&redis.Options{Addr: redisAddress})
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		return err
+	}
+
+	caches := map[string]invalidatable{
+		"hash":                 hashCache,
+		"theme":                themeCache,
+		"tag_model":            tagModelCache,
+		"user_model_by_id":     userModelByIdCache,
+		"user_model_by_name":   userModelByNameCache,
+		"livestream_by_id":     livestreamModelByIdCache,
+		"livestreams_by_owner": livestreamModelByUserIDCache,
+		"viewers_count":        viewersCountCache,
+		"livestream_tags":      livestreamTagsCache,
+	}
+	setInvalidateHook(rdb, "hash", hashCache)
+	setInvalidateHook(rdb, "theme", themeCache)
+	setInvalidateHook(rdb, "tag_model", tagModelCache)
+	setInvalidateHook(rdb, "user_model_by_id", userModelByIdCache)
+	setInvalidateHook(rdb, "user_model_by_name", userModelByNameCache)
+	setInvalidateHook(rdb, "livestream_by_id", livestreamModelByIdCache)
+	setInvalidateHook(rdb, "livestreams_by_owner", livestreamModelByUserIDCache)
+	setInvalidateHook(rdb, "viewers_count", viewersCountCache)
+	setInvalidateHook(rdb, "livestream_tags", livestreamTagsCache)
+
+	sub := rdb.Subscribe(ctx, cacheInvalidationChannel)
+	go func() {
+		for m := range sub.Channel() {
+			var msg cacheInvalidationMessage
+			if err := json.Unmarshal([]byte(m.Payload), &msg); err != nil {
+				log.Printf("failed to decode cache invalidation: %v", err)
+				continue
+			}
+			if msg.Origin == instanceID {
+				continue
+			}
+			c, ok := caches[msg.Cache]
+			if !ok {
+				continue
+			}
+			if err := c.deleteLocalEncoded(msg.Key); err != nil {
+				log.Printf("failed to invalidate %s cache: %v", msg.Cache, err)
+			}
+		}
+	}()
+
+	return nil
+}
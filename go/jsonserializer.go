@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/go-json-experiment/json"
+	"github.com/go-json-experiment/json/jsontext"
+	"github.com/labstack/echo/v4"
+)
+
+// encoding/jsonと出力を揃えるためのオプション
+// 不正なUTF-8は置き換え、mapのキーはソートし、nilのslice/mapはnullに、<>&やU+2028/U+2029はエスケープして出力する
+// boolや数値のゼロ値を省くにはomitemptyではなくomitzeroを付ける
+var jsonMarshalOptions = json.JoinOptions(
+	jsontext.AllowInvalidUTF8(true),
+	json.Deterministic(true),
+	json.FormatNilSliceAsNull(true),
+	json.FormatNilMapAsNull(true),
+	jsontext.EscapeForHTML(true),
+	jsontext.EscapeForJS(true),
+)
+
+// c.JSONでもgo-json-experimentでエンコードするためのSerializer
+type jsonSerializer struct{}
+
+func (jsonSerializer) Serialize(c echo.Context, i interface{}, indent string) error {
+	opts := []json.Options{jsonMarshalOptions}
+	if indent != "" {
+		opts = append(opts, jsontext.WithIndent(indent))
+	}
+	return json.MarshalWrite(c.Response(), i, opts...)
+}
+
+func (jsonSerializer) Deserialize(c echo.Context, i interface{}) error {
+	if err := json.UnmarshalRead(c.Request().Body, i); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json").SetInternal(err)
+	}
+	return nil
+}
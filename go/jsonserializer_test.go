@@ -0,0 +1,49 @@
+package main
+
+import (
+	stdjson "encoding/json"
+	"testing"
+
+	"github.com/go-json-experiment/json"
+)
+
+func TestJSONMarshalOptionsMatchEncodingJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		v    any
+	}{
+		{"nil slice", struct {
+			Tags []*Tag `json:"tags"`
+		}{}},
+		{"empty slice", TagsResponse{Tags: []*Tag{}}},
+		{"nil map", struct {
+			M map[string]int64 `json:"m"`
+		}{}},
+		{"map keys", map[string]int64{"b": 2, "a": 1, "c": 3}},
+		{"html", Tag{ID: 1, Name: "<script>&</script>"}},
+		{"js separators", Tag{ID: 1, Name: "a b c"}},
+		{"invalid utf8", Tag{ID: 1, Name: "a\xffb"}},
+		{"omitempty bool false", CreateIndexResult{Query: "CREATE INDEX idx ON t (c)"}},
+		{"omitempty bool true", CreateIndexResult{Query: "CREATE INDEX idx ON t (c)", AlreadyExists: true}},
+		{"hidden livecomment", []Livecomment{{ID: 1, Comment: "hi"}, {ID: 2, Comment: "bye", Hidden: true}}},
+		{"user without optional fields", User{ID: 1, Name: "test"}},
+		{"user", User{ID: 1, Name: "test", DisplayName: "テスト", Description: "a\nb", Theme: Theme{ID: 1, DarkMode: true}, IconHash: "abc", HasIcon: true}},
+		{"nil pointer", Reaction{ID: 1, EmojiName: "smile"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want, err := stdjson.Marshal(tt.v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := json.Marshal(tt.v, jsonMarshalOptions)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(want) {
+				t.Errorf("got  %s\nwant %s", got, want)
+			}
+		})
+	}
+}
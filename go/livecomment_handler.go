@@ -11,13 +11,17 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
-	"time"
+	"unicode/utf8"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
+	"golang.org/x/text/unicode/norm"
 )
 
+// ライブコメントの最大文字数 (livecomments.commentはVARCHAR(255))
+var maxLivecommentLength = 255
+
 type PostLivecommentRequest struct {
 	Comment string `json:"comment"`
 	Tip     int64  `json:"tip"`
@@ -29,6 +33,7 @@ type LivecommentModel struct {
 	LivestreamID int64  `db:"livestream_id"`
 	Comment      string `db:"comment"`
 	Tip          int64  `db:"tip"`
+	Hidden       bool   `db:"hidden"`
 	CreatedAt    int64  `db:"created_at"`
 }
 
@@ -38,13 +43,26 @@ type Livecomment struct {
 	Livestream Livestream `json:"livestream"`
 	Comment    string     `json:"comment"`
 	Tip        int64      `json:"tip"`
+	Hidden     bool       `json:"hidden,omitempty,omitzero"`
 	CreatedAt  int64      `json:"created_at"`
 }
 
+type LivecommentsWithTipTotal struct {
+	Livecomments []Livecomment `json:"livecomments"`
+	TipTotal     int64         `json:"tip_total"`
+}
+
+type LivecommentBounds struct {
+	// コメントがない場合はnull
+	FirstCreatedAt *int64 `json:"first_created_at" db:"first_created_at"`
+	LastCreatedAt  *int64 `json:"last_created_at" db:"last_created_at"`
+}
+
 type LivecommentReport struct {
 	ID          int64       `json:"id"`
 	Reporter    User        `json:"reporter"`
 	Livecomment Livecomment `json:"livecomment"`
+	Resolved    bool        `json:"resolved"`
 	CreatedAt   int64       `json:"created_at"`
 }
 
@@ -53,11 +71,14 @@ type LivecommentReportModel struct {
 	UserID        int64 `db:"user_id"`
 	LivestreamID  int64 `db:"livestream_id"`
 	LivecommentID int64 `db:"livecomment_id"`
+	Resolved      bool  `db:"resolved"`
 	CreatedAt     int64 `db:"created_at"`
 }
 
 type ModerateRequest struct {
 	NGWord string `json:"ng_word"`
+	// 配信者のすべての配信に登録する
+	ApplyAll bool `json:"apply_all"`
 }
 
 type NGWord struct {
@@ -81,17 +102,50 @@ func getLivecommentsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 
-	query := "SELECT * FROM livecomments WHERE livestream_id = ? ORDER BY created_at DESC"
+	// 非表示のコメントは配信者が明示した場合のみ返す
+	includeHidden := false
+	if c.QueryParam("include_hidden") != "" {
+		includeHidden, err = strconv.ParseBool(c.QueryParam("include_hidden"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "include_hidden query parameter must be boolean")
+		}
+	}
+	if includeHidden {
+		livestreamModel, ok := livestreamModelByIdCache.Get(int64(livestreamID))
+		if !ok {
+			return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+		}
+
+		// error already checked
+		sess, _ := session.Get(defaultSessionIDKey, c)
+		// existence already checked
+		userID := sess.Values[defaultUserIDKey].(int64)
+
+		if livestreamModel.UserID != userID {
+			return echo.NewHTTPError(http.StatusForbidden, "can't get other streamer's hidden livecomments")
+		}
+	}
+
+	query := "SELECT * FROM livecomments WHERE livestream_id = ? AND hidden = FALSE ORDER BY created_at DESC"
+	if includeHidden {
+		query = "SELECT * FROM livecomments WHERE livestream_id = ? ORDER BY created_at DESC"
+	}
+	args := []interface{}{livestreamID}
 	if c.QueryParam("limit") != "" {
 		limit, err := strconv.Atoi(c.QueryParam("limit"))
 		if err != nil {
 			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
 		}
-		query += fmt.Sprintf(" LIMIT %d", limit)
+		query += " LIMIT ?"
+		args = append(args, limit)
 	}
 
+	stmt, err := preparedStmt(ctx, dbConn, query)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to prepare query: "+err.Error())
+	}
 	livecommentModels := []LivecommentModel{}
-	err = dbConn.SelectContext(ctx, &livecommentModels, query, livestreamID)
+	err = stmt.SelectContext(ctx, &livecommentModels, args...)
 	if errors.Is(err, sql.ErrNoRows) {
 		return c.JSON(http.StatusOK, []*Livecomment{})
 	}
@@ -104,7 +158,41 @@ func getLivecommentsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fil livecomments: "+err.Error())
 	}
 
-	return c.JSON(http.StatusOK, livecomments)
+	// 指定された場合だけ配信のチップ合計を添えて返す
+	if c.QueryParam("with_tip_total") == "1" {
+		var tipTotal int64
+		if err := dbConn.GetContext(ctx, &tipTotal, "SELECT IFNULL(SUM(tip), 0) FROM livecomments WHERE livestream_id = ? AND hidden = FALSE", livestreamID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tip total: "+err.Error())
+		}
+		return c.JSON(http.StatusOK, &LivecommentsWithTipTotal{
+			Livecomments: livecomments,
+			TipTotal:     tipTotal,
+		})
+	}
+
+	return streamJSONArray(c, http.StatusOK, livecomments)
+}
+
+// 配信の最初と最後のライブコメントの投稿時刻
+// GET /api/livestream/:livestream_id/livecomment/bounds
+func getLivecommentBoundsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var bounds LivecommentBounds
+	if err := dbConn.GetContext(ctx, &bounds, "SELECT MIN(created_at) AS first_created_at, MAX(created_at) AS last_created_at FROM livecomments WHERE livestream_id = ? AND hidden = FALSE", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment bounds: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, bounds)
 }
 
 func getNgwords(c echo.Context) error {
@@ -136,9 +224,104 @@ func getNgwords(c echo.Context) error {
 	return c.JSON(http.StatusOK, ngWords)
 }
 
+// 配信に登録されたNGワードをすべて削除
+// DELETE /api/livestream/:livestream_id/ngwords
+func deleteNgwordsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	livestreamModel, ok := livestreamModelByIdCache.Get(int64(livestreamID))
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+	}
+	if livestreamModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't delete other streamer's NG words")
+	}
+
+	// NGワードはキャッシュせず投稿のたびにDBから引いているので、行を消せばすぐに反映される
+	rs, err := dbConn.ExecContext(ctx, "DELETE FROM ng_words WHERE livestream_id = ?", livestreamID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete NG words: "+err.Error())
+	}
+	deleted, err := rs.RowsAffected()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get deleted NG word count: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"deleted": deleted,
+	})
+}
+
+// 配信に登録されたNGワードを1件削除
+// 既に非表示にしたコメントは元に戻さない
+// DELETE /api/livestream/:livestream_id/ngwords/:word_id
+func deleteNgwordHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	wordID, err := strconv.Atoi(c.Param("word_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "word_id in path must be integer")
+	}
+
+	livestreamModel, ok := livestreamModelByIdCache.Get(int64(livestreamID))
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+	}
+	if livestreamModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't delete other streamer's NG words")
+	}
+
+	var ngword NGWord
+	if err := dbConn.GetContext(ctx, &ngword, "SELECT * FROM ng_words WHERE id = ?", wordID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found NG word that has the given id")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG word: "+err.Error())
+	}
+	if ngword.LivestreamID != int64(livestreamID) {
+		return echo.NewHTTPError(http.StatusNotFound, "not found NG word that has the given id")
+	}
+	if ngword.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't delete other user's NG words")
+	}
+
+	if _, err := dbConn.ExecContext(ctx, "DELETE FROM ng_words WHERE id = ?", wordID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete NG word: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
 func postLivecommentHandler(c echo.Context) error {
 	ctx := c.Request().Context()
-	defer c.Request().Body.Close()
 
 	if err := verifyUserSession(c); err != nil {
 		return err
@@ -154,9 +337,16 @@ func postLivecommentHandler(c echo.Context) error {
 	// existence already checked
 	userID := sess.Values[defaultUserIDKey].(int64)
 
-	var req *PostLivecommentRequest
-	if err := json.UnmarshalRead(c.Request().Body, &req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	var req PostLivecommentRequest
+	if err := decodeJSON(c, &req); err != nil {
+		return err
+	}
+
+	if utf8.RuneCountInString(req.Comment) > maxLivecommentLength {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("comment must be at most %d characters", maxLivecommentLength))
+	}
+	if req.Tip < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "tip must not be negative")
 	}
 
 	livestreamModel, ok := livestreamModelByIdCache.Get(int64(livestreamID))
@@ -172,7 +362,7 @@ func postLivecommentHandler(c echo.Context) error {
 
 	var hitSpam int
 	for _, ngword := range ngwords {
-		if strings.Contains(req.Comment, ngword.Word) {
+		if containsNGWord(req.Comment, ngword.Word) {
 			hitSpam++
 		}
 
@@ -181,7 +371,7 @@ func postLivecommentHandler(c echo.Context) error {
 		}
 	}
 
-	now := time.Now().Unix()
+	now := nowFunc().Unix()
 	livecommentModel := LivecommentModel{
 		UserID:       userID,
 		LivestreamID: int64(livestreamID),
@@ -200,6 +390,7 @@ func postLivecommentHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livecomment id: "+err.Error())
 	}
 	livecommentModel.ID = livecommentID
+	totalTipCounter.Add(livecommentModel.Tip)
 
 	livecomment, err := fillLivecommentResponse(ctx, dbConn, livecommentModel)
 	if err != nil {
@@ -226,12 +417,16 @@ func reportLivecommentHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "livecomment_id in path must be integer")
 	}
 
+	if err := assertBelongsToStream(ctx, "livecomments", int64(livecommentID), int64(livestreamID)); err != nil {
+		return err
+	}
+
 	// error already checked
 	sess, _ := session.Get(defaultSessionIDKey, c)
 	// existence already checked
 	userID := sess.Values[defaultUserIDKey].(int64)
 
-	now := time.Now().Unix()
+	now := nowFunc().Unix()
 	reportModel := LivecommentReportModel{
 		UserID:        int64(userID),
 		LivestreamID:  int64(livestreamID),
@@ -240,6 +435,10 @@ func reportLivecommentHandler(c echo.Context) error {
 	}
 	rs, err := dbConn.NamedExecContext(ctx, "INSERT INTO livecomment_reports(user_id, livestream_id, livecomment_id, created_at) VALUES (:user_id, :livestream_id, :livecomment_id, :created_at)", &reportModel)
 	if err != nil {
+		// 同じユーザが同じライブコメントを重複して報告した
+		if isDuplicateEntryError(err) {
+			return echo.NewHTTPError(http.StatusConflict, "livecomment already reported")
+		}
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livecomment report: "+err.Error())
 	}
 	reportID, err := rs.LastInsertId()
@@ -256,10 +455,63 @@ func reportLivecommentHandler(c echo.Context) error {
 	return c.JSON(http.StatusCreated, report)
 }
 
+// スパム報告を対応済みにする (配信者のみ)
+// POST /api/livestream/:livestream_id/report/:report_id/resolve
+func resolveLivecommentReportHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	reportID, err := strconv.Atoi(c.Param("report_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "report_id in path must be integer")
+	}
+
+	livestreamModel, ok := livestreamModelByIdCache.Get(int64(livestreamID))
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	if livestreamModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't resolve other streamer's livecomment reports")
+	}
+
+	if err := assertBelongsToStream(ctx, "livecomment_reports", int64(reportID), int64(livestreamID)); err != nil {
+		return err
+	}
+
+	if _, err := dbConn.ExecContext(ctx, "UPDATE livecomment_reports SET resolved = TRUE WHERE id = ?", reportID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to resolve livecomment report: "+err.Error())
+	}
+
+	var reportModel LivecommentReportModel
+	if err := dbConn.GetContext(ctx, &reportModel, "SELECT * FROM livecomment_reports WHERE id = ?", reportID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment report: "+err.Error())
+	}
+
+	report, err := fillLivecommentReportResponse(ctx, dbConn, reportModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment report: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, report)
+}
+
 // NGワードを登録
 func moderateHandler(c echo.Context) error {
 	ctx := c.Request().Context()
-	defer c.Request().Body.Close()
 
 	if err := verifyUserSession(c); err != nil {
 		return err
@@ -275,9 +527,9 @@ func moderateHandler(c echo.Context) error {
 	// existence already checked
 	userID := sess.Values[defaultUserIDKey].(int64)
 
-	var req *ModerateRequest
-	if err := json.UnmarshalRead(c.Request().Body, &req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	var req ModerateRequest
+	if err := decodeJSON(c, &req); err != nil {
+		return err
 	}
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
@@ -287,59 +539,303 @@ func moderateHandler(c echo.Context) error {
 	defer tx.Rollback()
 
 	// 配信者自身の配信に対するmoderateなのかを検証
-	_, ok := livestreamModelByIdCache.Get(int64(livestreamID))
-	if !ok {
+	livestreamModel, ok := livestreamModelByIdCache.Get(int64(livestreamID))
+	if !ok || livestreamModel.UserID != userID {
 		return echo.NewHTTPError(http.StatusBadRequest, "A streamer can't moderate livestreams that other streamers own")
 	}
 
+	// apply_allの場合は配信者の全配信にNGワードを登録する
+	livestreamIDs := []int64{int64(livestreamID)}
+	if req.ApplyAll {
+		livestreamModels, err := getLivestreamModelsByUserID(ctx, userID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+		}
+		for _, livestreamModel := range livestreamModels {
+			if livestreamModel.ID != int64(livestreamID) {
+				livestreamIDs = append(livestreamIDs, livestreamModel.ID)
+			}
+		}
+	}
+
+	wordIDs := make([]int64, 0, len(livestreamIDs))
+	var hiddenTip int64
+	for _, id := range livestreamIDs {
+		wordID, tip, err := addNGWord(ctx, tx, userID, id, req.NGWord)
+		if err != nil {
+			return err
+		}
+		wordIDs = append(wordIDs, wordID)
+		hiddenTip += tip
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	totalTipCounter.Add(-hiddenTip)
+
+	res := map[string]interface{}{
+		"word_id": wordIDs[0],
+	}
+	if req.ApplyAll {
+		res["word_ids"] = wordIDs
+	}
+	return c.JSON(http.StatusCreated, res)
+}
+
+// NGワード判定用に文字列を正規化する (NFKC正規化 + 小文字化)
+func normalizeForNGWord(s string) string {
+	return strings.ToLower(norm.NFKC.String(s))
+}
+
+func containsNGWord(comment string, word string) bool {
+	return strings.Contains(normalizeForNGWord(comment), normalizeForNGWord(word))
+}
+
+// NGワードを登録し、配信のNGワードに引っかかるlivecommentsを非表示にする
+// 登録したNGワードのIDと、非表示にしたコメントのチップ合計を返す
+func addNGWord(ctx context.Context, tx *sqlx.Tx, userID int64, livestreamID int64, word string) (int64, int64, error) {
 	rs, err := tx.NamedExecContext(ctx, "INSERT INTO ng_words(user_id, livestream_id, word, created_at) VALUES (:user_id, :livestream_id, :word, :created_at)", &NGWord{
-		UserID:       int64(userID),
-		LivestreamID: int64(livestreamID),
-		Word:         req.NGWord,
-		CreatedAt:    time.Now().Unix(),
+		UserID:       userID,
+		LivestreamID: livestreamID,
+		Word:         word,
+		CreatedAt:    nowFunc().Unix(),
 	})
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert new NG word: "+err.Error())
+		return 0, 0, echo.NewHTTPError(http.StatusInternalServerError, "failed to insert new NG word: "+err.Error())
 	}
 
 	wordID, err := rs.LastInsertId()
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted NG word id: "+err.Error())
+		return 0, 0, echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted NG word id: "+err.Error())
 	}
 
 	var ngwords []*NGWord
 	if err := tx.SelectContext(ctx, &ngwords, "SELECT * FROM ng_words WHERE livestream_id = ?", livestreamID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error())
+		return 0, 0, echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error())
 	}
 
-	// NGワードを含むlivecommentsを1クエリですべて削除する
-	query := `
-	DELETE FROM livecomments WHERE livestream_id = ? AND
-	`
-	for i, ngword := range ngwords {
-		if i == 0 {
-			query += fmt.Sprintf("comment LIKE '%%%s%%'", ngword.Word)
-		} else {
-			query += fmt.Sprintf(" OR comment LIKE '%%%s%%'", ngword.Word)
+	var livecomments []struct {
+		ID      int64  `db:"id"`
+		Comment string `db:"comment"`
+		Tip     int64  `db:"tip"`
+	}
+	if err := tx.SelectContext(ctx, &livecomments, "SELECT id, comment, tip FROM livecomments WHERE livestream_id = ? AND hidden = FALSE FOR UPDATE", livestreamID); err != nil {
+		return 0, 0, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
+	}
+
+	// 大文字小文字・全角半角の違いを吸収して比較するため、LIKEではなくアプリ側で判定する
+	var hiddenTip int64
+	hiddenIDs := []int64{}
+	for _, livecomment := range livecomments {
+		for _, ngword := range ngwords {
+			if containsNGWord(livecomment.Comment, ngword.Word) {
+				hiddenIDs = append(hiddenIDs, livecomment.ID)
+				hiddenTip += livecomment.Tip
+				break
+			}
 		}
 	}
-	if _, err := tx.ExecContext(ctx, query, livestreamID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete old livecomments that hit spams: "+err.Error())
+
+	// NGワードを含むlivecommentsを1クエリですべて非表示にする
+	if len(hiddenIDs) > 0 {
+		query, args, err := sqlx.In("UPDATE livecomments SET hidden = TRUE WHERE id IN (?)", hiddenIDs)
+		if err != nil {
+			return 0, 0, echo.NewHTTPError(http.StatusInternalServerError, "failed to build query: "+err.Error())
+		}
+		if _, err := tx.ExecContext(ctx, tx.Rebind(query), args...); err != nil {
+			return 0, 0, echo.NewHTTPError(http.StatusInternalServerError, "failed to hide old livecomments that hit spams: "+err.Error())
+		}
 	}
 
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	return wordID, hiddenTip, nil
+}
+
+// エクスポート時にまとめてレスポンスを組み立てる件数
+const livecommentExportBatchSize = 100
+
+// 配信のライブコメント履歴をNDJSONでストリーミングする (配信者のみ)
+// GET /api/livestream/:livestream_id/livecomment/export
+func exportLivecommentsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
 	}
 
-	return c.JSON(http.StatusCreated, map[string]interface{}{
-		"word_id": wordID,
-	})
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	livestreamModel, ok := livestreamModelByIdCache.Get(int64(livestreamID))
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	if livestreamModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't export other streamer's livecomments")
+	}
+
+	rows, err := dbConn.QueryxContext(ctx, "SELECT * FROM livecomments WHERE livestream_id = ? ORDER BY created_at ASC, id ASC", livestreamID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
+	}
+	defer rows.Close()
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "application/x-ndjson")
+	res.WriteHeader(http.StatusOK)
+
+	// ヘッダを送った後はエラーレスポンスを返せないので、ログに残して打ち切る
+	writeBatch := func(livecommentModels []LivecommentModel) error {
+		livecomments, err := fillLivecommentResponseBulk(ctx, dbConn, livecommentModels)
+		if err != nil {
+			return err
+		}
+		for i := range livecomments {
+			if err := json.MarshalWrite(res, &livecomments[i], jsonMarshalOptions); err != nil {
+				return err
+			}
+			if _, err := res.Write([]byte("\n")); err != nil {
+				return err
+			}
+		}
+		res.Flush()
+		return nil
+	}
+
+	batch := make([]LivecommentModel, 0, livecommentExportBatchSize)
+	for rows.Next() {
+		var livecommentModel LivecommentModel
+		if err := rows.StructScan(&livecommentModel); err != nil {
+			c.Logger().Errorf("failed to scan livecomment: %s", err.Error())
+			return nil
+		}
+		batch = append(batch, livecommentModel)
+		if len(batch) == livecommentExportBatchSize {
+			if err := writeBatch(batch); err != nil {
+				c.Logger().Errorf("failed to export livecomments: %s", err.Error())
+				return nil
+			}
+			batch = batch[:0]
+		}
+	}
+	if err := rows.Err(); err != nil {
+		c.Logger().Errorf("failed to iterate livecomments: %s", err.Error())
+		return nil
+	}
+	if len(batch) > 0 {
+		if err := writeBatch(batch); err != nil {
+			c.Logger().Errorf("failed to export livecomments: %s", err.Error())
+		}
+	}
+
+	return nil
 }
 
-func fillLivecommentResponse(ctx context.Context, db *sqlx.DB, livecommentModel LivecommentModel) (Livecomment, error) {
-	commentOwnerModel, ok := userModelByIdCache.Get(livecommentModel.UserID)
+type Tipper struct {
+	User     User  `json:"user"`
+	TotalTip int64 `json:"total_tip"`
+}
+
+// 配信にチップを多く送ったユーザ (配信者のみ)
+// GET /api/livestream/:livestream_id/tippers?limit=N
+func getLivestreamTippersHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	livestreamModel, ok := livestreamModelByIdCache.Get(int64(livestreamID))
 	if !ok {
-		return Livecomment{}, fmt.Errorf("failed to get user model by id: %d", livecommentModel.UserID)
+		return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	if livestreamModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't get other streamer's tippers")
+	}
+
+	limit := 10
+	if c.QueryParam("limit") != "" {
+		v, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || v < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be non-negative integer")
+		}
+		limit = v
+	}
+
+	var entries []struct {
+		UserID   int64 `db:"user_id"`
+		TotalTip int64 `db:"total_tip"`
+	}
+	query := "SELECT user_id, SUM(tip) AS total_tip FROM livecomments WHERE livestream_id = ? AND tip > 0 AND hidden = FALSE GROUP BY user_id ORDER BY total_tip DESC, user_id ASC LIMIT ?"
+	if err := dbConn.SelectContext(ctx, &entries, query, livestreamID, limit); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tippers: "+err.Error())
+	}
+
+	userModels := make([]UserModel, len(entries))
+	for i := range entries {
+		userModel, err := getUserModelByID(ctx, entries[i].UserID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+		}
+		userModels[i] = userModel
+	}
+	users, err := fillUserResponseBulk(ctx, dbConn, userModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill users: "+err.Error())
+	}
+
+	tippers := make([]Tipper, len(entries))
+	for i := range entries {
+		tippers[i] = Tipper{
+			User:     users[i],
+			TotalTip: entries[i].TotalTip,
+		}
+	}
+
+	return c.JSON(http.StatusOK, tippers)
+}
+
+// livecomments, reactionsなど配信にぶら下がるリソースが、パスで指定された配信のものか検証する
+// 存在しなければ404、別の配信のものであれば400を返す
+func assertBelongsToStream(ctx context.Context, table string, id int64, livestreamID int64) error {
+	var ownerLivestreamID int64
+	if err := dbConn.GetContext(ctx, &ownerLivestreamID, fmt.Sprintf("SELECT livestream_id FROM %s WHERE id = ?", table), id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("not found %s that has the given id", table))
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("failed to get %s: %s", table, err.Error()))
+	}
+	if ownerLivestreamID != livestreamID {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("the %s does not belong to the livestream", table))
+	}
+	return nil
+}
+
+func fillLivecommentResponse(ctx context.Context, db *sqlx.DB, livecommentModel LivecommentModel) (Livecomment, error) {
+	commentOwnerModel, err := getUserModelByID(ctx, livecommentModel.UserID)
+	if err != nil {
+		return Livecomment{}, err
 	}
 	commentOwner, err := fillUserResponse(ctx, db, commentOwnerModel)
 	if err != nil {
@@ -362,6 +858,7 @@ func fillLivecommentResponse(ctx context.Context, db *sqlx.DB, livecommentModel
 		Livestream: livestream,
 		Comment:    livecommentModel.Comment,
 		Tip:        livecommentModel.Tip,
+		Hidden:     livecommentModel.Hidden,
 		CreatedAt:  livecommentModel.CreatedAt,
 	}
 
@@ -373,17 +870,22 @@ func fillLivecommentResponseBulk(ctx context.Context, db *sqlx.DB, livecommentMo
 		return []Livecomment{}, nil
 	}
 
-	livestreamIDs := make([]int64, len(livecommentModels))
+	// 同じ配信へのコメントが多いので、配信は重複を除いて一度だけ組み立てる
+	livestreamIDs := make([]int64, 0, len(livecommentModels))
+	seenLivestreamIDs := make(map[int64]struct{}, len(livecommentModels))
 
 	var userModels []UserModel
 
 	for i := range livecommentModels {
-		userModel, ok := userModelByIdCache.Get(livecommentModels[i].UserID)
-		if !ok {
-			return []Livecomment{}, fmt.Errorf("failed to get user model by id: %d", livecommentModels[i].UserID)
+		userModel, err := getUserModelByID(ctx, livecommentModels[i].UserID)
+		if err != nil {
+			return []Livecomment{}, err
 		}
 		userModels = append(userModels, userModel)
-		livestreamIDs[i] = livecommentModels[i].LivestreamID
+		if _, ok := seenLivestreamIDs[livecommentModels[i].LivestreamID]; !ok {
+			seenLivestreamIDs[livecommentModels[i].LivestreamID] = struct{}{}
+			livestreamIDs = append(livestreamIDs, livecommentModels[i].LivestreamID)
+		}
 	}
 
 	commentOwners, err := fillUserResponseBulk(ctx, db, userModels)
@@ -396,7 +898,29 @@ func fillLivecommentResponseBulk(ctx context.Context, db *sqlx.DB, livecommentMo
 		commentOwnersMap[commentOwners[i].ID] = commentOwners[i]
 	}
 
-	livestreamModels := []*LivestreamModel{}
+	// キャッシュにない配信はまとめてDBから引いてキャッシュに載せる
+	var missingLivestreamIDs []int64
+	for _, livestreamID := range livestreamIDs {
+		if _, ok := livestreamModelByIdCache.Get(livestreamID); !ok {
+			missingLivestreamIDs = append(missingLivestreamIDs, livestreamID)
+		}
+	}
+	if len(missingLivestreamIDs) > 0 {
+		var missingLivestreamModels []LivestreamModel
+		query, args, err := sqlx.In("SELECT * FROM livestreams WHERE id IN (?)", missingLivestreamIDs)
+		if err != nil {
+			return []Livecomment{}, err
+		}
+		query = db.Rebind(query)
+		if err := db.SelectContext(ctx, &missingLivestreamModels, query, args...); err != nil {
+			return []Livecomment{}, err
+		}
+		for _, livestreamModel := range missingLivestreamModels {
+			livestreamModelByIdCache.Set(livestreamModel.ID, livestreamModel)
+		}
+	}
+
+	livestreamModels := make([]*LivestreamModel, 0, len(livestreamIDs))
 	for _, livestreamID := range livestreamIDs {
 		livestreamModel, ok := livestreamModelByIdCache.Get(livestreamID)
 		if !ok {
@@ -423,6 +947,7 @@ func fillLivecommentResponseBulk(ctx context.Context, db *sqlx.DB, livecommentMo
 			Livestream: livestreamMap[livecommentModels[i].LivestreamID],
 			Comment:    livecommentModels[i].Comment,
 			Tip:        livecommentModels[i].Tip,
+			Hidden:     livecommentModels[i].Hidden,
 			CreatedAt:  livecommentModels[i].CreatedAt,
 		}
 	}
@@ -431,9 +956,9 @@ func fillLivecommentResponseBulk(ctx context.Context, db *sqlx.DB, livecommentMo
 }
 
 func fillLivecommentReportResponse(ctx context.Context, db *sqlx.DB, reportModel LivecommentReportModel) (LivecommentReport, error) {
-	reporterModel, ok := userModelByIdCache.Get(reportModel.UserID)
-	if !ok {
-		return LivecommentReport{}, fmt.Errorf("failed to get user model by id: %d", reportModel.UserID)
+	reporterModel, err := getUserModelByID(ctx, reportModel.UserID)
+	if err != nil {
+		return LivecommentReport{}, err
 	}
 	reporter, err := fillUserResponse(ctx, db, reporterModel)
 	if err != nil {
@@ -453,6 +978,7 @@ func fillLivecommentReportResponse(ctx context.Context, db *sqlx.DB, reportModel
 		ID:          reportModel.ID,
 		Reporter:    reporter,
 		Livecomment: livecomment,
+		Resolved:    reportModel.Resolved,
 		CreatedAt:   reportModel.CreatedAt,
 	}
 	return report, nil
@@ -467,9 +993,9 @@ func fillLivecommentReportResponseBulk(ctx context.Context, db *sqlx.DB, reportM
 	livecommentIDs := make([]int64, len(reportModels))
 
 	for i := range reportModels {
-		userModel, ok := userModelByIdCache.Get(reportModels[i].UserID)
-		if !ok {
-			return []LivecommentReport{}, fmt.Errorf("failed to get user model by id: %d", reportModels[i].UserID)
+		userModel, err := getUserModelByID(ctx, reportModels[i].UserID)
+		if err != nil {
+			return []LivecommentReport{}, err
 		}
 		userModels = append(userModels, userModel)
 		livecommentIDs[i] = reportModels[i].LivecommentID
@@ -481,7 +1007,10 @@ func fillLivecommentReportResponseBulk(ctx context.Context, db *sqlx.DB, reportM
 		return []LivecommentReport{}, err
 	}
 	query = db.Rebind(query)
-	if err := db.SelectContext(ctx, &livecommentModels, query, args...); err != nil {
+	spanCtx, span := tracer.Start(ctx, "SELECT livecomments")
+	err = db.SelectContext(spanCtx, &livecommentModels, query, args...)
+	span.End()
+	if err != nil {
 		return []LivecommentReport{}, err
 	}
 
@@ -511,6 +1040,7 @@ func fillLivecommentReportResponseBulk(ctx context.Context, db *sqlx.DB, reportM
 			ID:          reportModels[i].ID,
 			Reporter:    reportersMap[reportModels[i].UserID],
 			Livecomment: livecommentsMap[reportModels[i].LivecommentID],
+			Resolved:    reportModels[i].Resolved,
 			CreatedAt:   reportModels[i].CreatedAt,
 		}
 	}
@@ -0,0 +1,878 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-json-experiment/json"
+	"github.com/go-sql-driver/mysql"
+)
+
+// 配信者のアカウントで、表示・非表示のライブコメントを1件ずつ足す
+func insertVisibilityTestLivecomments(t *testing.T) (LivestreamModel, LivecommentModel, LivecommentModel) {
+	t.Helper()
+
+	_, livestreams := seedTestLivestreams(t, "visibility-test-user", 1)
+	livestream := livestreams[0]
+
+	now := time.Now().Unix()
+	visible := seedTestLivecomment(t, LivecommentModel{UserID: livestream.UserID, LivestreamID: livestream.ID, Comment: "visibility-test-visible", Tip: 100, CreatedAt: now})
+	hidden := seedTestLivecomment(t, LivecommentModel{UserID: livestream.UserID, LivestreamID: livestream.ID, Comment: "visibility-test-hidden", Tip: 500, Hidden: true, CreatedAt: now})
+	return livestream, visible, hidden
+}
+
+func getLivecommentsAs(t *testing.T, userID, livestreamID int64, query string) (int, []Livecomment) {
+	t.Helper()
+	code, body, err := serveAs(userID, getLivecommentsHandler, http.MethodGet, "/?"+query, "", "livestream_id", strconv.FormatInt(livestreamID, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var livecomments []Livecomment
+	if code == http.StatusOK {
+		if err := json.Unmarshal([]byte(body), &livecomments); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return code, livecomments
+}
+
+func containsLivecomment(livecomments []Livecomment, id int64) bool {
+	for _, l := range livecomments {
+		if l.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func TestGetLivecommentsHidesHiddenByDefault(t *testing.T) {
+	setupTestDB(t)
+	livestream, visible, hidden := insertVisibilityTestLivecomments(t)
+
+	code, livecomments := getLivecommentsAs(t, livestream.UserID, livestream.ID, "")
+	if code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+	if !containsLivecomment(livecomments, visible.ID) {
+		t.Error("visible livecomment is missing")
+	}
+	if containsLivecomment(livecomments, hidden.ID) {
+		t.Error("hidden livecomment is returned without include_hidden")
+	}
+}
+
+func TestGetLivecommentsIncludeHiddenForOwner(t *testing.T) {
+	setupTestDB(t)
+	livestream, visible, hidden := insertVisibilityTestLivecomments(t)
+
+	code, livecomments := getLivecommentsAs(t, livestream.UserID, livestream.ID, "include_hidden=true")
+	if code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+	if !containsLivecomment(livecomments, visible.ID) || !containsLivecomment(livecomments, hidden.ID) {
+		t.Error("include_hidden=true must return both visible and hidden livecomments")
+	}
+	for _, l := range livecomments {
+		if l.ID == hidden.ID && !l.Hidden {
+			t.Error("hidden livecomment is not marked as hidden")
+		}
+	}
+
+	if code, _ := getLivecommentsAs(t, livestream.UserID+1, livestream.ID, "include_hidden=true"); code != http.StatusForbidden {
+		t.Errorf("status for another user = %d, want %d", code, http.StatusForbidden)
+	}
+}
+
+func TestRevenueExcludesHiddenTips(t *testing.T) {
+	setupTestDB(t)
+	livestream, visible, _ := insertVisibilityTestLivecomments(t)
+
+	code, body, err := serveAs(livestream.UserID, getMyRevenueHandler, http.MethodGet, "/", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+	var revenue UserRevenue
+	if err := json.Unmarshal([]byte(strings.TrimSpace(body)), &revenue); err != nil {
+		t.Fatal(err)
+	}
+	if revenue.TotalTip != visible.Tip {
+		t.Errorf("revenue = %d, want %d (hidden tips must not be counted)", revenue.TotalTip, visible.Tip)
+	}
+}
+
+func TestContainsNGWord(t *testing.T) {
+	tests := []struct {
+		comment string
+		word    string
+		want    bool
+	}{
+		{"this is spam", "spam", true},
+		{"This Is SPAM", "spam", true},
+		{"this is spam", "SPAM", true},
+		// 全角英字
+		{"ｓｐａｍだよ", "spam", true},
+		{"ＳＰＡＭだよ", "spam", true},
+		// 半角カナ
+		{"ｽﾊﾟﾑです", "スパム", true},
+		// 全角数字
+		{"１２３４", "1234", true},
+		{"this is fine", "spam", false},
+		{"s p a m", "spam", false},
+	}
+	for _, tt := range tests {
+		if got := containsNGWord(tt.comment, tt.word); got != tt.want {
+			t.Errorf("containsNGWord(%q, %q) = %v, want %v", tt.comment, tt.word, got, tt.want)
+		}
+	}
+}
+
+func TestGetLivecommentsLimit(t *testing.T) {
+	setupTestDB(t)
+	user, livestreams := seedTestLivestreams(t, "limit-test-user", 1)
+	livestreamID := livestreams[0].ID
+	for i := 0; i < 3; i++ {
+		seedTestLivecomment(t, LivecommentModel{UserID: user.ID, LivestreamID: livestreamID, Comment: "limit-test", CreatedAt: int64(i)})
+	}
+
+	code, livecomments := getLivecommentsAs(t, user.ID, livestreamID, "limit=2")
+	if code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+	if len(livecomments) != 2 {
+		t.Errorf("len(livecomments) = %d, want 2", len(livecomments))
+	}
+}
+
+func TestGetLivecommentsLimitIsBound(t *testing.T) {
+	f := setupHandlerTest(t)
+	var gotArgs []driver.Value
+	f.on("SELECT * FROM livecomments WHERE livestream_id", func(args []driver.Value) fakeResponse {
+		gotArgs = args
+		return fakeResponse{}
+	})
+
+	tests := []struct {
+		query    string
+		wantCode int
+		wantArgs []driver.Value
+	}{
+		{"", http.StatusOK, []driver.Value{int64(1)}},
+		{"limit=2", http.StatusOK, []driver.Value{int64(1), int64(2)}},
+		{"limit=2%20OR%201=1", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		gotArgs = nil
+		code, _ := getLivecommentsAs(t, 1, 1, tt.query)
+		if code != tt.wantCode {
+			t.Errorf("%q: status = %d, want %d", tt.query, code, tt.wantCode)
+			continue
+		}
+		if code != http.StatusOK {
+			continue
+		}
+		// LIMITの値はクエリ文字列に埋め込まずに引数で渡す
+		if q := f.lastQuery(); strings.HasSuffix(q, "LIMIT ?") != (len(tt.wantArgs) == 2) {
+			t.Errorf("%q: query = %s", tt.query, q)
+		}
+		if !slices.Equal(gotArgs, tt.wantArgs) {
+			t.Errorf("%q: args = %v, want %v", tt.query, gotArgs, tt.wantArgs)
+		}
+	}
+}
+
+func BenchmarkFillLivecommentReportResponseBulkOneStream(b *testing.B) {
+	setupTestDB(b)
+	user, livestreams := seedTestLivestreams(b, "report-bench-user", 1)
+
+	livecommentModels := make([]LivecommentModel, 200)
+	for i := range livecommentModels {
+		livecommentModels[i] = seedTestLivecomment(b, LivecommentModel{UserID: user.ID, LivestreamID: livestreams[0].ID, Comment: "report-bench", CreatedAt: int64(i)})
+	}
+	// 同じ配信のコメントへの報告を大量に作る
+	reportModels := make([]LivecommentReportModel, len(livecommentModels))
+	for i, livecommentModel := range livecommentModels {
+		reportModels[i] = LivecommentReportModel{
+			ID:            int64(i + 1),
+			UserID:        livecommentModel.UserID,
+			LivestreamID:  livecommentModel.LivestreamID,
+			LivecommentID: livecommentModel.ID,
+		}
+	}
+
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		livestreamTagsCache.deleteLocal(livecommentModels[0].LivestreamID)
+		b.StartTimer()
+		if _, err := fillLivecommentReportResponseBulk(ctx, dbConn, reportModels); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestReportNonexistentLivecomment(t *testing.T) {
+	setupTestDB(t)
+	user, livestreams := seedTestLivestreams(t, "report-test-user", 1)
+	livecomment := seedTestLivecomment(t, LivecommentModel{UserID: user.ID, LivestreamID: livestreams[0].ID, Comment: "report-test"})
+
+	code, _, err := serveAs(user.ID, reportLivecommentHandler, http.MethodPost, "/", "",
+		"livestream_id", strconv.FormatInt(livestreams[0].ID, 10),
+		"livecomment_id", strconv.FormatInt(livecomment.ID+1000, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", code, http.StatusNotFound)
+	}
+}
+
+// ライブコメントを投稿できる配信をキャッシュとフェイクDBに用意する
+// ユーザーIDがそのままユーザー名の末尾になる
+func fakeLivecommentTarget(f *fakeDB, livestream LivestreamModel, users ...int64) {
+	livestreamModelByIdCache.Set(livestream.ID, livestream)
+	livestreamTagsCache.Set(livestream.ID, []int64{})
+	models := make([]any, 0, len(users))
+	themes := make([]any, 0, len(users))
+	for _, id := range users {
+		models = append(models, UserModel{ID: id, Name: "livecomment-test-user" + strconv.FormatInt(id, 10)})
+		themes = append(themes, ThemeModel{ID: id, UserID: id})
+	}
+	f.rowsWhere("FROM users WHERE id", "id", models...)
+	f.rowsWhere("FROM themes WHERE user_id", "user_id", themes...)
+	f.rows("FROM ng_words WHERE user_id")
+	f.exec("INSERT INTO livecomments", 1)
+}
+
+func postLivecommentAs(t *testing.T, userID, livestreamID int64, body string) (int, string) {
+	t.Helper()
+	code, resBody, err := serveAs(userID, postLivecommentHandler, http.MethodPost, "/", body, "livestream_id", strconv.FormatInt(livestreamID, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code, resBody
+}
+
+func TestPaymentResultCountsPostedTips(t *testing.T) {
+	f := setupHandlerTest(t)
+	prev := totalTipCounter.Load()
+	t.Cleanup(func() { totalTipCounter.Store(prev) })
+
+	f.value("SUM(tip)", "total", int64(100))
+	if err := seedTotalTip(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	fakeLivecommentTarget(f, LivestreamModel{ID: 1, UserID: 1}, 1, 2)
+
+	for _, tip := range []int{10, 0, 20} {
+		if code, body := postLivecommentAs(t, 2, 1, `{"comment":"tip","tip":`+strconv.Itoa(tip)+`}`); code != http.StatusCreated {
+			t.Fatalf("post tip %d: status = %d, body = %s", tip, code, body)
+		}
+	}
+
+	code, body, err := serveAs(1, GetPaymentResult, http.MethodGet, "/api/payment", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+	var result PaymentResult
+	if err := json.Unmarshal([]byte(body), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.TotalTip != 130 {
+		t.Errorf("total_tip = %d, want 130", result.TotalTip)
+	}
+}
+
+func TestDeleteNgwordsOwnerOnly(t *testing.T) {
+	f := setupHandlerTest(t)
+	livestreamModelByIdCache.Set(1, LivestreamModel{ID: 1, UserID: 1})
+	f.on("DELETE FROM ng_words WHERE livestream_id", func([]driver.Value) fakeResponse {
+		return fakeResponse{rowsAffected: 3}
+	})
+
+	tests := []struct {
+		name         string
+		userID       int64
+		livestreamID string
+		wantCode     int
+	}{
+		{"owner", 1, "1", http.StatusOK},
+		{"other streamer", 2, "1", http.StatusForbidden},
+		{"missing livestream", 1, "999", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		code, body, err := serveAs(tt.userID, deleteNgwordsHandler, http.MethodDelete, "/", "", "livestream_id", tt.livestreamID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.wantCode {
+			t.Errorf("%s: status = %d, want %d", tt.name, code, tt.wantCode)
+			continue
+		}
+		if code == http.StatusOK && body != `{"deleted":3}` {
+			t.Errorf("%s: body = %q, want deleted 3", tt.name, body)
+		}
+	}
+	if n := f.count("DELETE FROM ng_words"); n != 1 {
+		t.Errorf("ran DELETE %d times, want only for the owner", n)
+	}
+}
+
+func TestDeleteNgwordsClearsWords(t *testing.T) {
+	setupTestDB(t)
+	user, livestreams := seedTestLivestreams(t, "clear-ngwords-test-user", 1)
+	livestream := livestreams[0]
+	livestreamModelByIdCache.Set(livestream.ID, livestream)
+	id := strconv.FormatInt(livestream.ID, 10)
+
+	for _, word := range []string{"spam", "scam"} {
+		if code, body, err := serveAs(user.ID, moderateHandler, http.MethodPost, "/", `{"ng_word":"`+word+`"}`, "livestream_id", id); err != nil || code != http.StatusCreated {
+			t.Fatalf("moderate %q: status = %d (err=%v), body = %s", word, code, err, body)
+		}
+	}
+	if code, _ := postLivecommentAs(t, user.ID, livestream.ID, `{"comment":"this is spam"}`); code != http.StatusBadRequest {
+		t.Fatalf("comment with an NG word: status = %d, want %d", code, http.StatusBadRequest)
+	}
+
+	code, body, err := serveAs(user.ID, deleteNgwordsHandler, http.MethodDelete, "/", "", "livestream_id", id)
+	if err != nil || code != http.StatusOK {
+		t.Fatalf("status = %d (err=%v), want %d", code, err, http.StatusOK)
+	}
+	if body != `{"deleted":2}` {
+		t.Errorf("body = %q, want deleted 2", body)
+	}
+
+	var n int
+	if err := dbConn.Get(&n, "SELECT COUNT(*) FROM ng_words WHERE livestream_id = ?", livestream.ID); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("%d NG words are left", n)
+	}
+	code, body, err = serveAs(user.ID, getNgwords, http.MethodGet, "/", "", "livestream_id", id)
+	if err != nil || code != http.StatusOK {
+		t.Fatalf("ngwords after clearing: status = %d (err=%v)", code, err)
+	}
+	var ngwords []NGWord
+	if err := json.Unmarshal([]byte(body), &ngwords); err != nil {
+		t.Fatal(err)
+	}
+	if len(ngwords) != 0 {
+		t.Errorf("ngwords after clearing = %+v, want none", ngwords)
+	}
+	// 消したNGワードで投稿が弾かれない
+	if code, body := postLivecommentAs(t, user.ID, livestream.ID, `{"comment":"this is spam"}`); code != http.StatusCreated {
+		t.Errorf("comment after clearing: status = %d, body = %s", code, body)
+	}
+}
+
+func getLivecommentsWithTipTotal(t *testing.T, userID, livestreamID int64, query string) LivecommentsWithTipTotal {
+	t.Helper()
+	code, body, err := serveAs(userID, getLivecommentsHandler, http.MethodGet, "/?with_tip_total=1&"+query, "", "livestream_id", strconv.FormatInt(livestreamID, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+	var res LivecommentsWithTipTotal
+	if err := json.Unmarshal([]byte(body), &res); err != nil {
+		t.Fatalf("body is not an envelope: %v: %s", err, body)
+	}
+	return res
+}
+
+func TestGetLivecommentsWithTipTotal(t *testing.T) {
+	f := setupHandlerTest(t)
+	fakeLivecommentTarget(f, LivestreamModel{ID: 1, UserID: 1}, 1)
+	f.rows("FROM livecomments WHERE livestream_id = ? AND hidden = FALSE ORDER BY",
+		LivecommentModel{ID: 1, UserID: 1, LivestreamID: 1, Comment: "a", Tip: 10},
+		LivecommentModel{ID: 2, UserID: 1, LivestreamID: 1, Comment: "b", Tip: 20})
+	f.value("SUM(tip)", "total", int64(30))
+
+	res := getLivecommentsWithTipTotal(t, 1, 1, "")
+	if len(res.Livecomments) != 2 || res.TipTotal != 30 {
+		t.Errorf("response = %d livecomments, tip_total %d, want 2 and 30", len(res.Livecomments), res.TipTotal)
+	}
+
+	// 指定しなければ配列のまま返す
+	code, livecomments := getLivecommentsAs(t, 1, 1, "")
+	if code != http.StatusOK || len(livecomments) != 2 {
+		t.Errorf("without with_tip_total: status = %d, %d livecomments", code, len(livecomments))
+	}
+	if n := f.count("SUM(tip)"); n != 1 {
+		t.Errorf("summed tips %d times, want only with with_tip_total", n)
+	}
+}
+
+func TestGetLivecommentsTipTotalMatchesStream(t *testing.T) {
+	setupTestDB(t)
+	livestream, visible, _ := insertVisibilityTestLivecomments(t)
+	livestreamModelByIdCache.Set(livestream.ID, livestream)
+	seedTestLivecomment(t, LivecommentModel{UserID: livestream.UserID, LivestreamID: livestream.ID, Comment: "older", Tip: 30, CreatedAt: visible.CreatedAt - 60})
+	// 他の配信のチップは含めない
+	_, others := seedTestLivestreams(t, "tip-total-other-user", 1)
+	seedTestLivecomment(t, LivecommentModel{UserID: livestream.UserID, LivestreamID: others[0].ID, Comment: "other", Tip: 1000})
+
+	// limitで返すコメントを絞っても、チップ合計は配信全体の非表示でないコメント分
+	res := getLivecommentsWithTipTotal(t, livestream.UserID, livestream.ID, "limit=1")
+	if len(res.Livecomments) != 1 {
+		t.Errorf("%d livecomments, want 1", len(res.Livecomments))
+	}
+	if want := visible.Tip + 30; res.TipTotal != want {
+		t.Errorf("tip_total = %d, want %d", res.TipTotal, want)
+	}
+}
+
+func TestGetLivecommentReportsResolvedFilter(t *testing.T) {
+	f := setupHandlerTest(t)
+	livestreamModelByIdCache.Set(1, LivestreamModel{ID: 1, UserID: 1})
+	var gotArgs []driver.Value
+	f.on("FROM livecomment_reports WHERE livestream_id", func(args []driver.Value) fakeResponse {
+		gotArgs = args
+		return fakeResponse{}
+	})
+
+	tests := []struct {
+		query        string
+		wantCode     int
+		wantResolved driver.Value
+	}{
+		{"", http.StatusOK, nil},
+		{"resolved=false", http.StatusOK, false},
+		{"resolved=true", http.StatusOK, true},
+		{"resolved=maybe", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		gotArgs = nil
+		code, _, err := serveAs(1, getLivecommentReportsHandler, http.MethodGet, "/?"+tt.query, "", "livestream_id", "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.wantCode {
+			t.Errorf("%q: status = %d, want %d", tt.query, code, tt.wantCode)
+			continue
+		}
+		if code != http.StatusOK {
+			continue
+		}
+		gotQuery := f.lastQuery()
+		if tt.wantResolved == nil {
+			if strings.Contains(gotQuery, "resolved") {
+				t.Errorf("%q: query filters by resolved: %s", tt.query, gotQuery)
+			}
+			continue
+		}
+		if !strings.Contains(gotQuery, "AND resolved = ?") || len(gotArgs) != 2 || gotArgs[1] != tt.wantResolved {
+			t.Errorf("%q: query = %s, args = %v, want resolved = %v", tt.query, gotQuery, gotArgs, tt.wantResolved)
+		}
+	}
+}
+
+func TestResolveLivecommentReportOwnerOnly(t *testing.T) {
+	f := setupHandlerTest(t)
+	livestreamModelByIdCache.Set(1, LivestreamModel{ID: 1, UserID: 1})
+	f.on("SELECT livestream_id FROM livecomment_reports WHERE id", func(args []driver.Value) fakeResponse {
+		return fakeResponse{columns: []string{"livestream_id"}}
+	})
+
+	for _, tt := range []struct {
+		name         string
+		userID       int64
+		livestreamID string
+		wantCode     int
+	}{
+		{"other streamer", 2, "1", http.StatusForbidden},
+		{"missing livestream", 1, "999", http.StatusNotFound},
+		{"missing report", 1, "1", http.StatusNotFound},
+	} {
+		code, _, err := serveAs(tt.userID, resolveLivecommentReportHandler, http.MethodPost, "/", "", "livestream_id", tt.livestreamID, "report_id", "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.wantCode {
+			t.Errorf("%s: status = %d, want %d", tt.name, code, tt.wantCode)
+		}
+	}
+	if n := f.count("UPDATE livecomment_reports"); n != 0 {
+		t.Errorf("resolved a report %d times without permission", n)
+	}
+}
+
+func TestResolveLivecommentReport(t *testing.T) {
+	setupTestDB(t)
+	streamer, livestreams := seedTestLivestreams(t, "resolve-test-streamer", 1)
+	viewer, _ := seedTestLivestreams(t, "resolve-test-viewer", 0)
+	livestream := livestreams[0]
+	livestreamModelByIdCache.Set(livestream.ID, livestream)
+	id := strconv.FormatInt(livestream.ID, 10)
+
+	var reportIDs []int64
+	for _, comment := range []string{"first", "second"} {
+		livecomment := seedTestLivecomment(t, LivecommentModel{UserID: viewer.ID, LivestreamID: livestream.ID, Comment: comment})
+		rs, err := dbConn.Exec("INSERT INTO livecomment_reports (user_id, livestream_id, livecomment_id, created_at) VALUES (?, ?, ?, 0)", viewer.ID, livestream.ID, livecomment.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reportID, err := rs.LastInsertId()
+		if err != nil {
+			t.Fatal(err)
+		}
+		reportIDs = append(reportIDs, reportID)
+	}
+
+	code, body, err := serveAs(streamer.ID, resolveLivecommentReportHandler, http.MethodPost, "/", "", "livestream_id", id, "report_id", strconv.FormatInt(reportIDs[0], 10))
+	if err != nil || code != http.StatusOK {
+		t.Fatalf("resolve: status = %d (err=%v), want %d", code, err, http.StatusOK)
+	}
+	var resolved LivecommentReport
+	if err := json.Unmarshal([]byte(body), &resolved); err != nil {
+		t.Fatal(err)
+	}
+	if resolved.ID != reportIDs[0] || !resolved.Resolved {
+		t.Errorf("resolved report = %+v, want %d resolved", resolved, reportIDs[0])
+	}
+
+	reports := func(query string) []int64 {
+		t.Helper()
+		code, body, err := serveAs(streamer.ID, getLivecommentReportsHandler, http.MethodGet, "/?"+query, "", "livestream_id", id)
+		if err != nil || code != http.StatusOK {
+			t.Fatalf("reports %q: status = %d (err=%v), want %d", query, code, err, http.StatusOK)
+		}
+		var reports []LivecommentReport
+		if err := json.Unmarshal([]byte(body), &reports); err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]int64, len(reports))
+		for i, report := range reports {
+			ids[i] = report.ID
+		}
+		slices.Sort(ids)
+		return ids
+	}
+	if got := reports("resolved=false"); !slices.Equal(got, reportIDs[1:]) {
+		t.Errorf("unresolved reports = %v, want %v", got, reportIDs[1:])
+	}
+	if got := reports("resolved=true"); !slices.Equal(got, reportIDs[:1]) {
+		t.Errorf("resolved reports = %v, want %v", got, reportIDs[:1])
+	}
+	if got := reports(""); !slices.Equal(got, reportIDs) {
+		t.Errorf("all reports = %v, want %v", got, reportIDs)
+	}
+}
+
+func reportAs(t *testing.T, userID, livestreamID, livecommentID int64) int {
+	t.Helper()
+	code, _, err := serveAs(userID, reportLivecommentHandler, http.MethodPost, "/", "",
+		"livestream_id", strconv.FormatInt(livestreamID, 10),
+		"livecomment_id", strconv.FormatInt(livecommentID, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestReportLivecommentTwiceConflicts(t *testing.T) {
+	f := setupHandlerTest(t)
+	fakeLivecommentTarget(f, LivestreamModel{ID: 1, UserID: 1}, 1, 2)
+	f.on("SELECT livestream_id FROM livecomments WHERE id", func([]driver.Value) fakeResponse {
+		return fakeResponse{columns: []string{"livestream_id"}, rows: [][]driver.Value{{int64(1)}}}
+	})
+	f.rows("SELECT * FROM livecomments WHERE id", LivecommentModel{ID: 1, UserID: 1, LivestreamID: 1, Comment: "spam"})
+	// (user_id, livecomment_id)のユニークキーで2回目の報告は弾かれる
+	reported := map[[2]int64]bool{}
+	f.on("INSERT INTO livecomment_reports", func(args []driver.Value) fakeResponse {
+		key := [2]int64{args[0].(int64), args[2].(int64)}
+		if reported[key] {
+			return fakeResponse{err: &mysql.MySQLError{Number: 1062, Message: "Duplicate entry"}}
+		}
+		reported[key] = true
+		return fakeResponse{lastInsertID: int64(len(reported)), rowsAffected: 1}
+	})
+
+	if code := reportAs(t, 2, 1, 1); code != http.StatusCreated {
+		t.Fatalf("first report: status = %d, want %d", code, http.StatusCreated)
+	}
+	if code := reportAs(t, 2, 1, 1); code != http.StatusConflict {
+		t.Errorf("second report: status = %d, want %d", code, http.StatusConflict)
+	}
+	// 別のユーザは報告できる
+	if code := reportAs(t, 1, 1, 1); code != http.StatusCreated {
+		t.Errorf("report by another user: status = %d, want %d", code, http.StatusCreated)
+	}
+}
+
+func TestReportLivecommentTwiceCountsOnce(t *testing.T) {
+	setupTestDB(t)
+	streamer, livestreams := seedTestLivestreams(t, "duplicate-report-streamer", 1)
+	viewer, _ := seedTestLivestreams(t, "duplicate-report-viewer", 0)
+	livestream := livestreams[0]
+	livestreamModelByIdCache.Set(livestream.ID, livestream)
+	livecomment := seedTestLivecomment(t, LivecommentModel{UserID: streamer.ID, LivestreamID: livestream.ID, Comment: "spam"})
+
+	if code := reportAs(t, viewer.ID, livestream.ID, livecomment.ID); code != http.StatusCreated {
+		t.Fatalf("first report: status = %d, want %d", code, http.StatusCreated)
+	}
+	if code := reportAs(t, viewer.ID, livestream.ID, livecomment.ID); code != http.StatusConflict {
+		t.Errorf("second report: status = %d, want %d", code, http.StatusConflict)
+	}
+
+	code, body, err := serveAs(streamer.ID, getLivestreamStatisticsHandler, http.MethodGet, "/", "", "livestream_id", strconv.FormatInt(livestream.ID, 10))
+	if err != nil || code != http.StatusOK {
+		t.Fatalf("statistics: status = %d (err=%v), want %d", code, err, http.StatusOK)
+	}
+	var stats LivestreamStatistics
+	if err := json.Unmarshal([]byte(body), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.TotalReports != 1 {
+		t.Errorf("total_reports = %d, want 1", stats.TotalReports)
+	}
+}
+
+func TestReportLivecommentValidatesLivecomment(t *testing.T) {
+	f := setupHandlerTest(t)
+	fakeLivecommentTarget(f, LivestreamModel{ID: 1, UserID: 1}, 1)
+	// ライブコメント1は配信2へのもの。それ以外は存在しない
+	f.on("SELECT livestream_id FROM livecomments WHERE id", func(args []driver.Value) fakeResponse {
+		res := fakeResponse{columns: []string{"livestream_id"}}
+		if args[0] == int64(1) {
+			res.rows = [][]driver.Value{{int64(2)}}
+		}
+		return res
+	})
+	f.exec("INSERT INTO livecomment_reports", 1)
+
+	if code := reportAs(t, 1, 1, 99); code != http.StatusNotFound {
+		t.Errorf("missing livecomment: status = %d, want %d", code, http.StatusNotFound)
+	}
+	if code := reportAs(t, 1, 1, 1); code != http.StatusBadRequest {
+		t.Errorf("livecomment of another livestream: status = %d, want %d", code, http.StatusBadRequest)
+	}
+	if n := f.count("INSERT INTO livecomment_reports"); n != 0 {
+		t.Errorf("inserted %d dangling reports", n)
+	}
+}
+
+func TestDeleteNgword(t *testing.T) {
+	f := setupHandlerTest(t)
+	livestreamModelByIdCache.Set(1, LivestreamModel{ID: 1, UserID: 1})
+	livestreamModelByIdCache.Set(2, LivestreamModel{ID: 2, UserID: 2})
+	f.rowsWhere("SELECT * FROM ng_words WHERE id", "id",
+		NGWord{ID: 10, UserID: 1, LivestreamID: 1, Word: "spam"},
+		NGWord{ID: 11, UserID: 1, LivestreamID: 3, Word: "scam"})
+	f.exec("DELETE FROM ng_words WHERE id", 0)
+
+	tests := []struct {
+		name         string
+		userID       int64
+		livestreamID string
+		wordID       string
+		wantCode     int
+	}{
+		{"other streamer", 2, "1", "10", http.StatusForbidden},
+		{"missing livestream", 1, "999", "10", http.StatusNotFound},
+		{"missing word", 1, "1", "99", http.StatusNotFound},
+		{"word of another livestream", 1, "1", "11", http.StatusNotFound},
+		{"owner", 1, "1", "10", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		code, _, err := serveAs(tt.userID, deleteNgwordHandler, http.MethodDelete, "/", "", "livestream_id", tt.livestreamID, "word_id", tt.wordID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.wantCode {
+			t.Errorf("%s: status = %d, want %d", tt.name, code, tt.wantCode)
+		}
+	}
+	if n := f.count("DELETE FROM ng_words WHERE id"); n != 1 {
+		t.Errorf("deleted NG words %d times, want only for the owner", n)
+	}
+}
+
+func TestDeleteNgwordKeepsHiddenLivecomments(t *testing.T) {
+	setupTestDB(t)
+	user, livestreams := seedTestLivestreams(t, "delete-ngword-test-user", 1)
+	livestream := livestreams[0]
+	livestreamModelByIdCache.Set(livestream.ID, livestream)
+	id := strconv.FormatInt(livestream.ID, 10)
+	spam := seedTestLivecomment(t, LivecommentModel{UserID: user.ID, LivestreamID: livestream.ID, Comment: "this is spam"})
+
+	code, body, err := serveAs(user.ID, moderateHandler, http.MethodPost, "/", `{"ng_word":"spam"}`, "livestream_id", id)
+	if err != nil || code != http.StatusCreated {
+		t.Fatalf("moderate: status = %d (err=%v), want %d", code, err, http.StatusCreated)
+	}
+	var res struct {
+		WordID int64 `json:"word_id"`
+	}
+	if err := json.Unmarshal([]byte(body), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	code, _, err = serveAs(user.ID, deleteNgwordHandler, http.MethodDelete, "/", "", "livestream_id", id, "word_id", strconv.FormatInt(res.WordID, 10))
+	if err != nil || code != http.StatusNoContent {
+		t.Fatalf("delete: status = %d (err=%v), want %d", code, err, http.StatusNoContent)
+	}
+	var n int
+	if err := dbConn.Get(&n, "SELECT COUNT(*) FROM ng_words WHERE id = ?", res.WordID); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Error("NG word is left after delete")
+	}
+	// 既に非表示にしたコメントは戻さない
+	var hidden bool
+	if err := dbConn.Get(&hidden, "SELECT hidden FROM livecomments WHERE id = ?", spam.ID); err != nil {
+		t.Fatal(err)
+	}
+	if !hidden {
+		t.Error("hidden livecomment is visible again after deleting the NG word")
+	}
+}
+
+type fakeModerateLivecommentRow struct {
+	ID      int64  `db:"id"`
+	Comment string `db:"comment"`
+	Tip     int64  `db:"tip"`
+}
+
+func TestModerateApplyAll(t *testing.T) {
+	f := setupHandlerTest(t)
+	prevTip := totalTipCounter.Load()
+	t.Cleanup(func() { totalTipCounter.Store(prevTip) })
+	totalTipCounter.Store(1000)
+
+	first, second := &LivestreamModel{ID: 1, UserID: 1}, &LivestreamModel{ID: 2, UserID: 1}
+	livestreamModelByIdCache.Set(1, *first)
+	livestreamModelByIdCache.Set(2, *second)
+	livestreamModelByUserIDCache.Set(1, []*LivestreamModel{first, second})
+
+	var wordLivestreamIDs []driver.Value
+	f.on("INSERT INTO ng_words", func(args []driver.Value) fakeResponse {
+		wordLivestreamIDs = append(wordLivestreamIDs, args[1])
+		return fakeResponse{lastInsertID: int64(100 + len(wordLivestreamIDs)), rowsAffected: 1}
+	})
+	f.on("SELECT * FROM ng_words WHERE livestream_id", func(args []driver.Value) fakeResponse {
+		return rowsOf(NGWord{ID: 100, UserID: 1, LivestreamID: args[0].(int64), Word: "spam"})
+	})
+	// 各配信にスパムとそうでないコメントが1件ずつある
+	f.on("SELECT id, comment, tip FROM livecomments", func(args []driver.Value) fakeResponse {
+		id := args[0].(int64) * 10
+		return rowsOf(
+			fakeModerateLivecommentRow{ID: id, Comment: "SPAM!", Tip: 100},
+			fakeModerateLivecommentRow{ID: id + 1, Comment: "hello", Tip: 50})
+	})
+	var hiddenIDs []driver.Value
+	f.on("UPDATE livecomments SET hidden = TRUE", func(args []driver.Value) fakeResponse {
+		hiddenIDs = append(hiddenIDs, args...)
+		return fakeResponse{rowsAffected: int64(len(args))}
+	})
+
+	// 他の配信者の配信には登録できない
+	code, _, err := serveAs(2, moderateHandler, http.MethodPost, "/", `{"ng_word":"spam","apply_all":true}`, "livestream_id", "1")
+	if err != nil || code != http.StatusBadRequest {
+		t.Fatalf("other streamer: status = %d (err=%v), want %d", code, err, http.StatusBadRequest)
+	}
+
+	code, body, err := serveAs(1, moderateHandler, http.MethodPost, "/", `{"ng_word":"spam","apply_all":true}`, "livestream_id", "1")
+	if err != nil || code != http.StatusCreated {
+		t.Fatalf("status = %d (err=%v), want %d", code, err, http.StatusCreated)
+	}
+	var res struct {
+		WordID  int64   `json:"word_id"`
+		WordIDs []int64 `json:"word_ids"`
+	}
+	if err := json.Unmarshal([]byte(body), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []driver.Value{int64(1), int64(2)}; !slices.Equal(wordLivestreamIDs, want) {
+		t.Errorf("registered the word for livestreams %v, want %v", wordLivestreamIDs, want)
+	}
+	if res.WordID != 101 || !slices.Equal(res.WordIDs, []int64{101, 102}) {
+		t.Errorf("response = %+v, want word_id 101 and word_ids [101 102]", res)
+	}
+	if want := []driver.Value{int64(10), int64(20)}; !slices.Equal(hiddenIDs, want) {
+		t.Errorf("hid livecomments %v, want %v", hiddenIDs, want)
+	}
+	if got := totalTipCounter.Load(); got != 800 {
+		t.Errorf("total tip = %d, want 800", got)
+	}
+}
+
+func TestModerateApplyAllWithMySQL(t *testing.T) {
+	setupTestDB(t)
+	user, livestreams := seedTestLivestreams(t, "apply-all-test-user", 2)
+	for _, livestream := range livestreams {
+		livestreamModelByIdCache.Set(livestream.ID, livestream)
+	}
+	var spams []LivecommentModel
+	for _, livestream := range livestreams {
+		spams = append(spams, seedTestLivecomment(t, LivecommentModel{UserID: user.ID, LivestreamID: livestream.ID, Comment: "buy spam now"}))
+	}
+
+	code, _, err := serveAs(user.ID, moderateHandler, http.MethodPost, "/", `{"ng_word":"spam","apply_all":true}`, "livestream_id", strconv.FormatInt(livestreams[0].ID, 10))
+	if err != nil || code != http.StatusCreated {
+		t.Fatalf("status = %d (err=%v), want %d", code, err, http.StatusCreated)
+	}
+
+	for i, livestream := range livestreams {
+		var n int
+		if err := dbConn.Get(&n, "SELECT COUNT(*) FROM ng_words WHERE livestream_id = ? AND word = 'spam'", livestream.ID); err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Errorf("livestream %d has %d NG words, want 1", livestream.ID, n)
+		}
+		var hidden bool
+		if err := dbConn.Get(&hidden, "SELECT hidden FROM livecomments WHERE id = ?", spams[i].ID); err != nil {
+			t.Fatal(err)
+		}
+		if !hidden {
+			t.Errorf("spam on livestream %d is not hidden", livestream.ID)
+		}
+	}
+}
+
+func TestPostLivecommentValidation(t *testing.T) {
+	f := setupHandlerTest(t)
+	fakeLivecommentTarget(f, LivestreamModel{ID: 1, UserID: 1}, 1)
+	prev := maxLivecommentLength
+	maxLivecommentLength = 5
+	t.Cleanup(func() { maxLivecommentLength = prev })
+
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+	}{
+		// 文字数はバイト数ではなくルーン数で数える
+		{"at the limit", `{"comment":"あいうえお","tip":0}`, http.StatusCreated},
+		{"too long", `{"comment":"あいうえおか","tip":0}`, http.StatusBadRequest},
+		{"negative tip", `{"comment":"hi","tip":-1}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if code, _ := postLivecommentAs(t, 1, 1, tt.body); code != tt.wantCode {
+			t.Errorf("%s: status = %d, want %d", tt.name, code, tt.wantCode)
+		}
+	}
+	// 不正なコメントはスパム判定や挿入の前に弾く
+	if n := f.count("FROM ng_words"); n != 1 {
+		t.Errorf("checked NG words %d times, want only for the valid comment", n)
+	}
+	if n := f.count("INSERT INTO livecomments"); n != 1 {
+		t.Errorf("inserted %d livecomments, want 1", n)
+	}
+}
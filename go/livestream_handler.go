@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"net/http"
 	"sort"
@@ -9,8 +11,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/go-json-experiment/json"
-
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
@@ -55,6 +55,12 @@ type Livestream struct {
 	EndAt        int64  `json:"end_at"`
 }
 
+type LivestreamCountdown struct {
+	LivestreamID int64 `json:"livestream_id"`
+	// 配信開始までの秒数 (開始済みなら0以下)
+	SecondsUntilStart int64 `json:"seconds_until_start"`
+}
+
 type LivestreamTagModel struct {
 	ID           int64 `db:"id" json:"id"`
 	LivestreamID int64 `db:"livestream_id" json:"livestream_id"`
@@ -62,15 +68,53 @@ type LivestreamTagModel struct {
 }
 
 type ReservationSlotModel struct {
-	ID      int64 `db:"id" json:"id"`
-	Slot    int64 `db:"slot" json:"slot"`
-	StartAt int64 `db:"start_at" json:"start_at"`
-	EndAt   int64 `db:"end_at" json:"end_at"`
+	ID   int64 `db:"id" json:"id"`
+	Slot int64 `db:"slot" json:"slot"`
+	// 初期状態の枠数
+	Capacity int64 `db:"capacity" json:"capacity"`
+	StartAt  int64 `db:"start_at" json:"start_at"`
+	EndAt    int64 `db:"end_at" json:"end_at"`
 }
 
+// 期間内の予約枠と残り枠数 (参照のみなのでロックは取らない)
+// GET /api/reservation/slots?start_at=&end_at=
+func getReservationSlotsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	startAt, err := strconv.ParseInt(c.QueryParam("start_at"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "start_at query parameter must be integer")
+	}
+	endAt, err := strconv.ParseInt(c.QueryParam("end_at"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "end_at query parameter must be integer")
+	}
+	if startAt > endAt {
+		return echo.NewHTTPError(http.StatusBadRequest, "start_at must be less than or equal to end_at")
+	}
+
+	slots := []*ReservationSlotModel{}
+	if err := dbConn.SelectContext(ctx, &slots, "SELECT * FROM reservation_slots WHERE start_at >= ? AND end_at <= ? ORDER BY start_at ASC", startAt, endAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, slots)
+}
+
+// 予約できる最短の配信時間 (予約枠は1時間単位)
+var minReservationDuration = time.Hour
+
+// 予約枠のロックを取り合う予約処理の同時実行数を制限する
+// ISUCON13_RESERVATION_CONCURRENCYが設定されていない場合はnilで、制限しない
+var reservationSemaphore chan struct{}
+
 func reserveLivestreamHandler(c echo.Context) error {
 	ctx := c.Request().Context()
-	defer c.Request().Body.Close()
 
 	if err := verifyUserSession(c); err != nil {
 		// echo.NewHTTPErrorが返っているのでそのまま出力
@@ -82,9 +126,9 @@ func reserveLivestreamHandler(c echo.Context) error {
 	// existence already checked
 	userID := sess.Values[defaultUserIDKey].(int64)
 
-	var req *ReserveLivestreamRequest
-	if err := json.UnmarshalRead(c.Request().Body, &req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	var req ReserveLivestreamRequest
+	if err := decodeJSON(c, &req); err != nil {
+		return err
 	}
 
 	// 2023/11/25 10:00からの１年間の期間内であるかチェック
@@ -97,25 +141,59 @@ func reserveLivestreamHandler(c echo.Context) error {
 	if (reserveStartAt.Equal(termEndAt) || reserveStartAt.After(termEndAt)) || (reserveEndAt.Equal(termStartAt) || reserveEndAt.Before(termStartAt)) {
 		return echo.NewHTTPError(http.StatusBadRequest, "bad reservation time range")
 	}
+	if req.StartAt >= req.EndAt {
+		return echo.NewHTTPError(http.StatusBadRequest, "start_at must be before end_at")
+	}
+	if reserveEndAt.Sub(reserveStartAt) < minReservationDuration {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("reservation must be at least %s", minReservationDuration))
+	}
+
+	// 存在しないタグが紐付かないようにする
+	var unknownTagIDs []string
+	for _, tagID := range req.Tags {
+		if _, err := getTagModelByID(ctx, tagID); err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tag: "+err.Error())
+			}
+			unknownTagIDs = append(unknownTagIDs, strconv.FormatInt(tagID, 10))
+		}
+	}
+	if len(unknownTagIDs) > 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "unknown tag ids: "+strings.Join(unknownTagIDs, ","))
+	}
+
+	if reservationSemaphore != nil {
+		select {
+		case reservationSemaphore <- struct{}{}:
+			defer func() { <-reservationSemaphore }()
+		default:
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "too many concurrent reservations")
+		}
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
 
 	// 予約枠をみて、予約が可能か調べる
 	// NOTE: 並列な予約のoverbooking防止にFOR UPDATEが必要
 	var slots []*ReservationSlotModel
-	if err := dbConn.SelectContext(ctx, &slots, "SELECT * FROM reservation_slots WHERE start_at >= ? AND end_at <= ? FOR UPDATE", req.StartAt, req.EndAt); err != nil {
+	if err := tx.SelectContext(ctx, &slots, "SELECT * FROM reservation_slots WHERE start_at >= ? AND end_at <= ? FOR UPDATE", req.StartAt, req.EndAt); err != nil {
 		c.Logger().Warnf("予約枠一覧取得でエラー発生: %+v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
 	}
 
-	conditions := make([]string, len(slots))
-	for i := range slots {
-		conditions[i] = fmt.Sprintf("(start_at = %d AND end_at = %d AND slot > 0)", slots[i].StartAt, slots[i].EndAt)
-	}
-	query := fmt.Sprintf("SELECT COUNT(*) FROM reservation_slots WHERE %s", strings.Join(conditions, " OR "))
-	var count int
-	if err := dbConn.GetContext(ctx, &count, query); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+	// 区間内のすべての枠に空きがなければ予約できない
+	available := len(slots) > 0
+	for _, slot := range slots {
+		if slot.Slot <= 0 {
+			available = false
+			break
+		}
 	}
-	if count < 1 {
+	if !available {
 		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("予約期間 %d ~ %dに対して、予約区間 %d ~ %dが予約できません", termStartAt.Unix(), termEndAt.Unix(), req.StartAt, req.EndAt))
 	}
 
@@ -131,12 +209,6 @@ func reserveLivestreamHandler(c echo.Context) error {
 		}
 	)
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
-	}
-	defer tx.Rollback()
-
 	if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot - 1 WHERE start_at >= ? AND end_at <= ?", req.StartAt, req.EndAt); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slot: "+err.Error())
 	}
@@ -151,13 +223,6 @@ func reserveLivestreamHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livestream id: "+err.Error())
 	}
 	livestreamModel.ID = livestreamID
-	livestreamModelByIdCache.Set(livestreamID, *livestreamModel)
-	livestreamModelsByUserID, ok := livestreamModelByUserIDCache.Get(livestreamModel.UserID)
-	if !ok {
-		livestreamModelsByUserID = make([]*LivestreamModel, 0)
-	}
-	livestreamModelsByUserID = append(livestreamModelsByUserID, livestreamModel)
-	livestreamModelByUserIDCache.Set(livestreamModel.UserID, livestreamModelsByUserID)
 
 	// タグ追加
 	livestreamTagModels := make([]*LivestreamTagModel, len(req.Tags))
@@ -178,6 +243,21 @@ func reserveLivestreamHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	// ロールバックされた配信が残らないように、キャッシュはコミットしてから更新する
+	livestreamModelByIdCache.Set(livestreamID, *livestreamModel)
+	// 載っていない場合は新しい配信だけの一覧を載せると不完全になるので、次のGetOrSetでDBから読ませる
+	if livestreamModelsByUserID, ok := livestreamModelByUserIDCache.Get(livestreamModel.UserID); ok {
+		// 取得済みの一覧を読んでいるリクエストと配列を共有しないように、コピーしてから足す
+		updated := make([]*LivestreamModel, 0, len(livestreamModelsByUserID)+1)
+		updated = append(updated, livestreamModelsByUserID...)
+		livestreamModelByUserIDCache.Set(livestreamModel.UserID, append(updated, livestreamModel))
+	}
+	livestreamModelByUserIDCache.Invalidate(livestreamModel.UserID)
+	// 予約後にタグは変わらないので、そのままキャッシュに載せておく
+	livestreamTagsCache.Set(livestreamID, append([]int64{}, req.Tags...))
+	// 他のサーバーが存在しない配信IDとして空のタグを載せている場合があるので破棄させる
+	livestreamTagsCache.Invalidate(livestreamID)
+
 	livestream, err := fillLivestreamResponse(ctx, dbConn, *livestreamModel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
@@ -188,6 +268,39 @@ func reserveLivestreamHandler(c echo.Context) error {
 
 func searchLivestreamsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
+
+	livestreamModels, err := searchLivestreamModels(c)
+	if err != nil {
+		return err
+	}
+
+	livestreams, err := fillLivestreamResponseBulk(ctx, dbConn, livestreamModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
+	return streamJSONArray(c, http.StatusOK, livestreams)
+}
+
+// 検索結果のIDだけを検索と同じ順序で返す
+// GET /api/livestream/search/ids
+func searchLivestreamIDsHandler(c echo.Context) error {
+	livestreamModels, err := searchLivestreamModels(c)
+	if err != nil {
+		return err
+	}
+
+	livestreamIDs := make([]int64, len(livestreamModels))
+	for i := range livestreamModels {
+		livestreamIDs[i] = livestreamModels[i].ID
+	}
+
+	return c.JSON(http.StatusOK, livestreamIDs)
+}
+
+// tag, limitクエリパラメータに従って配信を検索する (エラーはecho.HTTPErrorで返す)
+func searchLivestreamModels(c echo.Context) ([]*LivestreamModel, error) {
+	ctx := c.Request().Context()
 	keyTagName := c.QueryParam("tag")
 
 	var livestreamModels []*LivestreamModel
@@ -203,11 +316,11 @@ func searchLivestreamsHandler(c echo.Context) error {
 
 		query, params, err := sqlx.In("SELECT * FROM livestream_tags WHERE tag_id IN (?) ORDER BY livestream_id DESC", tagIDList)
 		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
 		}
 		var keyTaggedLivestreams []*LivestreamTagModel
-		if err := dbConn.SelectContext(ctx, &keyTaggedLivestreams, query, params...); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get keyTaggedLivestreams: "+err.Error())
+		if err := readDB().SelectContext(ctx, &keyTaggedLivestreams, query, params...); err != nil {
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get keyTaggedLivestreams: "+err.Error())
 		}
 
 		livestreamIDs := make([]int64, len(keyTaggedLivestreams))
@@ -219,15 +332,11 @@ func searchLivestreamsHandler(c echo.Context) error {
 		for i := range livestreamIDs {
 			livestreamModel, ok := livestreamModelByIdCache.Get(livestreamIDs[i])
 			if !ok {
-				if err := dbConn.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamIDs[i]); err != nil {
-					return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+				if err := readDB().GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamIDs[i]); err != nil {
+					return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
 				}
+				// 配信者ごとの一覧はこの1件だけでは完全にならないので、getLivestreamModelsByUserIDに任せる
 				livestreamModelByIdCache.Set(livestreamIDs[i], livestreamModel)
-				cached, ok := livestreamModelByUserIDCache.Get(livestreamModel.UserID)
-				if !ok {
-					cached = make([]*LivestreamModel, 0)
-				}
-				livestreamModelByUserIDCache.Set(livestreamModel.UserID, append(cached, &livestreamModel))
 			}
 			livestreamModels[i] = &livestreamModel
 		}
@@ -239,17 +348,55 @@ func searchLivestreamsHandler(c echo.Context) error {
 	} else {
 		// 検索条件なし
 		query := `SELECT * FROM livestreams ORDER BY id DESC`
+		var args []interface{}
 		if c.QueryParam("limit") != "" {
 			limit, err := strconv.Atoi(c.QueryParam("limit"))
 			if err != nil {
-				return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
+				return nil, echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
 			}
-			query += fmt.Sprintf(" LIMIT %d", limit)
+			query += " LIMIT ?"
+			args = append(args, limit)
+		}
+
+		if err := readDB().SelectContext(ctx, &livestreamModels, query, args...); err != nil {
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 		}
+	}
+
+	return livestreamModels, nil
+}
 
-		if err := dbConn.SelectContext(ctx, &livestreamModels, query); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+// 終了した配信一覧で一度に返す最大件数
+const maxRecentEndedLivestreamsLimit = 100
+
+// 配信が終了したライブ配信を終了時刻の新しい順に返す
+// GET /api/livestream/recent-ended
+func getRecentEndedLivestreamsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	limit := 20
+	if c.QueryParam("limit") != "" {
+		v, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || v < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be non-negative integer")
+		}
+		limit = v
+	}
+	if limit > maxRecentEndedLivestreamsLimit {
+		limit = maxRecentEndedLivestreamsLimit
+	}
+	offset := 0
+	if c.QueryParam("offset") != "" {
+		v, err := strconv.Atoi(c.QueryParam("offset"))
+		if err != nil || v < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "offset query parameter must be non-negative integer")
 		}
+		offset = v
+	}
+
+	var livestreamModels []*LivestreamModel
+	if err := dbConn.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE end_at < ? ORDER BY end_at DESC, id DESC LIMIT ? OFFSET ?", nowFunc().Unix(), limit, offset); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 	}
 
 	livestreams, err := fillLivestreamResponseBulk(ctx, dbConn, livestreamModels)
@@ -271,9 +418,9 @@ func getMyLivestreamsHandler(c echo.Context) error {
 	// existence already checked
 	userID := sess.Values[defaultUserIDKey].(int64)
 
-	livestreamModels, ok := livestreamModelByUserIDCache.Get(userID)
-	if !ok {
-		livestreamModels = make([]*LivestreamModel, 0)
+	livestreamModels, err := getLivestreamModelsByUserID(ctx, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 	}
 
 	livestreams, err := fillLivestreamResponseBulk(ctx, dbConn, livestreamModels)
@@ -297,9 +444,9 @@ func getUserLivestreamsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusNotFound, "user not found")
 	}
 
-	livestreamModels, ok := livestreamModelByUserIDCache.Get(user.ID)
-	if !ok {
-		livestreamModels = make([]*LivestreamModel, 0)
+	livestreamModels, err := getLivestreamModelsByUserID(ctx, user.ID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 	}
 
 	livestreams, err := fillLivestreamResponseBulk(ctx, dbConn, livestreamModels)
@@ -331,12 +478,13 @@ func enterLivestreamHandler(c echo.Context) error {
 	viewer := LivestreamViewerModel{
 		UserID:       int64(userID),
 		LivestreamID: int64(livestreamID),
-		CreatedAt:    time.Now().Unix(),
+		CreatedAt:    nowFunc().Unix(),
 	}
 
 	if _, err := dbConn.NamedExecContext(ctx, "INSERT INTO livestream_viewers_history (user_id, livestream_id, created_at) VALUES(:user_id, :livestream_id, :created_at)", viewer); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream_view_history: "+err.Error())
 	}
+	viewersCountCache.Delete(int64(livestreamID))
 
 	return c.NoContent(http.StatusOK)
 }
@@ -358,14 +506,116 @@ func exitLivestreamHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 
+	// 視聴時間を記録してから履歴を消す
+	var enteredAt sql.NullInt64
+	if err := dbConn.GetContext(ctx, &enteredAt, "SELECT MIN(created_at) FROM livestream_viewers_history WHERE user_id = ? AND livestream_id = ?", userID, livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream_view_history: "+err.Error())
+	}
+	if enteredAt.Valid {
+		now := nowFunc().Unix()
+		if _, err := dbConn.ExecContext(ctx, "INSERT INTO livestream_view_durations (user_id, livestream_id, duration, created_at) VALUES (?, ?, ?, ?)", userID, livestreamID, now-enteredAt.Int64, now); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream_view_duration: "+err.Error())
+		}
+	}
+
 	if _, err := dbConn.ExecContext(ctx, "DELETE FROM livestream_viewers_history WHERE user_id = ? AND livestream_id = ?", userID, livestreamID); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream_view_history: "+err.Error())
 	}
+	viewersCountCache.Delete(int64(livestreamID))
 
 	return c.NoContent(http.StatusOK)
 }
 
-func getLivestreamHandler(c echo.Context) error {
+type RetentionCheckpoint struct {
+	// 視聴開始からの秒数
+	Seconds int64 `json:"seconds"`
+	// この時間以上視聴した視聴者の割合
+	Ratio float64 `json:"ratio"`
+}
+
+type LivestreamRetention struct {
+	TotalViewers int64                 `json:"total_viewers"`
+	Checkpoints  []RetentionCheckpoint `json:"checkpoints"`
+}
+
+// 視聴者がどれだけ視聴を続けたか (配信者のみ)
+// GET /api/livestream/:livestream_id/retention?checkpoints=60,300,900
+func getLivestreamRetentionHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	livestreamModel, ok := livestreamModelByIdCache.Get(int64(livestreamID))
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+	}
+
+	// error already check
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already check
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	if livestreamModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't get other streamer's retention")
+	}
+
+	checkpoints := []int64{60, 300, 900}
+	if c.QueryParam("checkpoints") != "" {
+		checkpoints = checkpoints[:0]
+		for _, v := range strings.Split(c.QueryParam("checkpoints"), ",") {
+			seconds, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+			if err != nil || seconds < 0 {
+				return echo.NewHTTPError(http.StatusBadRequest, "checkpoints query parameter must be comma separated non-negative integers")
+			}
+			checkpoints = append(checkpoints, seconds)
+		}
+	}
+
+	var durations []int64
+	if err := dbConn.SelectContext(ctx, &durations, "SELECT duration FROM livestream_view_durations WHERE livestream_id = ?", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream_view_durations: "+err.Error())
+	}
+
+	retention := LivestreamRetention{
+		TotalViewers: int64(len(durations)),
+		Checkpoints:  make([]RetentionCheckpoint, len(checkpoints)),
+	}
+	for i, seconds := range checkpoints {
+		retention.Checkpoints[i].Seconds = seconds
+		if len(durations) == 0 {
+			continue
+		}
+		var stayed int
+		for _, duration := range durations {
+			if duration >= seconds {
+				stayed++
+			}
+		}
+		retention.Checkpoints[i].Ratio = float64(stayed) / float64(len(durations))
+	}
+
+	return c.JSON(http.StatusOK, retention)
+}
+
+type ViewerTimelineBucket struct {
+	StartAt      int64 `json:"start_at"`
+	ViewersCount int64 `json:"viewers_count"`
+}
+
+// タイムラインのバケット数の上限
+const maxViewerTimelineBuckets = 10000
+
+// 同時視聴者数の推移 (配信者のみ)
+// 視聴中のユーザは入室時刻から現在まで、退室済みのユーザは記録した視聴時間の区間を視聴していたとみなす
+// GET /api/livestream/:livestream_id/viewers/timeline?bucket=60
+func getLivestreamViewersTimelineHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
 	if err := verifyUserSession(c); err != nil {
@@ -382,6 +632,101 @@ func getLivestreamHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
 	}
 
+	// error already check
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already check
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	if livestreamModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't get other streamer's viewers timeline")
+	}
+
+	var bucket int64 = 60
+	if c.QueryParam("bucket") != "" {
+		v, err := strconv.ParseInt(c.QueryParam("bucket"), 10, 64)
+		if err != nil || v <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "bucket query parameter must be positive integer")
+		}
+		bucket = v
+	}
+
+	now := nowFunc().Unix()
+	from := livestreamModel.StartAt
+	to := livestreamModel.EndAt
+	if now < to {
+		to = now
+	}
+	if to <= from {
+		return c.JSON(http.StatusOK, []ViewerTimelineBucket{})
+	}
+	if (to-from+bucket-1)/bucket > maxViewerTimelineBuckets {
+		return echo.NewHTTPError(http.StatusBadRequest, "bucket query parameter is too small")
+	}
+
+	type interval struct {
+		EnterAt int64 `db:"enter_at"`
+		ExitAt  int64 `db:"exit_at"`
+	}
+	var intervals []interval
+	query := `
+	SELECT created_at AS enter_at, ? AS exit_at FROM livestream_viewers_history WHERE livestream_id = ?
+	UNION ALL
+	SELECT created_at - duration AS enter_at, created_at AS exit_at FROM livestream_view_durations WHERE livestream_id = ?
+	`
+	if err := dbConn.SelectContext(ctx, &intervals, query, now, livestreamID, livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get viewers history: "+err.Error())
+	}
+
+	timeline := make([]ViewerTimelineBucket, 0, (to-from+bucket-1)/bucket)
+	for t := from; t < to; t += bucket {
+		timeline = append(timeline, ViewerTimelineBucket{StartAt: t})
+	}
+	// バケットと区間が重なっていればそのバケットの視聴者として数える
+	for _, iv := range intervals {
+		if iv.ExitAt < from || iv.EnterAt >= to {
+			continue
+		}
+		first := int64(0)
+		if iv.EnterAt > from {
+			first = (iv.EnterAt - from) / bucket
+		}
+		last := (iv.ExitAt - from) / bucket
+		if last >= int64(len(timeline)) {
+			last = int64(len(timeline)) - 1
+		}
+		for b := first; b <= last; b++ {
+			timeline[b].ViewersCount++
+		}
+	}
+
+	return c.JSON(http.StatusOK, timeline)
+}
+
+func getLivestreamHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	// キャッシュになければDBから読んでキャッシュに載せる
+	livestreamModel, err := livestreamModelByIdCache.GetOrSet(int64(livestreamID), func() (LivestreamModel, error) {
+		var livestreamModel LivestreamModel
+		err := dbConn.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID)
+		return livestreamModel, err
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
 	livestream, err := fillLivestreamResponse(ctx, dbConn, livestreamModel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
@@ -390,6 +735,69 @@ func getLivestreamHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, livestream)
 }
 
+// 配信開始までの残り時間をサーバ時刻基準で返す
+// GET /api/livestream/:livestream_id/countdown
+func getLivestreamCountdownHandler(c echo.Context) error {
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	livestreamModel, ok := livestreamModelByIdCache.Get(int64(livestreamID))
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+	}
+
+	return c.JSON(http.StatusOK, &LivestreamCountdown{
+		LivestreamID:      livestreamModel.ID,
+		SecondsUntilStart: livestreamModel.StartAt - nowFunc().Unix(),
+	})
+}
+
+type LivestreamStatus struct {
+	Live    bool  `json:"live"`
+	Viewers int64 `json:"viewers"`
+}
+
+// 配信中かどうかと現在の視聴者数を返す
+// GET /api/livestream/:livestream_id/status
+func getLivestreamStatusHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	livestreamModel, ok := livestreamModelByIdCache.Get(int64(livestreamID))
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+	}
+
+	viewers, err := viewersCountCache.GetOrSet(livestreamModel.ID, func() (int64, error) {
+		var count int64
+		err := dbConn.GetContext(ctx, &count, "SELECT COUNT(DISTINCT user_id) FROM livestream_viewers_history WHERE livestream_id = ?", livestreamModel.ID)
+		return count, err
+	})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count viewers: "+err.Error())
+	}
+
+	now := nowFunc().Unix()
+	return c.JSON(http.StatusOK, &LivestreamStatus{
+		Live:    livestreamModel.StartAt <= now && now < livestreamModel.EndAt,
+		Viewers: viewers,
+	})
+}
+
 func getLivecommentReportsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
@@ -416,8 +824,19 @@ func getLivecommentReportsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusForbidden, "can't get other streamer's livecomment reports")
 	}
 
+	query := "SELECT * FROM livecomment_reports WHERE livestream_id = ?"
+	args := []interface{}{livestreamID}
+	if c.QueryParam("resolved") != "" {
+		resolved, err := strconv.ParseBool(c.QueryParam("resolved"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "resolved query parameter must be boolean")
+		}
+		query += " AND resolved = ?"
+		args = append(args, resolved)
+	}
+
 	var reportModels []LivecommentReportModel
-	if err := dbConn.SelectContext(ctx, &reportModels, "SELECT * FROM livecomment_reports WHERE livestream_id = ?", livestreamID); err != nil {
+	if err := dbConn.SelectContext(ctx, &reportModels, query, args...); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment reports: "+err.Error())
 	}
 
@@ -429,27 +848,39 @@ func getLivecommentReportsHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, reports)
 }
 
+// キャッシュになければDBから取得してキャッシュに載せる (配信がなければ空で載せる)
+func getLivestreamModelsByUserID(ctx context.Context, userID int64) ([]*LivestreamModel, error) {
+	return livestreamModelByUserIDCache.GetOrSet(userID, func() ([]*LivestreamModel, error) {
+		livestreamModels := []*LivestreamModel{}
+		if err := dbConn.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE user_id = ?", userID); err != nil {
+			return nil, err
+		}
+		return livestreamModels, nil
+	})
+}
+
 func fillLivestreamResponse(ctx context.Context, db *sqlx.DB, livestreamModel LivestreamModel) (Livestream, error) {
-	ownerModel, ok := userModelByIdCache.Get(livestreamModel.UserID)
-	if !ok {
-		return Livestream{}, fmt.Errorf("failed to get user model by id: %d", livestreamModel.UserID)
+	ownerModel, err := getUserModelByID(ctx, livestreamModel.UserID)
+	if err != nil {
+		return Livestream{}, err
 	}
 	owner, err := fillUserResponse(ctx, db, ownerModel)
 	if err != nil {
 		return Livestream{}, err
 	}
 
-	var livestreamTagModels []*LivestreamTagModel
-	if err := db.SelectContext(ctx, &livestreamTagModels, "SELECT * FROM livestream_tags WHERE livestream_id = ?", livestreamModel.ID); err != nil {
+	tagIDsMap, err := livestreamTagsLoaderFrom(ctx).load(ctx, db, []int64{livestreamModel.ID})
+	if err != nil {
 		return Livestream{}, err
 	}
+	tagIDs := tagIDsMap[livestreamModel.ID]
 
-	tags := make([]Tag, len(livestreamTagModels))
+	tags := make([]Tag, len(tagIDs))
 	var tagModels []TagModel
-	for i := range livestreamTagModels {
-		tagModel, ok := tagModelCache.Get(livestreamTagModels[i].TagID)
-		if !ok {
-			return Livestream{}, fmt.Errorf("failed to get tag: %d", livestreamTagModels[i].TagID)
+	for _, tagID := range tagIDs {
+		tagModel, err := getTagModelByID(ctx, tagID)
+		if err != nil {
+			return Livestream{}, fmt.Errorf("failed to get tag: %d: %w", tagID, err)
 		}
 		tagModels = append(tagModels, tagModel)
 	}
@@ -487,9 +918,9 @@ func fillLivestreamResponseBulk(ctx context.Context, db *sqlx.DB, livestreamMode
 	var ownerModels []UserModel
 	livestreamIDs := make([]int64, len(livestreamModels))
 	for i := range livestreamModels {
-		userModel, ok := userModelByIdCache.Get(livestreamModels[i].UserID)
-		if !ok {
-			return nil, fmt.Errorf("failed to get user model by id: %d", livestreamModels[i].UserID)
+		userModel, err := getUserModelByID(ctx, livestreamModels[i].UserID)
+		if err != nil {
+			return nil, err
 		}
 		ownerModels = append(ownerModels, userModel)
 
@@ -506,33 +937,24 @@ func fillLivestreamResponseBulk(ctx context.Context, db *sqlx.DB, livestreamMode
 		ownersMap[owners[i].ID] = owners[i]
 	}
 
-	var allLivestreamTagModels []*LivestreamTagModel
-	query, params, err := sqlx.In("SELECT * FROM livestream_tags WHERE livestream_id IN (?)", livestreamIDs)
+	tagIDsMap, err := livestreamTagsLoaderFrom(ctx).load(ctx, db, livestreamIDs)
 	if err != nil {
 		return nil, err
 	}
-	if err := db.SelectContext(ctx, &allLivestreamTagModels, query, params...); err != nil {
-		return nil, err
-	}
-
-	livestreamTagsMap := make(map[int64][]*LivestreamTagModel, len(allLivestreamTagModels))
-	for i := range allLivestreamTagModels {
-		livestreamTagsModel := allLivestreamTagModels[i]
-		if _, ok := livestreamTagsMap[livestreamTagsModel.LivestreamID]; !ok {
-			livestreamTagsMap[livestreamTagsModel.LivestreamID] = []*LivestreamTagModel{livestreamTagsModel}
-		} else {
-			livestreamTagsMap[livestreamTagsModel.LivestreamID] = append(livestreamTagsMap[livestreamTagsModel.LivestreamID], livestreamTagsModel)
-		}
-	}
 
 	var allTagModels []TagModel
-	for i := range allLivestreamTagModels {
-		tagModel, ok := tagModelCache.Get(allLivestreamTagModels[i].TagID)
-		if !ok {
-			gErr = fmt.Errorf("failed to get tag: %d", allLivestreamTagModels[i].TagID)
+	for _, tagIDs := range tagIDsMap {
+		for _, tagID := range tagIDs {
+			tagModel, err := getTagModelByID(ctx, tagID)
+			if err != nil {
+				gErr = fmt.Errorf("failed to get tag: %d: %w", tagID, err)
+				break
+			}
+			allTagModels = append(allTagModels, tagModel)
+		}
+		if gErr != nil {
 			break
 		}
-		allTagModels = append(allTagModels, tagModel)
 	}
 
 	tagsMap := make(map[int64]Tag, len(allTagModels))
@@ -552,14 +974,10 @@ func fillLivestreamResponseBulk(ctx context.Context, db *sqlx.DB, livestreamMode
 			break
 		}
 
-		livestreamTagModels, ok := livestreamTagsMap[livestreamModel.ID]
-		if !ok {
-			livestreamTagModels = []*LivestreamTagModel{}
-		}
-
-		tags := make([]Tag, len(livestreamTagModels))
-		for i := range livestreamTagModels {
-			tags[i] = tagsMap[livestreamTagModels[i].TagID]
+		tagIDs := tagIDsMap[livestreamModel.ID]
+		tags := make([]Tag, len(tagIDs))
+		for i, tagID := range tagIDs {
+			tags[i] = tagsMap[tagID]
 		}
 
 		livestream := Livestream{
@@ -0,0 +1,799 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-json-experiment/json"
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// userIDでログインしている状態でハンドラを呼び、ステータスコードとボディを返す
+func serveAs(userID int64, h echo.HandlerFunc, method, target, body string, params ...string) (int, string, error) {
+	return serveWithSession(map[any]any{defaultUserIDKey: userID}, h, method, target, body, params...)
+}
+
+// セッションにsessionValuesを入れた状態でハンドラを呼ぶ (有効期限は1時間後にする)
+func serveWithSession(sessionValues map[any]any, h echo.HandlerFunc, method, target, body string, params ...string) (int, string, error) {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	return serveRequestWithSession(sessionValues, h, req, params...)
+}
+
+// JSON以外のボディを送るときはリクエストを組み立ててこちらを呼ぶ
+func serveRequestWithSession(sessionValues map[any]any, h echo.HandlerFunc, req *http.Request, params ...string) (int, string, error) {
+	e := echo.New()
+	e.JSONSerializer = jsonSerializer{}
+	method := req.Method
+	rec := httptest.NewRecorder()
+	// パスパラメータの数だけルートを登録しておかないと、SetParamValuesで値が捨てられる
+	var path string
+	var names, values []string
+	for i := 0; i+1 < len(params); i += 2 {
+		path += "/:" + params[i]
+		names = append(names, params[i])
+		values = append(values, params[i+1])
+	}
+	e.Add(method, path+"/", h)
+	c := e.NewContext(req, rec)
+	c.SetParamNames(names...)
+	c.SetParamValues(values...)
+
+	withSession := session.Middleware(sessions.NewCookieStore(secret))(func(c echo.Context) error {
+		sess, err := session.Get(defaultSessionIDKey, c)
+		if err != nil {
+			return err
+		}
+		sess.Values[defaultSessionExpiresKey] = time.Now().Add(time.Hour).Unix()
+		// nilを渡したキーはセッションから消す
+		for k, v := range sessionValues {
+			if v == nil {
+				delete(sess.Values, k)
+				continue
+			}
+			sess.Values[k] = v
+		}
+		return h(c)
+	})
+	if err := withSession(c); err != nil {
+		var he *echo.HTTPError
+		if errors.As(err, &he) {
+			// エラーのときはメッセージをボディの代わりに返す
+			return he.Code, fmt.Sprint(he.Message), nil
+		}
+		return 0, "", err
+	}
+	return rec.Code, rec.Body.String(), nil
+}
+
+func reserveAs(userID int64, body string) (int, error) {
+	code, _, err := serveAs(userID, reserveLivestreamHandler, http.MethodPost, "/api/livestream/reservation", body)
+	return code, err
+}
+
+// 残り2枠の予約枠を作り、そこにn件の予約を同時に投げてステータスコードと残り枠数を返す
+func reserveConcurrently(t *testing.T, n int) ([]int, int64) {
+	t.Helper()
+	setupTestDB(t)
+	user, _ := seedTestLivestreams(t, "reserve-test-user", 0)
+	slot := ReservationSlotModel{Slot: 2, Capacity: 2, StartAt: 1704067200, EndAt: 1704070800}
+	if _, err := dbConn.NamedExec("INSERT INTO reservation_slots (slot, capacity, start_at, end_at) VALUES (:slot, :capacity, :start_at, :end_at)", slot); err != nil {
+		t.Fatal(err)
+	}
+	body := reservationBody()
+
+	codes := make([]int, n)
+	errs := make([]error, n)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			codes[i], errs[i] = reserveAs(user.ID, body)
+		}(i)
+	}
+	close(start)
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("concurrent reservations did not finish (deadlock?)")
+	}
+	for i := range errs {
+		if errs[i] != nil {
+			t.Fatalf("reservation %d failed: %v", i, errs[i])
+		}
+	}
+
+	var remaining int64
+	if err := dbConn.Get(&remaining, "SELECT slot FROM reservation_slots"); err != nil {
+		t.Fatal(err)
+	}
+	return codes, remaining
+}
+
+func countStatus(codes []int, status int) int {
+	n := 0
+	for _, code := range codes {
+		if code == status {
+			n++
+		}
+	}
+	return n
+}
+
+func TestReserveLivestreamConcurrentNoOverbooking(t *testing.T) {
+	codes, remaining := reserveConcurrently(t, 7)
+
+	if created := countStatus(codes, http.StatusCreated); created != 2 {
+		t.Errorf("created %d reservations, want 2", created)
+	}
+	if rejected := countStatus(codes, http.StatusBadRequest); rejected != 5 {
+		t.Errorf("rejected %d reservations, want 5 (codes=%v)", rejected, codes)
+	}
+	if remaining != 0 {
+		t.Errorf("remaining slot = %d, want 0", remaining)
+	}
+}
+
+func TestReserveLivestreamConcurrentWithSemaphore(t *testing.T) {
+	prev := reservationSemaphore
+	reservationSemaphore = make(chan struct{}, 1)
+	t.Cleanup(func() { reservationSemaphore = prev })
+
+	codes, remaining := reserveConcurrently(t, 20)
+
+	created := countStatus(codes, http.StatusCreated)
+	unavailable := countStatus(codes, http.StatusServiceUnavailable)
+	if unavailable == 0 {
+		t.Errorf("no reservation was turned away with 503 (codes=%v)", codes)
+	}
+	if created+unavailable+countStatus(codes, http.StatusBadRequest) != len(codes) {
+		t.Errorf("unexpected status in %v, want only 201, 400 or 503", codes)
+	}
+	if created > 2 {
+		t.Errorf("created %d reservations for 2 slots", created)
+	}
+	if remaining != 2-int64(created) {
+		t.Errorf("remaining slot = %d, want %d", remaining, 2-created)
+	}
+}
+
+// 上限まで使われていれば、DBに触らずに503を返す
+func TestReserveLivestreamSemaphoreFull(t *testing.T) {
+	f := setupHandlerTest(t)
+	fakeReservation(f, 100)
+	prev := reservationSemaphore
+	reservationSemaphore = make(chan struct{}, 1)
+	reservationSemaphore <- struct{}{}
+	t.Cleanup(func() { reservationSemaphore = prev })
+
+	code, err := reserveAs(1, reservationBody())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	if n := f.count("reservation_slots"); n != 0 {
+		t.Errorf("queried reservation_slots %d times while the semaphore was full", n)
+	}
+
+	// 空きができれば予約できる
+	<-reservationSemaphore
+	if code, err := reserveAs(1, reservationBody()); err != nil || code != http.StatusCreated {
+		t.Errorf("status after release = %d (err=%v), want %d", code, err, http.StatusCreated)
+	}
+}
+
+func TestGetRecentEndedLivestreamsRejectsNegativeParams(t *testing.T) {
+	for _, query := range []string{"limit=-1", "offset=-1", "limit=abc"} {
+		e := echo.New()
+		req := httptest.NewRequest(http.MethodGet, "/api/livestream/recent-ended?"+query, nil)
+		err := getRecentEndedLivestreamsHandler(e.NewContext(req, httptest.NewRecorder()))
+		var he *echo.HTTPError
+		if !errors.As(err, &he) || he.Code != http.StatusBadRequest {
+			t.Errorf("%s: err = %v, want 400", query, err)
+		}
+	}
+}
+
+func TestSearchLivestreamsLimit(t *testing.T) {
+	setupTestDB(t)
+	user, _ := seedTestLivestreams(t, "search-test-user", 5)
+
+	code, body, err := serveAs(user.ID, searchLivestreamsHandler, http.MethodGet, "/api/livestream/search?limit=3", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+	var livestreams []Livestream
+	if err := json.Unmarshal([]byte(body), &livestreams); err != nil {
+		t.Fatal(err)
+	}
+	if len(livestreams) != 3 {
+		t.Errorf("len(livestreams) = %d, want 3", len(livestreams))
+	}
+}
+
+func TestSearchLivestreamsLimitIsBound(t *testing.T) {
+	f := setupHandlerTest(t)
+	var gotArgs []driver.Value
+	f.on("SELECT * FROM livestreams ORDER BY id DESC", func(args []driver.Value) fakeResponse {
+		gotArgs = args
+		return fakeResponse{}
+	})
+
+	code, _, err := serveAs(1, searchLivestreamsHandler, http.MethodGet, "/api/livestream/search?limit=3", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+	if q := f.lastQuery(); !strings.HasSuffix(q, "LIMIT ?") {
+		t.Errorf("query = %s, want a bound LIMIT", q)
+	}
+	if want := []driver.Value{int64(3)}; !slices.Equal(gotArgs, want) {
+		t.Errorf("args = %v, want %v", gotArgs, want)
+	}
+}
+
+// 2024/01/01 00:00 (UTC) から1時間の予約
+func reservationBody(tags ...int64) string {
+	b, _ := json.Marshal(ReserveLivestreamRequest{
+		Tags:         append([]int64{}, tags...),
+		Title:        "test",
+		Description:  "test",
+		PlaylistUrl:  "https://media.xiidec.com/whoami/playlist.m3u8",
+		ThumbnailUrl: "https://media.xiidec.com/whoami/thumbnail.jpg",
+		StartAt:      1704067200,
+		EndAt:        1704070800,
+	})
+	return string(b)
+}
+
+// reservationBodyの区間に空きが1枠ある状態で、livestreamIDの配信が作られるようにする
+func fakeReservation(f *fakeDB, livestreamID int64) {
+	f.rows("FROM reservation_slots", ReservationSlotModel{ID: 1, Slot: 1, Capacity: 1, StartAt: 1704067200, EndAt: 1704070800})
+	f.exec("UPDATE reservation_slots", 0)
+	f.exec("INSERT INTO livestreams", livestreamID)
+	f.rowsWhere("FROM users WHERE id", "id", UserModel{ID: 1, Name: "reserve-test-user"})
+	f.rowsWhere("FROM themes WHERE user_id", "user_id", ThemeModel{ID: 1, UserID: 1})
+}
+
+func TestReserveLivestreamRejectsWindowWithFullSlot(t *testing.T) {
+	body, _ := json.Marshal(ReserveLivestreamRequest{
+		Tags:    []int64{},
+		Title:   "test",
+		StartAt: 1704067200,
+		EndAt:   1704067200 + 3*3600,
+	})
+	tests := []struct {
+		name     string
+		slots    []int64
+		wantCode int
+	}{
+		{"full inner slot", []int64{1, 0, 1}, http.StatusBadRequest},
+		{"full last slot", []int64{1, 1, 0}, http.StatusBadRequest},
+		{"all available", []int64{1, 1, 1}, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := setupHandlerTest(t)
+			fakeReservation(f, 100)
+			slots := make([]any, len(tt.slots))
+			for i, slot := range tt.slots {
+				start := int64(1704067200 + i*3600)
+				slots[i] = ReservationSlotModel{ID: int64(i + 1), Slot: slot, Capacity: 1, StartAt: start, EndAt: start + 3600}
+			}
+			f.rows("FROM reservation_slots", slots...)
+
+			code, err := reserveAs(1, string(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", code, tt.wantCode)
+			}
+			if code != http.StatusCreated && f.count("UPDATE reservation_slots") != 0 {
+				t.Error("decremented the slots of a rejected reservation")
+			}
+		})
+	}
+}
+
+func TestReserveLivestreamValidatesRange(t *testing.T) {
+	const start = 1704067200
+	tests := []struct {
+		name        string
+		startAt     int64
+		endAt       int64
+		minDuration time.Duration
+		wantCode    int
+	}{
+		{"reversed", start + 3600, start, time.Hour, http.StatusBadRequest},
+		{"zero length", start, start, time.Hour, http.StatusBadRequest},
+		{"shorter than minimum", start, start + 1800, time.Hour, http.StatusBadRequest},
+		{"exactly minimum", start, start + 3600, time.Hour, http.StatusCreated},
+		{"short with lowered minimum", start, start + 1800, 15 * time.Minute, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := setupHandlerTest(t)
+			fakeReservation(f, 100)
+			prev := minReservationDuration
+			minReservationDuration = tt.minDuration
+			t.Cleanup(func() { minReservationDuration = prev })
+
+			body, _ := json.Marshal(ReserveLivestreamRequest{Tags: []int64{}, Title: "test", StartAt: tt.startAt, EndAt: tt.endAt})
+			code, err := reserveAs(1, string(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if code != tt.wantCode {
+				t.Errorf("status = %d, want %d", code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestReserveLivestreamRejectsUnknownTags(t *testing.T) {
+	f := setupHandlerTest(t)
+	fakeReservation(f, 100)
+	f.rowsWhere("FROM tags WHERE id", "id", TagModel{ID: 1, Name: "known"})
+	f.exec("INSERT INTO livestream_tags", 0)
+
+	code, body, err := serveAs(1, reserveLivestreamHandler, http.MethodPost, "/api/livestream/reservation", reservationBody(1, 99, 98))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", code, http.StatusBadRequest)
+	}
+	if !strings.Contains(body, "99,98") {
+		t.Errorf("message = %q, want unknown ids 99,98", body)
+	}
+	// 枠を消費する前に弾く
+	if n := f.count("UPDATE reservation_slots"); n != 0 {
+		t.Errorf("reservation_slots updated %d times, want 0", n)
+	}
+	if n := f.count("INSERT INTO livestream_tags"); n != 0 {
+		t.Errorf("livestream_tags inserted %d times, want 0", n)
+	}
+
+	code, err = reserveAs(1, reservationBody(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusCreated {
+		t.Errorf("known tag: status = %d, want %d", code, http.StatusCreated)
+	}
+}
+
+func TestReserveLivestreamCommitFailureLeavesCaches(t *testing.T) {
+	f := setupHandlerTest(t)
+	fakeReservation(f, 100)
+	f.commitErr = errors.New("commit failed")
+	livestreamModelByUserIDCache.Set(1, []*LivestreamModel{{ID: 1, UserID: 1}})
+
+	code, err := reserveAs(1, reservationBody())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want %d", code, http.StatusInternalServerError)
+	}
+	if _, ok := livestreamModelByIdCache.Get(100); ok {
+		t.Error("rolled back livestream is in livestreamModelByIdCache")
+	}
+	if _, ok := livestreamTagsCache.Get(100); ok {
+		t.Error("rolled back livestream is in livestreamTagsCache")
+	}
+	if got, _ := livestreamModelByUserIDCache.Get(1); len(got) != 1 {
+		t.Errorf("len(livestreamModelByUserIDCache[1]) = %d, want 1", len(got))
+	}
+}
+
+func TestReserveLivestreamDoesNotShareCachedSlice(t *testing.T) {
+	f := setupHandlerTest(t)
+	fakeReservation(f, 100)
+	// 余分な容量があるとappendが元の配列に書き込んでしまう
+	cached := make([]*LivestreamModel, 1, 4)
+	cached[0] = &LivestreamModel{ID: 1, UserID: 1}
+	livestreamModelByUserIDCache.Set(1, cached)
+
+	code, err := reserveAs(1, reservationBody())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d", code, http.StatusCreated)
+	}
+	if cached[:2][1] != nil {
+		t.Error("reservation wrote into the backing array of the cached slice")
+	}
+	got, _ := livestreamModelByUserIDCache.Get(1)
+	if len(got) != 2 || got[1].ID != 100 {
+		t.Errorf("livestreamModelByUserIDCache[1] = %v, want the new livestream appended", got)
+	}
+	if _, ok := livestreamModelByIdCache.Get(100); !ok {
+		t.Error("new livestream is not in livestreamModelByIdCache")
+	}
+}
+
+func TestGetRecentEndedLivestreamsCapsLimit(t *testing.T) {
+	f := setupHandlerTest(t)
+	var gotLimit driver.Value
+	f.on("FROM livestreams WHERE end_at <", func(args []driver.Value) fakeResponse {
+		gotLimit = args[1]
+		return fakeResponse{}
+	})
+
+	code, _, err := serveAs(1, getRecentEndedLivestreamsHandler, http.MethodGet, "/api/livestream/recent-ended?limit=100000", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+	if gotLimit != int64(maxRecentEndedLivestreamsLimit) {
+		t.Errorf("LIMIT = %v, want %d", gotLimit, maxRecentEndedLivestreamsLimit)
+	}
+}
+
+func TestGetRecentEndedLivestreamsSkipsLive(t *testing.T) {
+	setupTestDB(t)
+	// 1時間ずつずらした配信を4件作り、3件目の配信中の時刻にする
+	_, livestreams := seedTestLivestreams(t, "recent-ended-test-user", 4)
+	prevNow := nowFunc
+	nowFunc = func() time.Time { return time.Unix(livestreams[2].StartAt+60, 0) }
+	t.Cleanup(func() { nowFunc = prevNow })
+
+	code, body, err := serveAs(1, getRecentEndedLivestreamsHandler, http.MethodGet, "/api/livestream/recent-ended", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+	var got []Livestream
+	if err := json.Unmarshal([]byte(body), &got); err != nil {
+		t.Fatal(err)
+	}
+	// 配信中と未来の配信は含まず、終了時刻の新しい順
+	if len(got) != 2 || got[0].ID != livestreams[1].ID || got[1].ID != livestreams[0].ID {
+		t.Errorf("ended livestreams = %+v, want ids %d, %d", got, livestreams[1].ID, livestreams[0].ID)
+	}
+}
+
+func TestGetLivestreamCountdownUsesNowFunc(t *testing.T) {
+	setupHandlerTest(t)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	livestreamModelByIdCache.Set(1, LivestreamModel{ID: 1, UserID: 1, StartAt: start.Unix(), EndAt: start.Add(time.Hour).Unix()})
+	setNow(t, start.Add(-90*time.Second))
+
+	code, body, err := serveAs(1, getLivestreamCountdownHandler, http.MethodGet, "/", "", "livestream_id", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+	var countdown LivestreamCountdown
+	if err := json.Unmarshal([]byte(body), &countdown); err != nil {
+		t.Fatal(err)
+	}
+	if countdown.SecondsUntilStart != 90 {
+		t.Errorf("seconds_until_start = %d, want 90", countdown.SecondsUntilStart)
+	}
+}
+
+func getRetentionAs(t *testing.T, userID, livestreamID int64, query string) (int, LivestreamRetention) {
+	t.Helper()
+	code, body, err := serveAs(userID, getLivestreamRetentionHandler, http.MethodGet, "/?"+query, "", "livestream_id", strconv.FormatInt(livestreamID, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var retention LivestreamRetention
+	if code == http.StatusOK {
+		if err := json.Unmarshal([]byte(body), &retention); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return code, retention
+}
+
+func TestGetLivestreamRetention(t *testing.T) {
+	f := setupHandlerTest(t)
+	livestreamModelByIdCache.Set(1, LivestreamModel{ID: 1, UserID: 1})
+	livestreamModelByIdCache.Set(2, LivestreamModel{ID: 2, UserID: 1})
+	f.on("FROM livestream_view_durations", func(args []driver.Value) fakeResponse {
+		res := fakeResponse{columns: []string{"duration"}}
+		if args[0] == int64(1) {
+			for _, d := range []int64{30, 60, 299, 300, 1000} {
+				res.rows = append(res.rows, []driver.Value{d})
+			}
+		}
+		return res
+	})
+
+	tests := []struct {
+		name         string
+		livestreamID int64
+		query        string
+		want         LivestreamRetention
+	}{
+		{"default checkpoints", 1, "", LivestreamRetention{TotalViewers: 5, Checkpoints: []RetentionCheckpoint{{60, 0.8}, {300, 0.4}, {900, 0.2}}}},
+		{"custom checkpoints", 1, "checkpoints=0,120", LivestreamRetention{TotalViewers: 5, Checkpoints: []RetentionCheckpoint{{0, 1}, {120, 0.6}}}},
+		{"no viewers", 2, "", LivestreamRetention{Checkpoints: []RetentionCheckpoint{{60, 0}, {300, 0}, {900, 0}}}},
+	}
+	for _, tt := range tests {
+		code, retention := getRetentionAs(t, 1, tt.livestreamID, tt.query)
+		if code != http.StatusOK {
+			t.Errorf("%s: status = %d, want %d", tt.name, code, http.StatusOK)
+			continue
+		}
+		if retention.TotalViewers != tt.want.TotalViewers || !slices.Equal(retention.Checkpoints, tt.want.Checkpoints) {
+			t.Errorf("%s: retention = %+v, want %+v", tt.name, retention, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		name         string
+		userID       int64
+		livestreamID int64
+		query        string
+		wantCode     int
+	}{
+		{"other streamer", 2, 1, "", http.StatusForbidden},
+		{"missing livestream", 1, 999, "", http.StatusNotFound},
+		{"negative checkpoint", 1, 1, "checkpoints=-1", http.StatusBadRequest},
+		{"invalid checkpoint", 1, 1, "checkpoints=60,abc", http.StatusBadRequest},
+	} {
+		if code, _ := getRetentionAs(t, tt.userID, tt.livestreamID, tt.query); code != tt.wantCode {
+			t.Errorf("%s: status = %d, want %d", tt.name, code, tt.wantCode)
+		}
+	}
+}
+
+func getReservationSlotsAs(t *testing.T, userID int64, query string) (int, []ReservationSlotModel) {
+	t.Helper()
+	code, body, err := serveAs(userID, getReservationSlotsHandler, http.MethodGet, "/api/reservation/slots?"+query, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var slots []ReservationSlotModel
+	if code == http.StatusOK {
+		if err := json.Unmarshal([]byte(body), &slots); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return code, slots
+}
+
+func TestGetReservationSlotsValidation(t *testing.T) {
+	f := setupHandlerTest(t)
+	for _, query := range []string{"", "start_at=100", "start_at=abc&end_at=200", "start_at=200&end_at=100"} {
+		if code, _ := getReservationSlotsAs(t, 1, query); code != http.StatusBadRequest {
+			t.Errorf("%q: status = %d, want %d", query, code, http.StatusBadRequest)
+		}
+	}
+	if n := f.count("reservation_slots"); n != 0 {
+		t.Errorf("queried reservation_slots %d times for invalid ranges", n)
+	}
+}
+
+func TestGetReservationSlotsAfterPartialBooking(t *testing.T) {
+	setupTestDB(t)
+	user, _ := seedTestLivestreams(t, "slots-test-user", 0)
+	const base = 1704067200
+	for i := int64(0); i < 4; i++ {
+		slot := ReservationSlotModel{Slot: 2, Capacity: 2, StartAt: base + i*3600, EndAt: base + (i+1)*3600}
+		if _, err := dbConn.NamedExec("INSERT INTO reservation_slots (slot, capacity, start_at, end_at) VALUES (:slot, :capacity, :start_at, :end_at)", slot); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 2枠目と3枠目にまたがる予約を入れる
+	body, _ := json.Marshal(ReserveLivestreamRequest{Tags: []int64{}, Title: "test", StartAt: base + 3600, EndAt: base + 3*3600})
+	if code, err := reserveAs(user.ID, string(body)); err != nil || code != http.StatusCreated {
+		t.Fatalf("reserve: status = %d (err=%v), want %d", code, err, http.StatusCreated)
+	}
+
+	remaining := func(slots []ReservationSlotModel) []int64 {
+		r := make([]int64, len(slots))
+		for i, slot := range slots {
+			r[i] = slot.Slot
+		}
+		return r
+	}
+	for _, tt := range []struct {
+		query string
+		want  []int64
+	}{
+		{"start_at=" + strconv.Itoa(base) + "&end_at=" + strconv.Itoa(base+4*3600), []int64{2, 1, 1, 2}},
+		{"start_at=" + strconv.Itoa(base+3600) + "&end_at=" + strconv.Itoa(base+3*3600), []int64{1, 1}},
+		// 範囲に収まりきらない枠は含めない
+		{"start_at=" + strconv.Itoa(base+1800) + "&end_at=" + strconv.Itoa(base+3*3600), []int64{1, 1}},
+		{"start_at=" + strconv.Itoa(base+10*3600) + "&end_at=" + strconv.Itoa(base+11*3600), []int64{}},
+	} {
+		code, slots := getReservationSlotsAs(t, user.ID, tt.query)
+		if code != http.StatusOK {
+			t.Fatalf("%q: status = %d, want %d", tt.query, code, http.StatusOK)
+		}
+		if got := remaining(slots); !slices.Equal(got, tt.want) {
+			t.Errorf("%q: remaining slots = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func getLivestreamStatusAs(t *testing.T, userID, livestreamID int64) LivestreamStatus {
+	t.Helper()
+	code, body, err := serveAs(userID, getLivestreamStatusHandler, http.MethodGet, "/", "", "livestream_id", strconv.FormatInt(livestreamID, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+	var status LivestreamStatus
+	if err := json.Unmarshal([]byte(body), &status); err != nil {
+		t.Fatal(err)
+	}
+	return status
+}
+
+func TestGetLivestreamStatus(t *testing.T) {
+	startAt := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	endAt := startAt.Add(time.Hour)
+	tests := []struct {
+		name string
+		now  time.Time
+		live bool
+	}{
+		{"before", startAt.Add(-time.Second), false},
+		{"at start", startAt, true},
+		{"during", startAt.Add(30 * time.Minute), true},
+		{"at end", endAt, false},
+		{"after", endAt.Add(time.Hour), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := setupHandlerTest(t)
+			livestreamModelByIdCache.Set(1, LivestreamModel{ID: 1, UserID: 1, StartAt: startAt.Unix(), EndAt: endAt.Unix()})
+			f.value("COUNT(DISTINCT user_id) FROM livestream_viewers_history", "count", int64(3))
+			setNow(t, tt.now)
+
+			status := getLivestreamStatusAs(t, 1, 1)
+			if status.Live != tt.live || status.Viewers != 3 {
+				t.Errorf("status = %+v, want live=%v viewers=3", status, tt.live)
+			}
+		})
+	}
+
+	t.Run("unknown livestream", func(t *testing.T) {
+		setupHandlerTest(t)
+		code, _, err := serveAs(1, getLivestreamStatusHandler, http.MethodGet, "/", "", "livestream_id", "404")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != http.StatusNotFound {
+			t.Errorf("status = %d, want %d", code, http.StatusNotFound)
+		}
+	})
+}
+
+func TestGetLivestreamStatusViewersFollowEnter(t *testing.T) {
+	f := setupHandlerTest(t)
+	livestreamModelByIdCache.Set(1, LivestreamModel{ID: 1, UserID: 1})
+	viewers := int64(1)
+	f.on("COUNT(DISTINCT user_id) FROM livestream_viewers_history", func([]driver.Value) fakeResponse {
+		return fakeResponse{columns: []string{"count"}, rows: [][]driver.Value{{viewers}}}
+	})
+	f.exec("INSERT INTO livestream_viewers_history", 0)
+
+	if got := getLivestreamStatusAs(t, 1, 1).Viewers; got != 1 {
+		t.Fatalf("viewers = %d, want 1", got)
+	}
+	// 2回目はキャッシュから返す
+	getLivestreamStatusAs(t, 1, 1)
+	if n := f.count("COUNT(DISTINCT user_id)"); n != 1 {
+		t.Errorf("viewers counted %d times, want 1", n)
+	}
+
+	viewers = 2
+	if code, _, err := serveAs(2, enterLivestreamHandler, http.MethodPost, "/", "", "livestream_id", "1"); err != nil || code != http.StatusOK {
+		t.Fatalf("enter: status = %d (err=%v), want %d", code, err, http.StatusOK)
+	}
+	if got := getLivestreamStatusAs(t, 1, 1).Viewers; got != 2 {
+		t.Errorf("viewers after enter = %d, want 2", got)
+	}
+}
+
+func TestGetLivestreamServesCachedStreamWithoutDB(t *testing.T) {
+	f := setupHandlerTest(t)
+	fakeLivecommentTarget(f, LivestreamModel{ID: 1, UserID: 1, Title: "cached"}, 1)
+	get := func(livestreamID string) (int, Livestream) {
+		t.Helper()
+		code, body, err := serveAs(1, getLivestreamHandler, http.MethodGet, "/", "", "livestream_id", livestreamID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var livestream Livestream
+		if code == http.StatusOK {
+			if err := json.Unmarshal([]byte(body), &livestream); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return code, livestream
+	}
+
+	// 配信者のテーマなどをキャッシュに載せてから数える
+	if code, _ := get("1"); code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+	before := len(f.queries)
+	code, livestream := get("1")
+	if code != http.StatusOK || livestream.Title != "cached" {
+		t.Fatalf("status = %d, livestream = %+v, want the cached stream", code, livestream)
+	}
+	if n := f.count("FROM livestreams"); n != 0 {
+		t.Errorf("livestreams queried %d times, want 0", n)
+	}
+	if len(f.queries) != before {
+		t.Errorf("queries = %v, want none on the second request", f.queries[before:])
+	}
+}
+
+func TestGetLivestreamBackfillsCacheOnMiss(t *testing.T) {
+	f := setupHandlerTest(t)
+	fakeLivecommentTarget(f, LivestreamModel{ID: 1, UserID: 1}, 1)
+	livestreamModelByIdCache.Delete(1)
+	f.rowsWhere("SELECT * FROM livestreams WHERE id", "id", LivestreamModel{ID: 1, UserID: 1, Title: "from db"})
+
+	// 2回目はキャッシュに載ったものを返す
+	for i := 0; i < 2; i++ {
+		code, _, err := serveAs(1, getLivestreamHandler, http.MethodGet, "/", "", "livestream_id", "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", code, http.StatusOK)
+		}
+	}
+	if n := f.count("SELECT * FROM livestreams WHERE id"); n != 1 {
+		t.Errorf("livestream loaded %d times, want 1", n)
+	}
+	if got, ok := livestreamModelByIdCache.Get(1); !ok || got.Title != "from db" {
+		t.Errorf("cached = %+v (ok=%v), want the row from the DB", got, ok)
+	}
+
+	code, _, err := serveAs(1, getLivestreamHandler, http.MethodGet, "/", "", "livestream_id", "404")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusNotFound {
+		t.Errorf("unknown livestream: status = %d, want %d", code, http.StatusNotFound)
+	}
+}
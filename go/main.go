@@ -4,19 +4,31 @@ package main
 // sqlx的な参考: https://jmoiron.github.io/sqlx/
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
+	"runtime"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/go-json-experiment/json"
 	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 
 	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
 
 	"github.com/gorilla/sessions"
 	"github.com/labstack/echo-contrib/session"
@@ -32,9 +44,28 @@ const (
 var (
 	powerDNSSubdomainAddress string
 	dbConn                   *sqlx.DB
-	secret                   = []byte("isucon13_session_cookiestore_defaultsecret")
+	// 集計・検索などの重い読み取りクエリ用
+	replicaConn *sqlx.DB
+	secret      = []byte("isucon13_session_cookiestore_defaultsecret")
+	// initialize時に全ユーザのアイコンハッシュを計算しておくか
+	precomputeIconHash = false
+	// アイコンハッシュを計算するワーカー数
+	iconHashWorkers = runtime.NumCPU()
+	// ベンチマーク時は無効にしておく
+	enableSecurityHeaders = false
+	// CORSを許可するオリジン (空なら同一オリジンのみ)
+	corsAllowOrigins []string
+	// アイコンアップロードのリクエストボディの上限 (JSONの場合はbase64の分大きくなる)
+	iconUploadBodyLimit = "10M"
+	// init.sh の実行時間の上限
+	initializeTimeout = 40 * time.Second
+	// initialize時に実行するスクリプト
+	initScriptPath = "../sql/init.sh"
 )
 
+// 現在時刻の取得元 (テストで差し替えられるように変数にしておく)
+var nowFunc = time.Now
+
 var (
 	hashCache                    = NewCache[string, [32]byte]()
 	themeCache                   = NewCache[string, Theme]()
@@ -43,6 +74,10 @@ var (
 	userModelByNameCache         = NewCache[string, UserModel]()
 	livestreamModelByIdCache     = NewCache[int64, LivestreamModel]()
 	livestreamModelByUserIDCache = NewCache[int64, []*LivestreamModel]()
+	// 配信ごとの視聴中のユーザ数
+	viewersCountCache = NewCache[int64, int64]()
+	// 配信ごとに付いているタグID
+	livestreamTagsCache = NewCache[int64, []int64]()
 )
 
 func init() {
@@ -50,13 +85,166 @@ func init() {
 	if secretKey, ok := os.LookupEnv("ISUCON13_SESSION_SECRETKEY"); ok {
 		secret = []byte(secretKey)
 	}
+	if v, ok := os.LookupEnv("ISUCON13_ADMIN_USERNAME"); ok {
+		adminUsername = v
+	}
+	if v, ok := os.LookupEnv("ISUCON13_RESERVATION_CONCURRENCY"); ok {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			reservationSemaphore = make(chan struct{}, n)
+		}
+	}
+	if v, ok := os.LookupEnv("ISUCON13_ENABLE_METRICS"); ok {
+		enableMetrics, _ = strconv.ParseBool(v)
+	}
+	if v, ok := os.LookupEnv("ISUCON13_ENABLE_PPROF"); ok {
+		enablePprof, _ = strconv.ParseBool(v)
+	}
+	if v, ok := os.LookupEnv("ISUCON13_ENABLE_CSRF"); ok {
+		enableCSRF, _ = strconv.ParseBool(v)
+	}
+	if v, ok := os.LookupEnv("ISUCON13_ENABLE_ACCESS_LOG"); ok {
+		enableAccessLog, _ = strconv.ParseBool(v)
+	}
+	if v, ok := os.LookupEnv("ISUCON13_ENABLE_SECURITY_HEADERS"); ok {
+		enableSecurityHeaders, _ = strconv.ParseBool(v)
+	}
+	if v, ok := os.LookupEnv("ISUCON13_REDIS_ADDRESS"); ok {
+		redisAddress = v
+	}
+	if v, ok := os.LookupEnv("ISUCON13_SLOW_QUERY_THRESHOLD"); ok {
+		if d, err := time.ParseDuration(v); err == nil {
+			slowQueryThreshold = d
+		}
+	}
+	if v, ok := os.LookupEnv("ISUCON13_PRECOMPUTE_ICON_HASH"); ok {
+		precomputeIconHash, _ = strconv.ParseBool(v)
+	}
+	if v, ok := os.LookupEnv("ISUCON13_ICON_HASH_WORKERS"); ok {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			iconHashWorkers = n
+		}
+	}
+	if v, ok := os.LookupEnv("ISUCON13_RANKING_CACHE_TTL"); ok {
+		if d, err := time.ParseDuration(v); err == nil {
+			rankingCacheTTL = d
+		}
+	}
+	if v, ok := os.LookupEnv("ISUCON13_TAG_CACHE_REFRESH_INTERVAL"); ok {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			tagCacheRefreshInterval = d
+		}
+	}
+	if v, ok := os.LookupEnv("ISUCON13_MAX_COMMENT_LENGTH"); ok {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			maxLivecommentLength = n
+		}
+	}
+	if v, ok := os.LookupEnv("ISUCON13_ICON_UPLOAD_BODY_LIMIT"); ok {
+		iconUploadBodyLimit = v
+	}
+	if v, ok := os.LookupEnv("ISUCON13_MIN_RESERVATION_DURATION"); ok {
+		if d, err := time.ParseDuration(v); err == nil {
+			minReservationDuration = d
+		}
+	}
+	if v, ok := os.LookupEnv("ISUCON13_CORS_ALLOW_ORIGINS"); ok {
+		for _, origin := range strings.Split(v, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				corsAllowOrigins = append(corsAllowOrigins, origin)
+			}
+		}
+	}
+	if v, ok := os.LookupEnv("ISUCON13_QUERY_TIMEOUT"); ok {
+		if d, err := time.ParseDuration(v); err == nil {
+			queryTimeout = d
+		}
+	}
+	if v, ok := os.LookupEnv("ISUCON13_SUBDOMAIN_RETRY_ATTEMPTS"); ok {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			subdomainRetryAttempts = n
+		}
+	}
+	if v, ok := os.LookupEnv("ISUCON13_SUBDOMAIN_RETRY_BACKOFF"); ok {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			subdomainRetryBackoff = d
+		}
+	}
+	if v, ok := os.LookupEnv("ISUCON13_INITIALIZE_TIMEOUT"); ok {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			initializeTimeout = d
+		}
+	}
+}
+
+// init.sh を initializeTimeout を上限に実行する
+// タイムアウトした場合はプロセスを kill し、それまでの出力をエラーに含める
+func runInitScript(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(c.Request().Context(), initializeTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := newInitScriptCommand(ctx, initScriptPath)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		c.Logger().Warnf("init.sh failed with err=%s stdout=%s stderr=%s", err, stdout.String(), stderr.String())
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("failed to initialize: timed out after %s: %s%s", initializeTimeout, stdout.String(), stderr.String()))
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to initialize: "+err.Error()+": "+stderr.String())
+	}
+	return nil
+}
+
+// init.sh が起動した mysql などの子プロセスもまとめて kill できるようにプロセスグループを分ける
+// bash だけを kill すると子プロセスが stdout/stderr のパイプを握ったままになり Run が返らない
+func newInitScriptCommand(ctx context.Context, path string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, path)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	// kill 後もパイプが閉じない場合に待ち続けないようにする
+	cmd.WaitDelay = time.Second
+	return cmd
 }
 
 type InitializeResponse struct {
 	Language string `json:"language"`
 }
 
-func connectDB(logger echo.Logger) (*sqlx.DB, error) {
+type HealthResponse struct {
+	DB                string `json:"db"`
+	CachesInitialized bool   `json:"caches_initialized"`
+	IconHashesWarmed  bool   `json:"icon_hashes_warmed"`
+}
+
+// initializeが最後まで完了してキャッシュが載っているか
+var cachesInitialized atomic.Bool
+
+// 一意制約違反 (ER_DUP_ENTRY) か
+func isDuplicateEntryError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062
+}
+
+// 読み取り専用クエリの接続先。レプリカがなければプライマリを使う
+func readDB() *sqlx.DB {
+	if replicaConn != nil {
+		return replicaConn
+	}
+	return dbConn
+}
+
+// 同名のインデックスが既に存在する (ER_DUP_KEYNAME) か
+func isDuplicateKeyNameError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1061
+}
+
+// 環境変数から接続設定を組み立てる
+// addrが空でなければ ISUCON13_MYSQL_DIALCONFIG_ADDRESS の代わりにその接続先を使う
+func newDBConfig(addr string) (*mysql.Config, error) {
 	const (
 		networkTypeEnvKey = "ISUCON13_MYSQL_DIALCONFIG_NET"
 		addrEnvKey        = "ISUCON13_MYSQL_DIALCONFIG_ADDRESS"
@@ -65,6 +253,7 @@ func connectDB(logger echo.Logger) (*sqlx.DB, error) {
 		passwordEnvKey    = "ISUCON13_MYSQL_DIALCONFIG_PASSWORD"
 		dbNameEnvKey      = "ISUCON13_MYSQL_DIALCONFIG_DATABASE"
 		parseTimeEnvKey   = "ISUCON13_MYSQL_DIALCONFIG_PARSETIME"
+		interpolateEnvKey = "ISUCON13_MYSQL_INTERPOLATE_PARAMS"
 	)
 
 	conf := mysql.NewConfig()
@@ -89,6 +278,12 @@ func connectDB(logger echo.Logger) (*sqlx.DB, error) {
 			conf.Addr = net.JoinHostPort(addr, "3306")
 		}
 	}
+	if addr != "" {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "3306")
+		}
+		conf.Addr = addr
+	}
 	if v, ok := os.LookupEnv(userEnvKey); ok {
 		conf.User = v
 	}
@@ -105,12 +300,41 @@ func connectDB(logger echo.Logger) (*sqlx.DB, error) {
 		}
 		conf.ParseTime = parseTime
 	}
+	// falseにするとサーバサイドのプリペアドステートメントでパラメータを送る
+	if v, ok := os.LookupEnv(interpolateEnvKey); ok {
+		interpolateParams, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", interpolateEnvKey, err)
+		}
+		conf.InterpolateParams = interpolateParams
+	}
+	return conf, nil
+}
 
-	db, err := sqlx.Open("mysql", conf.FormatDSN())
+// 接続してプールを設定し、疎通を確認する
+func connectDB(logger echo.Logger, addr string) (*sqlx.DB, error) {
+	conf, err := newDBConfig(addr)
 	if err != nil {
 		return nil, err
 	}
-	db.SetMaxOpenConns(500)
+
+	var db *sqlx.DB
+	if useDBHook() {
+		connector, err := mysql.NewConnector(conf)
+		if err != nil {
+			return nil, err
+		}
+		db = sqlx.NewDb(sql.OpenDB(instrumentedConnector{connector}), "mysql")
+	} else {
+		db, err = sqlx.Open("mysql", conf.FormatDSN())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := configureDBPool(db); err != nil {
+		return nil, err
+	}
 
 	if err := db.Ping(); err != nil {
 		return nil, err
@@ -119,6 +343,40 @@ func connectDB(logger echo.Logger) (*sqlx.DB, error) {
 	return db, nil
 }
 
+// コネクションプールの設定 (未設定の場合、最大接続数は500でそれ以外はdatabase/sqlのデフォルト)
+func configureDBPool(db *sqlx.DB) error {
+	const (
+		maxOpenEnvKey         = "ISUCON13_MYSQL_MAX_OPEN"
+		maxIdleEnvKey         = "ISUCON13_MYSQL_MAX_IDLE"
+		connMaxLifetimeEnvKey = "ISUCON13_MYSQL_CONN_MAX_LIFETIME"
+	)
+
+	maxOpen := 500
+	if v, ok := os.LookupEnv(maxOpenEnvKey); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as int: %+v", maxOpenEnvKey, err)
+		}
+		maxOpen = n
+	}
+	db.SetMaxOpenConns(maxOpen)
+	if v, ok := os.LookupEnv(maxIdleEnvKey); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as int: %+v", maxIdleEnvKey, err)
+		}
+		db.SetMaxIdleConns(n)
+	}
+	if v, ok := os.LookupEnv(connMaxLifetimeEnvKey); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as duration: %+v", connMaxLifetimeEnvKey, err)
+		}
+		db.SetConnMaxLifetime(d)
+	}
+	return nil
+}
+
 type IndexQuery struct {
 	Table string
 	Name  string
@@ -134,17 +392,61 @@ var IDX_QUERIES = []IndexQuery{
 	{"ng_words", "livestream_viewers_small_idx", []string{"livestream_id"}},
 	{"reservation_slots", "reservation_slots_idx", []string{"start_at", "end_at"}},
 	{"livestreams", "livestreams_idx", []string{"user_id"}},
+	{"livestreams", "livestreams_end_at_idx", []string{"end_at"}},
 	{"livecomment_reports", "livestream_id_idx", []string{"livestream_id"}},
 	{"reactions", "livestream_id_idx", []string{"livestream_id", "created_at"}},
 	{"reactions", "livestream_id_short_idx", []string{"livestream_id"}},
+	{"reactions", "livecomment_id_idx", []string{"livecomment_id"}},
 	{"livecomments", "livestream_id_idx", []string{"livestream_id"}},
 	{"themes", "themes_idx", []string{"user_id"}},
 }
 
+// 同じテーブルに先頭カラムが一致する複合インデックスがあるものは冗長なので除く
+func effectiveIndexQueries() []IndexQuery {
+	isPrefix := func(short, long []string) bool {
+		if len(short) > len(long) {
+			return false
+		}
+		for i := range short {
+			if short[i] != long[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	idxs := make([]IndexQuery, 0, len(IDX_QUERIES))
+	for i, idx := range IDX_QUERIES {
+		redundant := false
+		for j, other := range IDX_QUERIES {
+			if i == j || idx.Table != other.Table || !isPrefix(idx.Cols, other.Cols) {
+				continue
+			}
+			// 全く同じ定義の場合は先に定義された方を残す
+			if len(idx.Cols) < len(other.Cols) || j < i {
+				log.Printf("skip redundant index %s.%s (covered by %s)", idx.Table, idx.Name, other.Name)
+				redundant = true
+				break
+			}
+		}
+		if !redundant {
+			idxs = append(idxs, idx)
+		}
+	}
+	return idxs
+}
+
 func createIndexQueries() []string {
-	qs := make([]string, 0, len(IDX_QUERIES))
-	for _, idx := range IDX_QUERIES {
-		qs = append(qs, fmt.Sprintf("ALTER TABLE `%s` ADD INDEX `%s` (%s)", idx.Table, idx.Name, "`"+idx.Cols[0]+"`"))
+	idxs := effectiveIndexQueries()
+	qs := make([]string, 0, len(idxs))
+	for _, idx := range idxs {
+		cols := make([]string, len(idx.Cols))
+		for i, col := range idx.Cols {
+			// "created_at DESC" のような指定はカラム名だけをクォートする
+			name, order, _ := strings.Cut(col, " ")
+			cols[i] = strings.TrimSpace("`" + name + "` " + order)
+		}
+		qs = append(qs, fmt.Sprintf("ALTER TABLE `%s` ADD INDEX `%s` (%s)", idx.Table, idx.Name, strings.Join(cols, ", ")))
 	}
 	return qs
 }
@@ -157,29 +459,47 @@ func initCaches() {
 	userModelByNameCache.Init()
 	livestreamModelByIdCache.Init()
 	livestreamModelByUserIDCache.Init()
+	viewersCountCache.Init()
+	livestreamTagsCache.Init()
 }
 
 func initializeHandler(c echo.Context) error {
+	cachesInitialized.Store(false)
+	// 前回のアイコンハッシュ計算が初期化後のキャッシュに書き込まないように待つ
+	<-iconHashWarmupDone()
 	resetSubdomains()
 	initCaches()
+	globalRanking.invalidate()
+	globalPopularTags.invalidate()
 	initIconDir()
 
-	if out, err := exec.Command("../sql/init.sh").CombinedOutput(); err != nil {
-		c.Logger().Warnf("init.sh failed with err=%s", string(out))
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to initialize: "+err.Error())
+	if err := runInitScript(c); err != nil {
+		return err
+	}
+	// init.shでテーブルを作り直した場合に備えて、ステートメントは準備し直す
+	closePreparedStmts(dbConn)
+
+	// 既に存在するインデックス以外の失敗は握りつぶさずに返す
+	var failedQueries []string
+	for _, result := range runCreateIndexQueries() {
+		switch {
+		case result.AlreadyExists:
+			c.Logger().Infof("[KNOWN] ALREADY EXISTS: %s", result.Query)
+		case result.Error != "":
+			c.Logger().Warnf("failed to create index: query=%s err=%s", result.Query, result.Error)
+			failedQueries = append(failedQueries, result.Query+": "+result.Error)
+		}
+	}
+	if len(failedQueries) > 0 {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to create indexes: "+strings.Join(failedQueries, "; "))
 	}
 
-	wg := sync.WaitGroup{}
-	for _, qs := range createIndexQueries() {
-		wg.Add(1)
-		go func(qs string) {
-			defer wg.Done()
-			if _, err := dbConn.Exec(qs); err != nil {
-				c.Logger().Infof("[KNOWN] ALREADY EXISTS: %s", qs)
-			}
-		}(qs)
+	if err := seedTotalTip(c.Request().Context()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total tip: "+err.Error())
+	}
+	if err := seedEmojiTally(c.Request().Context()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count emoji reactions: "+err.Error())
 	}
-	wg.Wait()
 
 	var tags []TagModel
 	if err := dbConn.Select(&tags, "SELECT * FROM tags"); err != nil {
@@ -193,10 +513,41 @@ func initializeHandler(c echo.Context) error {
 	if err := dbConn.Select(&users, "SELECT * FROM users"); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get users: "+err.Error())
 	}
+	userSubdomains := make([]string, 0, len(users))
 	for _, user := range users {
 		userModelByIdCache.Set(user.ID, user)
 		userModelByNameCache.Set(user.Name, user)
+		userSubdomains = append(userSubdomains, userSubdomain(user.Name))
+	}
+	// 初期データのユーザーのサブドメインをまとめて登録する
+	addSubdomains(userSubdomains...)
+
+	var livestreams []*LivestreamModel
+	if err := dbConn.Select(&livestreams, "SELECT * FROM livestreams"); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+	livestreamsByUserID := make(map[int64][]*LivestreamModel)
+	for _, livestream := range livestreams {
+		livestreamModelByIdCache.Set(livestream.ID, *livestream)
+		livestreamsByUserID[livestream.UserID] = append(livestreamsByUserID[livestream.UserID], livestream)
+	}
+	for userID, livestreams := range livestreamsByUserID {
+		livestreamModelByUserIDCache.Set(userID, livestreams)
+	}
+
+	var livestreamTagModels []LivestreamTagModel
+	if err := dbConn.Select(&livestreamTagModels, "SELECT * FROM livestream_tags ORDER BY id"); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream tags: "+err.Error())
+	}
+	// タグのない配信も空のスライスで載せておく
+	tagIDsByLivestreamID := make(map[int64][]int64, len(livestreams))
+	for _, livestream := range livestreams {
+		tagIDsByLivestreamID[livestream.ID] = []int64{}
 	}
+	for _, livestreamTagModel := range livestreamTagModels {
+		tagIDsByLivestreamID[livestreamTagModel.LivestreamID] = append(tagIDsByLivestreamID[livestreamTagModel.LivestreamID], livestreamTagModel.TagID)
+	}
+	livestreamTagsCache.Replace(tagIDsByLivestreamID)
 
 	type IconModel struct {
 		ID     int64  `db:"id"`
@@ -208,7 +559,7 @@ func initializeHandler(c echo.Context) error {
 	if err := dbConn.Select(&icons, "SELECT * FROM icons"); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get icons: "+err.Error())
 	}
-	wg = sync.WaitGroup{}
+	wg := sync.WaitGroup{}
 	for _, icon := range icons {
 		wg.Add(1)
 		go func(icon IconModel) {
@@ -216,21 +567,91 @@ func initializeHandler(c echo.Context) error {
 			if err := saveIcon(icon.UserID, icon.Image); err != nil {
 				c.Logger().Warnf("failed to save icon: %s", err.Error())
 			}
-		}(IconModel{
-			ID:     icon.ID,
-			UserID: icon.UserID,
-		})
+		}(icon)
 	}
 
 	wg.Wait()
 
+	// レスポンスを遅らせないように裏で計算する
+	if precomputeIconHash {
+		startIconHashWarmup(users, iconHashWorkers)
+	}
+
+	cachesInitialized.Store(true)
+
 	c.Request().Header.Add("Content-Type", "application/json;charset=utf-8")
 	return c.JSON(http.StatusOK, InitializeResponse{
 		Language: "golang",
 	})
 }
 
+// GET /healthz
+func healthzHandler(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(c.Request().Context(), 1*time.Second)
+	defer cancel()
+
+	res := HealthResponse{
+		DB:                "ok",
+		CachesInitialized: cachesInitialized.Load(),
+	}
+	select {
+	case <-iconHashWarmupDone():
+		res.IconHashesWarmed = true
+	default:
+	}
+	if err := dbConn.PingContext(ctx); err != nil {
+		c.Logger().Warnf("failed to ping db: %s", err.Error())
+		res.DB = "unreachable"
+		return c.JSON(http.StatusServiceUnavailable, res)
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+type CreateIndexResult struct {
+	Query string `json:"query"`
+	// 同名のインデックスが既にあった (1061 ER_DUP_KEYNAME)
+	AlreadyExists bool `json:"already_exists,omitempty,omitzero"`
+	// 既に存在する場合以外で失敗した場合のみエラーメッセージが入る
+	Error string `json:"error,omitempty"`
+}
+
+// インデックスを並行に作成し、クエリごとの結果を返す
+func runCreateIndexQueries() []CreateIndexResult {
+	queries := createIndexQueries()
+	results := make([]CreateIndexResult, len(queries))
+	wg := sync.WaitGroup{}
+	for i, qs := range queries {
+		wg.Add(1)
+		go func(i int, qs string) {
+			defer wg.Done()
+			results[i].Query = qs
+			if _, err := dbConn.Exec(qs); err != nil {
+				if isDuplicateKeyNameError(err) {
+					results[i].AlreadyExists = true
+				} else {
+					results[i].Error = err.Error()
+				}
+			}
+		}(i, qs)
+	}
+	wg.Wait()
+	return results
+}
+
+// 初期化せずにインデックスだけを作成する
+// POST /api/admin/create-index
+func createIndexHandler(c echo.Context) error {
+	if err := verifyAdminSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	return c.JSON(http.StatusOK, runCreateIndexQueries())
+}
+
 func dropIndexHandler(c echo.Context) error {
+	// 冗長として作らなくなったインデックスが以前の初期化で残っていても消せるように、除外前の一覧を使う
 	for _, idx := range IDX_QUERIES {
 		if _, err := dbConn.Exec(fmt.Sprintf("ALTER TABLE `%s` DROP INDEX `%s`", idx.Table, idx.Name)); err != nil {
 			c.Logger().Warnf("failed to drop index: %s", err.Error())
@@ -241,43 +662,113 @@ func dropIndexHandler(c echo.Context) error {
 }
 
 func main() {
+	// DNSサーバを起動する前にPowerDNS関連の設定を確認する
+	subdomainAddr, err := validatePowerDNSEnv()
+	if err != nil {
+		log.Fatalf("invalid PowerDNS configuration: %v", err)
+	}
+
 	go startDNS()
 	initCaches()
 
 	e := echo.New()
 	e.Debug = false
 	e.Logger.SetLevel(echolog.ERROR)
+	e.JSONSerializer = jsonSerializer{}
 	cookieStore := sessions.NewCookieStore(secret)
 	cookieStore.Options.Domain = "*.u.isucon.dev"
 	e.Use(session.Middleware(cookieStore))
+	if enableAccessLog {
+		e.Use(accessLogMiddleware())
+	}
+	if len(corsAllowOrigins) > 0 {
+		e.Use(corsMiddleware())
+	}
+	if enableCSRF {
+		e.Use(csrfMiddleware())
+		e.GET("/api/csrf", getCSRFTokenHandler)
+	}
+	if enableSecurityHeaders {
+		// アイコンはContent-Typeを明示して返しているのでnosniffでも表示できる
+		e.Use(middleware.SecureWithConfig(middleware.SecureConfig{
+			ContentTypeNosniff: "nosniff",
+			XFrameOptions:      "DENY",
+			ReferrerPolicy:     "strict-origin-when-cross-origin",
+		}))
+	}
+	if enableMetrics {
+		registerCacheMetrics()
+		e.Use(metricsMiddleware())
+		e.GET("/metrics", metricsHandler())
+	}
+	if enablePprof {
+		registerPprof(e)
+	}
+	if tracingEnabled() {
+		shutdown, err := initTracing(context.Background())
+		if err != nil {
+			e.Logger.Errorf("failed to init tracing: %v", err)
+			os.Exit(1)
+		}
+		defer shutdown(context.Background())
+		e.Use(tracingMiddleware())
+	}
+	if queryTimeout > 0 {
+		e.Use(queryTimeoutMiddleware())
+	}
+	// ネストしたfillでlivestream_tagsを何度も引かないようにリクエスト単位でまとめる
+	e.Use(livestreamTagsLoaderMiddleware())
+
+	e.GET("/healthz", healthzHandler)
 
 	// 初期化
 	e.POST("/api/initialize", initializeHandler)
 	e.POST("/api/drop-index", dropIndexHandler)
+	e.POST("/api/admin/create-index", createIndexHandler)
+
+	// admin
+	e.GET("/api/admin/ngwords/top", getTopNGWordsHandler)
+	e.GET("/api/admin/reservation/utilization", getReservationUtilizationHandler)
+	e.DELETE("/api/admin/subdomain/:username", deleteSubdomainHandler)
+	e.GET("/api/admin/stats", getPlatformStatisticsHandler)
 
 	// top
 	e.GET("/api/tag", getTagHandler)
+	e.GET("/api/tag/popular", getPopularTagsHandler)
+	e.POST("/api/tag", postTagHandler)
+	e.GET("/api/tag/:tag_id/stats", getTagStatisticsHandler)
 	e.GET("/api/user/:username/theme", getStreamerThemeHandler)
 
 	// livestream
 	// reserve livestream
 	e.POST("/api/livestream/reservation", reserveLivestreamHandler)
+	e.GET("/api/reservation/slots", getReservationSlotsHandler)
 	// list livestream
 	e.GET("/api/livestream/search", searchLivestreamsHandler)
+	e.GET("/api/livestream/search/ids", searchLivestreamIDsHandler)
+	e.GET("/api/livestream/recent-ended", getRecentEndedLivestreamsHandler)
 	e.GET("/api/livestream", getMyLivestreamsHandler)
 	e.GET("/api/user/:username/livestream", getUserLivestreamsHandler)
 	// get livestream
 	e.GET("/api/livestream/:livestream_id", getLivestreamHandler)
+	e.GET("/api/livestream/:livestream_id/countdown", getLivestreamCountdownHandler)
+	e.GET("/api/livestream/:livestream_id/status", getLivestreamStatusHandler)
 	// get polling livecomment timeline
 	e.GET("/api/livestream/:livestream_id/livecomment", getLivecommentsHandler)
 	// ライブコメント投稿
 	e.POST("/api/livestream/:livestream_id/livecomment", postLivecommentHandler)
+	e.GET("/api/livestream/:livestream_id/livecomment/bounds", getLivecommentBoundsHandler)
+	e.GET("/api/livestream/:livestream_id/livecomment/export", exportLivecommentsHandler)
 	e.POST("/api/livestream/:livestream_id/reaction", postReactionHandler)
 	e.GET("/api/livestream/:livestream_id/reaction", getReactionsHandler)
+	e.GET("/api/livestream/:livestream_id/livecomment/:livecomment_id/reaction", getLivecommentReactionsHandler)
 
 	// (配信者向け)ライブコメントの報告一覧取得API
 	e.GET("/api/livestream/:livestream_id/report", getLivecommentReportsHandler)
+	e.POST("/api/livestream/:livestream_id/report/:report_id/resolve", resolveLivecommentReportHandler)
 	e.GET("/api/livestream/:livestream_id/ngwords", getNgwords)
+	e.DELETE("/api/livestream/:livestream_id/ngwords", deleteNgwordsHandler)
+	e.DELETE("/api/livestream/:livestream_id/ngwords/:word_id", deleteNgwordHandler)
 	// ライブコメント報告
 	e.POST("/api/livestream/:livestream_id/livecomment/:livecomment_id/report", reportLivecommentHandler)
 	// 配信者によるモデレーション (NGワード登録)
@@ -288,20 +779,35 @@ func main() {
 	e.POST("/api/livestream/:livestream_id/enter", enterLivestreamHandler)
 	// ユーザ視聴終了 (viewer)
 	e.DELETE("/api/livestream/:livestream_id/exit", exitLivestreamHandler)
+	// (配信者向け)視聴維持率
+	e.GET("/api/livestream/:livestream_id/retention", getLivestreamRetentionHandler)
+	// (配信者向け)チップを多く送ったユーザ
+	e.GET("/api/livestream/:livestream_id/tippers", getLivestreamTippersHandler)
+	// (配信者向け)同時視聴者数の推移
+	e.GET("/api/livestream/:livestream_id/viewers/timeline", getLivestreamViewersTimelineHandler)
 
 	// user
 	e.POST("/api/register", registerHandler)
 	e.POST("/api/login", loginHandler)
 	e.GET("/api/user/me", getMeHandler)
+	e.GET("/api/user/me/revenue", getMyRevenueHandler)
+	e.GET("/api/user/me/statistics", getMyStatisticsHandler)
+	e.GET("/api/session", getSessionHandler)
 	// フロントエンドで、配信予約のコラボレーターを指定する際に必要
 	e.GET("/api/user/:username", getUserHandler)
 	e.GET("/api/user/:username/statistics", getUserStatisticsHandler)
+	e.GET("/api/user/:username/available", getUsernameAvailabilityHandler)
 	e.GET("/api/user/:username/icon", getIconHandler)
-	e.POST("/api/icon", postIconHandler)
+	e.POST("/api/icon", postIconHandler, middleware.BodyLimit(iconUploadBodyLimit))
+	e.POST("/api/users/icon-hashes", postIconHashesHandler)
+	e.POST("/api/users/batch", postUsersBatchHandler)
 
 	// stats
 	// ライブ配信統計情報
 	e.GET("/api/livestream/:livestream_id/statistics", getLivestreamStatisticsHandler)
+	// ランキング
+	e.GET("/api/ranking/users", getUserRankingHandler)
+	e.GET("/api/ranking/livestreams", getLivestreamRankingHandler)
 
 	// 課金情報
 	e.GET("/api/payment", GetPaymentResult)
@@ -309,35 +815,125 @@ func main() {
 	e.HTTPErrorHandler = errorResponseHandler
 
 	// DB接続
-	conn, err := connectDB(e.Logger)
+	conn, err := connectDB(e.Logger, "")
 	if err != nil {
 		e.Logger.Errorf("failed to connect db: %v", err)
 		os.Exit(1)
 	}
 	defer conn.Close()
+	defer closePreparedStmts(conn)
 	dbConn = conn
 
-	subdomainAddr, ok := os.LookupEnv(powerDNSSubdomainAddressEnvKey)
-	if !ok {
-		e.Logger.Errorf("environ %s must be provided", powerDNSSubdomainAddressEnvKey)
-		os.Exit(1)
+	// 読み取り専用のレプリカ (設定されていなければ readDB() はプライマリを返す)
+	if addr, ok := os.LookupEnv("ISUCON13_MYSQL_REPLICA_ADDRESS"); ok && addr != "" {
+		replica, err := connectDB(e.Logger, addr)
+		if err != nil {
+			e.Logger.Errorf("failed to connect replica db: %v", err)
+			os.Exit(1)
+		}
+		defer replica.Close()
+		replicaConn = replica
 	}
+
+	if redisAddress != "" {
+		if err := startCacheInvalidation(context.Background()); err != nil {
+			e.Logger.Errorf("failed to start cache invalidation: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	// initializeを経ずに再起動した場合でもチップ合計が0から始まらないようにする
+	if err := seedTotalTip(context.Background()); err != nil {
+		e.Logger.Errorf("failed to count total tip: %v", err)
+	}
+
 	powerDNSSubdomainAddress = subdomainAddr
 
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if tagCacheRefreshInterval > 0 {
+		go refreshTagCachePeriodically(ctx, tagCacheRefreshInterval)
+	}
+
 	// HTTPサーバ起動
 	listenAddr := net.JoinHostPort("0.0.0.0", strconv.Itoa(listenPort))
-	if err := e.Start(listenAddr); err != nil {
-		e.Logger.Errorf("failed to start HTTP server: %v", err)
-		os.Exit(1)
+	go func() {
+		if err := e.Start(listenAddr); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			e.Logger.Errorf("failed to start HTTP server: %v", err)
+			os.Exit(1)
+		}
+	}()
+
+	// シグナルを受けたら処理中のリクエストを待ってから終了する
+	<-ctx.Done()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := e.Shutdown(shutdownCtx); err != nil {
+		e.Logger.Errorf("failed to shutdown HTTP server: %v", err)
 	}
+	stopDNS()
 }
 
+// streamJSONArrayでFlushする間隔(要素数)
+const streamJSONFlushInterval = 100
+
 type ErrorResponse struct {
 	Error string `json:"error"`
 }
 
+// リクエストボディをJSONとして読み込む。失敗した場合は400を返す
+func decodeJSON(c echo.Context, v any) error {
+	defer c.Request().Body.Close()
+	if err := json.UnmarshalRead(c.Request().Body, v); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	return nil
+}
+
+// 大きな配列を一度にマーシャルせず、要素ごとに書き出してレスポンスを返す
+// ヘッダを送った後はエラーレスポンスを返せないので、途中で失敗した場合はログに残して打ち切る
+func streamJSONArray[T any](c echo.Context, code int, items []T) error {
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	res.WriteHeader(code)
+
+	if err := writeJSONArray(res, items); err != nil {
+		c.Logger().Errorf("failed to stream json array: %s", err.Error())
+	}
+	return nil
+}
+
+func writeJSONArray[T any](res *echo.Response, items []T) error {
+	if _, err := res.Write([]byte("[")); err != nil {
+		return err
+	}
+	for i := range items {
+		if i > 0 {
+			if _, err := res.Write([]byte(",")); err != nil {
+				return err
+			}
+		}
+		if err := json.MarshalWrite(res, &items[i], jsonMarshalOptions); err != nil {
+			return err
+		}
+		if (i+1)%streamJSONFlushInterval == 0 {
+			res.Flush()
+		}
+	}
+	if _, err := res.Write([]byte("]")); err != nil {
+		return err
+	}
+	res.Flush()
+	return nil
+}
+
 func errorResponseHandler(err error, c echo.Context) {
 	c.Logger().Errorf("error at %s: %+v", c.Path(), err)
+	// 既にレスポンスを書き始めている場合は、エラーのJSONを後ろに足さない
+	if c.Response().Committed {
+		return
+	}
 	if he, ok := err.(*echo.HTTPError); ok {
 		if e := c.JSON(he.Code, &ErrorResponse{Error: err.Error()}); e != nil {
 			c.Logger().Errorf("%+v", e)
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-json-experiment/json"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+func TestInitScriptCommandTimeout(t *testing.T) {
+	// bash から起動した子プロセスがパイプを握ったまま止まっている状況を再現する
+	script := filepath.Join(t.TempDir(), "init.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/bash\necho started\nsleep 30\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	cmd := newInitScriptCommand(ctx, script)
+	start := time.Now()
+	err := cmd.Run()
+	elapsed := time.Since(start)
+
+	if err == nil {
+		t.Fatal("Run() returned nil, want an error after the timeout")
+	}
+	if elapsed > 5*time.Second {
+		t.Fatalf("Run() took %s, want it to return shortly after the timeout", elapsed)
+	}
+}
+
+type failingItem struct {
+	fail bool
+}
+
+func (f failingItem) MarshalJSON() ([]byte, error) {
+	if f.fail {
+		return nil, errors.New("marshal failed")
+	}
+	return []byte(`"ok"`), nil
+}
+
+func newStreamTestContext() (echo.Context, *httptest.ResponseRecorder) {
+	e := echo.New()
+	e.JSONSerializer = jsonSerializer{}
+	e.HTTPErrorHandler = errorResponseHandler
+	rec := httptest.NewRecorder()
+	return e.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec), rec
+}
+
+func TestStreamJSONArrayMatchesJSON(t *testing.T) {
+	tags := make([]Tag, 250)
+	for i := range tags {
+		tags[i] = Tag{ID: int64(i), Name: "<tag>"}
+	}
+
+	c, rec := newStreamTestContext()
+	if err := streamJSONArray(c, http.StatusOK, tags); err != nil {
+		t.Fatal(err)
+	}
+	wantCtx, want := newStreamTestContext()
+	if err := wantCtx.JSON(http.StatusOK, tags); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec.Body.String() != want.Body.String() {
+		t.Errorf("got  %s\nwant %s", rec.Body.String(), want.Body.String())
+	}
+}
+
+func TestStreamJSONArrayMidStreamError(t *testing.T) {
+	c, rec := newStreamTestContext()
+	err := streamJSONArray(c, http.StatusOK, []failingItem{{}, {fail: true}})
+	if err != nil {
+		c.Echo().HTTPErrorHandler(err, c)
+	}
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	// ヘッダを送った後にエラーのJSONが後ろに足されていないこと
+	if got, want := rec.Body.String(), `["ok",`; got != want {
+		t.Errorf("body = %q, want %q", got, want)
+	}
+}
+
+func TestErrorResponseHandlerSkipsCommittedResponse(t *testing.T) {
+	c, rec := newStreamTestContext()
+	c.Response().WriteHeader(http.StatusOK)
+	c.Response().Write([]byte("partial"))
+
+	errorResponseHandler(echo.NewHTTPError(http.StatusInternalServerError, "boom"), c)
+
+	if got := rec.Body.String(); got != "partial" {
+		t.Errorf("body = %q, want %q", got, "partial")
+	}
+}
+
+func benchmarkTags(n int) []Tag {
+	tags := make([]Tag, n)
+	for i := range tags {
+		tags[i] = Tag{ID: int64(i), Name: "tag"}
+	}
+	return tags
+}
+
+func BenchmarkStreamJSONArray10k(b *testing.B) {
+	tags := benchmarkTags(10000)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c, _ := newStreamTestContext()
+		if err := streamJSONArray(c, http.StatusOK, tags); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkJSON10k(b *testing.B) {
+	tags := benchmarkTags(10000)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c, _ := newStreamTestContext()
+		if err := c.JSON(http.StatusOK, tags); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestEffectiveIndexQueriesHasNoRedundantIndex(t *testing.T) {
+	idxs := effectiveIndexQueries()
+	for i, idx := range idxs {
+		for j, other := range idxs {
+			if i == j || idx.Table != other.Table || len(idx.Cols) > len(other.Cols) {
+				continue
+			}
+			if slices.Equal(idx.Cols, other.Cols[:len(idx.Cols)]) {
+				t.Errorf("%s.%s %v is covered by %s %v", idx.Table, idx.Name, idx.Cols, other.Name, other.Cols)
+			}
+		}
+	}
+	// 冗長なものを除いた分だけ減っている
+	if len(idxs) >= len(IDX_QUERIES) {
+		t.Errorf("len(effectiveIndexQueries()) = %d, want fewer than %d", len(idxs), len(IDX_QUERIES))
+	}
+}
+
+func TestDropIndexDropsEveryDefinedIndex(t *testing.T) {
+	f := useFakeDB(t)
+	f.exec("DROP INDEX", 0)
+
+	c, rec := newStreamTestContext()
+	if err := dropIndexHandler(c); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	for _, idx := range IDX_QUERIES {
+		if n := f.count("ALTER TABLE `" + idx.Table + "` DROP INDEX `" + idx.Name + "`"); n != 1 {
+			t.Errorf("dropped %s.%s %d times, want 1", idx.Table, idx.Name, n)
+		}
+	}
+}
+
+// init.shの代わりに何もしないスクリプトを使い、initializeHandlerが読む初期データをフェイクDBに登録する
+func fakeInitialize(t *testing.T, f *fakeDB, users []any, livestreams []any, icons []any) {
+	t.Helper()
+	script := filepath.Join(t.TempDir(), "init.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\nexit 0\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	prev := initScriptPath
+	initScriptPath = script
+	t.Cleanup(func() {
+		initScriptPath = prev
+		resetSubdomains()
+	})
+
+	f.exec("ALTER TABLE", 0)
+	f.value("SUM(tip)", "total", int64(0))
+	f.rows("GROUP BY l.user_id, r.emoji_name")
+	f.rows("SELECT * FROM tags")
+	f.rows("SELECT * FROM users", users...)
+	f.rows("SELECT * FROM livestreams", livestreams...)
+	f.rows("SELECT * FROM livestream_tags ORDER BY id")
+	f.rows("SELECT * FROM icons", icons...)
+}
+
+type fakeIconRow struct {
+	ID     int64  `db:"id"`
+	UserID int64  `db:"user_id"`
+	Image  []byte `db:"image"`
+}
+
+func serveInitialize(t *testing.T) int {
+	t.Helper()
+	code, _, err := serveWithSession(nil, initializeHandler, http.MethodPost, "/api/initialize", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestInitializePrecomputesIconHashes(t *testing.T) {
+	f := setupHandlerTest(t)
+	prev := precomputeIconHash
+	precomputeIconHash = true
+	t.Cleanup(func() { precomputeIconHash = prev })
+
+	image := []byte("icon-of-user-1")
+	fakeInitialize(t, f,
+		[]any{UserModel{ID: 1, Name: "with-icon"}, UserModel{ID: 2, Name: "without-icon"}},
+		nil,
+		[]any{fakeIconRow{ID: 1, UserID: 1, Image: image}})
+
+	if code := serveInitialize(t); code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+	<-iconHashWarmupDone()
+
+	want := map[string][32]byte{
+		"with-icon":    sha256.Sum256(image),
+		"without-icon": fallbackImageHash,
+	}
+	for name, hash := range want {
+		if got, ok := hashCache.Get(name); !ok || got != hash {
+			t.Errorf("hashCache[%q] = (%x, %v), want %x", name, got, ok, hash)
+		}
+	}
+}
+
+func TestInitializeSkipsIconHashesWhenDisabled(t *testing.T) {
+	f := setupHandlerTest(t)
+	prev := precomputeIconHash
+	precomputeIconHash = false
+	t.Cleanup(func() { precomputeIconHash = prev })
+
+	fakeInitialize(t, f, []any{UserModel{ID: 1, Name: "with-icon"}}, nil, nil)
+	if code := serveInitialize(t); code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+	<-iconHashWarmupDone()
+
+	if n := hashCache.Len(); n != 0 {
+		t.Errorf("hashCache has %d entries, want 0", n)
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	setupHandlerTest(t)
+
+	code, body, err := serveWithSession(nil, healthzHandler, http.MethodGet, "/healthz", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", code, http.StatusOK, body)
+	}
+
+	// DBとの接続が切れたら503を返す
+	dbConn.Close()
+	code, body, err = serveWithSession(nil, healthzHandler, http.MethodGet, "/healthz", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	var res HealthResponse
+	if err := json.Unmarshal([]byte(body), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.DB != "unreachable" {
+		t.Errorf("db = %q, want unreachable", res.DB)
+	}
+}
+
+func TestInitializeWarmsLivestreamCaches(t *testing.T) {
+	f := setupHandlerTest(t)
+	fakeInitialize(t, f,
+		[]any{UserModel{ID: 1, Name: "streamer"}, UserModel{ID: 2, Name: "viewer"}},
+		[]any{LivestreamModel{ID: 10, UserID: 1, Title: "first"}, LivestreamModel{ID: 11, UserID: 1, Title: "second"}},
+		nil)
+
+	if code := serveInitialize(t); code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+
+	if n := livestreamModelByIdCache.Len(); n != 2 {
+		t.Errorf("livestreamModelByIdCache has %d entries, want 2", n)
+	}
+	if got, ok := livestreamModelByIdCache.Get(11); !ok || got.Title != "second" {
+		t.Errorf("livestreamModelByIdCache[11] = (%+v, %v), want second", got, ok)
+	}
+	if got, ok := livestreamModelByUserIDCache.Get(1); !ok || len(got) != 2 {
+		t.Errorf("livestreamModelByUserIDCache[1] = (%d livestreams, %v), want 2", len(got), ok)
+	}
+	// タグのない配信も取得済みとして載っている
+	if got, ok := livestreamTagsCache.Get(10); !ok || len(got) != 0 {
+		t.Errorf("livestreamTagsCache[10] = (%v, %v), want an empty slice", got, ok)
+	}
+}
+
+func TestInitializeReportsIndexErrors(t *testing.T) {
+	queries := createIndexQueries()
+	tests := []struct {
+		name     string
+		errNum   uint16
+		wantCode int
+	}{
+		// 既にある場合は初期化を続ける
+		{"already exists", 1061, http.StatusOK},
+		// 定義が間違っている場合は握りつぶさない
+		{"key column doesn't exist", 1072, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := setupHandlerTest(t)
+			fakeInitialize(t, f, nil, nil, nil)
+			f.on(queries[0], func([]driver.Value) fakeResponse {
+				return fakeResponse{err: &mysql.MySQLError{Number: tt.errNum, Message: tt.name}}
+			})
+
+			code, body, err := serveWithSession(nil, initializeHandler, http.MethodPost, "/api/initialize", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", code, tt.wantCode)
+			}
+			if tt.wantCode != http.StatusOK && !strings.Contains(body, queries[0]) {
+				t.Errorf("message = %q, want failed query %q", body, queries[0])
+			}
+		})
+	}
+}
+
+func TestConfigureDBPool(t *testing.T) {
+	// 1回クエリを投げたあとのプールの状態を返す
+	statsAfterQuery := func(t *testing.T, env map[string]string) (sql.DBStats, error) {
+		t.Helper()
+		for k, v := range env {
+			t.Setenv(k, v)
+		}
+		f := &fakeDB{}
+		f.exec("DO 1", 0)
+		db := sqlx.NewDb(sql.OpenDB(f), "mysql")
+		t.Cleanup(func() { db.Close() })
+		if err := configureDBPool(db); err != nil {
+			return sql.DBStats{}, err
+		}
+		if _, err := db.Exec("DO 1"); err != nil {
+			t.Fatal(err)
+		}
+		return db.Stats(), nil
+	}
+
+	t.Run("defaults", func(t *testing.T) {
+		stats, err := statsAfterQuery(t, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.MaxOpenConnections != 500 || stats.Idle != 1 {
+			t.Errorf("max open = %d, idle = %d, want 500, 1", stats.MaxOpenConnections, stats.Idle)
+		}
+	})
+	t.Run("from env", func(t *testing.T) {
+		stats, err := statsAfterQuery(t, map[string]string{
+			"ISUCON13_MYSQL_MAX_OPEN":          "7",
+			"ISUCON13_MYSQL_MAX_IDLE":          "-1",
+			"ISUCON13_MYSQL_CONN_MAX_LIFETIME": "1m",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// MAX_IDLEが負ならアイドルの接続を残さない
+		if stats.MaxOpenConnections != 7 || stats.Idle != 0 || stats.MaxIdleClosed != 1 {
+			t.Errorf("max open = %d, idle = %d, idle closed = %d, want 7, 0, 1", stats.MaxOpenConnections, stats.Idle, stats.MaxIdleClosed)
+		}
+	})
+	t.Run("conn max lifetime", func(t *testing.T) {
+		stats, err := statsAfterQuery(t, map[string]string{"ISUCON13_MYSQL_CONN_MAX_LIFETIME": "1ns"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 返却時点で寿命が切れているので使い回されない
+		if stats.Idle != 0 || stats.MaxLifetimeClosed != 1 {
+			t.Errorf("idle = %d, lifetime closed = %d, want 0, 1", stats.Idle, stats.MaxLifetimeClosed)
+		}
+	})
+	for _, key := range []string{"ISUCON13_MYSQL_MAX_OPEN", "ISUCON13_MYSQL_MAX_IDLE", "ISUCON13_MYSQL_CONN_MAX_LIFETIME"} {
+		t.Run("invalid "+key, func(t *testing.T) {
+			if _, err := statsAfterQuery(t, map[string]string{key: "many"}); err == nil || !strings.Contains(err.Error(), key) {
+				t.Errorf("err = %v, want an error naming %s", err, key)
+			}
+		})
+	}
+}
+
+func TestNewDBConfigInterpolateParams(t *testing.T) {
+	tests := []struct {
+		value   string
+		set     bool
+		want    bool
+		wantErr bool
+	}{
+		// 未設定ならクライアント側で埋め込む
+		{"", false, true, false},
+		{"true", true, true, false},
+		{"false", true, false, false},
+		{"0", true, false, false},
+		{"sometimes", true, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			// t.Setenvで元の値に戻るようにしてから消す
+			t.Setenv("ISUCON13_MYSQL_INTERPOLATE_PARAMS", tt.value)
+			if !tt.set {
+				os.Unsetenv("ISUCON13_MYSQL_INTERPOLATE_PARAMS")
+			}
+			conf, err := newDBConfig("")
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "ISUCON13_MYSQL_INTERPOLATE_PARAMS") {
+					t.Errorf("err = %v, want a parse error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if conf.InterpolateParams != tt.want {
+				t.Errorf("InterpolateParams = %v, want %v", conf.InterpolateParams, tt.want)
+			}
+			// DSNにも反映される
+			if got := strings.Contains(conf.FormatDSN(), "interpolateParams=true"); got != tt.want {
+				t.Errorf("DSN = %s", conf.FormatDSN())
+			}
+		})
+	}
+}
+
+func TestMutatingHandlersRejectMalformedJSON(t *testing.T) {
+	tests := []struct {
+		name   string
+		h      echo.HandlerFunc
+		params []string
+	}{
+		{"register", registerHandler, nil},
+		{"login", loginHandler, nil},
+		{"icon", postIconHandler, nil},
+		{"icon hashes", postIconHashesHandler, nil},
+		{"users batch", postUsersBatchHandler, nil},
+		{"tag", postTagHandler, nil},
+		{"reservation", reserveLivestreamHandler, nil},
+		{"livecomment", postLivecommentHandler, []string{"livestream_id", "1"}},
+		{"reaction", postReactionHandler, []string{"livestream_id", "1"}},
+		{"moderate", moderateHandler, []string{"livestream_id", "1"}},
+	}
+	// タグの作成は管理者のみなので、管理者としてログインしておく
+	prev := adminUsername
+	adminUsername = "test-admin"
+	t.Cleanup(func() { adminUsername = prev })
+	sessionValues := map[any]any{defaultUserIDKey: int64(1), defaultUsernameKey: adminUsername}
+
+	for _, tt := range tests {
+		for _, body := range []string{"", "{", "not json", "[]", `{"tags": [1,]}`} {
+			t.Run(tt.name+"/"+body, func(t *testing.T) {
+				f := setupHandlerTest(t)
+				// 自分の配信として扱われるようにしておく
+				livestreamModelByIdCache.Set(1, LivestreamModel{ID: 1, UserID: 1})
+				code, msg, err := serveWithSession(sessionValues, tt.h, http.MethodPost, "/", body, tt.params...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if code != http.StatusBadRequest {
+					t.Errorf("status = %d (%s), want %d", code, msg, http.StatusBadRequest)
+				}
+				// ボディを読めなければDBには触らない
+				if q := f.lastQuery(); q != "" {
+					t.Errorf("query = %s, want no query", q)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// ベンチマーク時は無効にできるように環境変数で切り替える
+var enableMetrics = false
+
+var (
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "isupipe_http_requests_total",
+		Help: "Number of HTTP requests by route and status.",
+	}, []string{"method", "path", "status"})
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "isupipe_http_request_duration_seconds",
+		Help:    "HTTP request latencies by route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "path"})
+	dbQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "isupipe_db_query_duration_seconds",
+		Help:    "DB query latencies by statement type.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"statement"})
+)
+
+type cacheStats interface {
+	Len() int
+	HitsMisses() (int64, int64)
+}
+
+func registerCacheMetrics() {
+	caches := map[string]cacheStats{
+		"hash":                 hashCache,
+		"theme":                themeCache,
+		"tag_model":            tagModelCache,
+		"user_model_by_id":     userModelByIdCache,
+		"user_model_by_name":   userModelByNameCache,
+		"livestream_by_id":     livestreamModelByIdCache,
+		"livestreams_by_owner": livestreamModelByUserIDCache,
+		"livestream_tags":      livestreamTagsCache,
+		"viewers_count":        viewersCountCache,
+	}
+	for name, c := range caches {
+		c := c
+		labels := prometheus.Labels{"cache": name}
+		promauto.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "isupipe_cache_entries",
+			Help:        "Number of entries in the cache.",
+			ConstLabels: labels,
+		}, func() float64 { return float64(c.Len()) })
+		promauto.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "isupipe_cache_hits_total",
+			Help:        "Number of cache hits.",
+			ConstLabels: labels,
+		}, func() float64 { hits, _ := c.HitsMisses(); return float64(hits) })
+		promauto.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "isupipe_cache_misses_total",
+			Help:        "Number of cache misses.",
+			ConstLabels: labels,
+		}, func() float64 { _, misses := c.HitsMisses(); return float64(misses) })
+	}
+}
+
+func metricsMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			err := next(c)
+			if err != nil {
+				c.Error(err)
+			}
+			path := c.Path()
+			status := strconv.Itoa(c.Response().Status)
+			httpRequestsTotal.WithLabelValues(c.Request().Method, path, status).Inc()
+			httpRequestDuration.WithLabelValues(c.Request().Method, path).Observe(time.Since(start).Seconds())
+			return nil
+		}
+	}
+}
+
+func metricsHandler() echo.HandlerFunc {
+	return echo.WrapHandler(promhttp.Handler())
+}
+
+func observeDBQuery(query string, elapsed time.Duration) {
+	statement := "other"
+	if fields := strings.Fields(query); len(fields) > 0 {
+		switch s := strings.ToLower(fields[0]); s {
+		case "select", "insert", "update", "delete":
+			statement = s
+		}
+	}
+	dbQueryDuration.WithLabelValues(statement).Observe(elapsed.Seconds())
+}
@@ -1,24 +1,33 @@
 package main
 
 import (
+	"context"
 	"net/http"
+	"sync/atomic"
 
 	"github.com/labstack/echo/v4"
 )
 
+// 全ライブコメントのチップ合計
+// 起動時とinitialize時にDBから読み込み、以降はライブコメントの投稿・非表示化に合わせて増減させる
+// 加算されるのは自分が受けた投稿の分だけなので、アプリケーションサーバが1台の構成を前提にしている
+var totalTipCounter atomic.Int64
+
 type PaymentResult struct {
 	TotalTip int64 `json:"total_tip"`
 }
 
-func GetPaymentResult(c echo.Context) error {
-	ctx := c.Request().Context()
-
+func seedTotalTip(ctx context.Context) error {
 	var totalTip int64
-	if err := dbConn.GetContext(ctx, &totalTip, "SELECT IFNULL(SUM(tip), 0) FROM livecomments"); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total tip: "+err.Error())
+	if err := dbConn.GetContext(ctx, &totalTip, "SELECT IFNULL(SUM(tip), 0) FROM livecomments WHERE hidden = FALSE"); err != nil {
+		return err
 	}
+	totalTipCounter.Store(totalTip)
+	return nil
+}
 
+func GetPaymentResult(c echo.Context) error {
 	return c.JSON(http.StatusOK, &PaymentResult{
-		TotalTip: totalTip,
+		TotalTip: totalTipCounter.Load(),
 	})
 }
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/labstack/echo/v4"
+)
+
+// チューニング時だけ有効にする
+var enablePprof = false
+
+func registerPprof(e *echo.Echo) {
+	g := e.Group("/debug/pprof")
+	g.GET("/cmdline", echo.WrapHandler(http.HandlerFunc(pprof.Cmdline)))
+	g.GET("/profile", echo.WrapHandler(http.HandlerFunc(pprof.Profile)))
+	g.GET("/symbol", echo.WrapHandler(http.HandlerFunc(pprof.Symbol)))
+	g.POST("/symbol", echo.WrapHandler(http.HandlerFunc(pprof.Symbol)))
+	g.GET("/trace", echo.WrapHandler(http.HandlerFunc(pprof.Trace)))
+	// heap, goroutine などはIndexがパスから判断して返す
+	g.GET("/*", echo.WrapHandler(http.HandlerFunc(pprof.Index)))
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// DBクエリを含むハンドラの処理時間の上限 (0なら無効)
+// ハンドラはc.Request().Context()でクエリを投げているので、リクエストのコンテキストに期限を付ければ全クエリに効く
+var queryTimeout time.Duration = 0
+
+func queryTimeoutMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			// initializeはinit.shの実行を含むので別の上限 (initializeTimeout) に任せる
+			if c.Path() == "/api/initialize" {
+				return next(c)
+			}
+
+			ctx, cancel := context.WithTimeout(c.Request().Context(), queryTimeout)
+			defer cancel()
+			c.SetRequest(c.Request().WithContext(ctx))
+
+			err := next(c)
+			// 期限切れで失敗した場合はDBの応答待ちとみなして504にする
+			if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return echo.NewHTTPError(http.StatusGatewayTimeout, "query timed out: "+err.Error())
+			}
+			return err
+		}
+	}
+}
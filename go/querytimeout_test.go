@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestQueryTimeoutMiddleware(t *testing.T) {
+	prev := queryTimeout
+	queryTimeout = 20 * time.Millisecond
+	t.Cleanup(func() { queryTimeout = prev })
+
+	tests := []struct {
+		name     string
+		delay    time.Duration
+		wantCode int
+	}{
+		{"fast query", 0, http.StatusOK},
+		{"slow query", time.Second, http.StatusGatewayTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := setupHandlerTest(t)
+			f.delay = tt.delay
+			f.value("SELECT COUNT(*) FROM users", "count", int64(1))
+
+			e := echo.New()
+			e.Use(queryTimeoutMiddleware())
+			e.GET("/api/count", func(c echo.Context) error {
+				var count int64
+				if err := dbConn.GetContext(c.Request().Context(), &count, "SELECT COUNT(*) FROM users"); err != nil {
+					return echo.NewHTTPError(http.StatusInternalServerError, "failed to count users: "+err.Error())
+				}
+				return c.NoContent(http.StatusOK)
+			})
+
+			start := time.Now()
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/count", nil))
+			if rec.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantCode)
+			}
+			// 遅いクエリを最後まで待たずに返す
+			if elapsed := time.Since(start); elapsed >= tt.delay && tt.delay > 0 {
+				t.Errorf("took %s, want less than the query delay %s", elapsed, tt.delay)
+			}
+		})
+	}
+}
@@ -2,36 +2,100 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"net/http"
 	"strconv"
-	"time"
-
-	"github.com/go-json-experiment/json"
+	"sync"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 )
 
+// 配信者ごとに、自分の配信に付いた絵文字の数を数えておく
+// お気に入り絵文字をGROUP BYせずにメモリ上で求めるため
+type emojiTally struct {
+	mu     sync.RWMutex
+	counts map[int64]map[string]int64
+}
+
+var globalEmojiTally = &emojiTally{counts: map[int64]map[string]int64{}}
+
+func (t *emojiTally) add(streamerID int64, emojiName string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	counts, ok := t.counts[streamerID]
+	if !ok {
+		counts = map[string]int64{}
+		t.counts[streamerID] = counts
+	}
+	counts[emojiName]++
+}
+
+// 最も多い絵文字を返す。同数ならSQLの ORDER BY COUNT(*) DESC, emoji_name DESC に合わせて名前の大きい方
+func (t *emojiTally) favorite(streamerID int64) string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var (
+		favorite string
+		maxCount int64
+	)
+	for emojiName, count := range t.counts[streamerID] {
+		if count > maxCount || (count == maxCount && emojiName > favorite) {
+			favorite = emojiName
+			maxCount = count
+		}
+	}
+	return favorite
+}
+
+func seedEmojiTally(ctx context.Context) error {
+	var rows []struct {
+		UserID    int64  `db:"user_id"`
+		EmojiName string `db:"emoji_name"`
+		Count     int64  `db:"count"`
+	}
+	if err := dbConn.SelectContext(ctx, &rows, "SELECT l.user_id, r.emoji_name, COUNT(*) AS count FROM reactions r INNER JOIN livestreams l ON l.id = r.livestream_id GROUP BY l.user_id, r.emoji_name"); err != nil {
+		return err
+	}
+
+	counts := make(map[int64]map[string]int64)
+	for _, row := range rows {
+		if _, ok := counts[row.UserID]; !ok {
+			counts[row.UserID] = map[string]int64{}
+		}
+		counts[row.UserID][row.EmojiName] = row.Count
+	}
+
+	globalEmojiTally.mu.Lock()
+	globalEmojiTally.counts = counts
+	globalEmojiTally.mu.Unlock()
+	return nil
+}
+
 type ReactionModel struct {
-	ID           int64  `db:"id"`
-	EmojiName    string `db:"emoji_name"`
-	UserID       int64  `db:"user_id"`
-	LivestreamID int64  `db:"livestream_id"`
-	CreatedAt    int64  `db:"created_at"`
+	ID            int64         `db:"id"`
+	EmojiName     string        `db:"emoji_name"`
+	UserID        int64         `db:"user_id"`
+	LivestreamID  int64         `db:"livestream_id"`
+	LivecommentID sql.NullInt64 `db:"livecomment_id"`
+	CreatedAt     int64         `db:"created_at"`
 }
 
 type Reaction struct {
-	ID         int64      `json:"id"`
-	EmojiName  string     `json:"emoji_name"`
-	User       User       `json:"user"`
-	Livestream Livestream `json:"livestream"`
-	CreatedAt  int64      `json:"created_at"`
+	ID            int64      `json:"id"`
+	EmojiName     string     `json:"emoji_name"`
+	User          User       `json:"user"`
+	Livestream    Livestream `json:"livestream"`
+	LivecommentID *int64     `json:"livecomment_id,omitempty"`
+	CreatedAt     int64      `json:"created_at"`
 }
 
 type PostReactionRequest struct {
 	EmojiName string `json:"emoji_name"`
+	// 指定された場合はライブコメントに対するリアクションになる
+	LivecommentID *int64 `json:"livecomment_id"`
 }
 
 func getReactionsHandler(c echo.Context) error {
@@ -47,17 +111,55 @@ func getReactionsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 
-	query := "SELECT * FROM reactions WHERE livestream_id = ? ORDER BY created_at DESC"
+	// (livestream_id, created_at)のインデックスは逆順にも走査できるので昇順・降順どちらでも使える
+	order := "DESC"
+	switch c.QueryParam("order") {
+	case "", "desc":
+	case "asc":
+		order = "ASC"
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "order query parameter must be asc or desc")
+	}
+
+	query := "SELECT * FROM reactions WHERE livestream_id = ?"
+	args := []interface{}{livestreamID}
+	// since, until (unix秒) で期間を絞り込む。どちらも境界を含む
+	var since, until int64
+	if c.QueryParam("since") != "" {
+		since, err = strconv.ParseInt(c.QueryParam("since"), 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "since query parameter must be integer")
+		}
+		query += " AND created_at >= ?"
+		args = append(args, since)
+	}
+	if c.QueryParam("until") != "" {
+		until, err = strconv.ParseInt(c.QueryParam("until"), 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "until query parameter must be integer")
+		}
+		query += " AND created_at <= ?"
+		args = append(args, until)
+	}
+	if c.QueryParam("since") != "" && c.QueryParam("until") != "" && since > until {
+		return echo.NewHTTPError(http.StatusBadRequest, "since must be less than or equal to until")
+	}
+	query += " ORDER BY created_at " + order
 	if c.QueryParam("limit") != "" {
 		limit, err := strconv.Atoi(c.QueryParam("limit"))
 		if err != nil {
 			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
 		}
-		query += fmt.Sprintf(" LIMIT %d", limit)
+		query += " LIMIT ?"
+		args = append(args, limit)
 	}
 
+	stmt, err := preparedStmt(ctx, dbConn, query)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to prepare query: "+err.Error())
+	}
 	reactionModels := []ReactionModel{}
-	if err := dbConn.SelectContext(ctx, &reactionModels, query, livestreamID); err != nil {
+	if err := stmt.SelectContext(ctx, &reactionModels, args...); err != nil {
 		return echo.NewHTTPError(http.StatusNotFound, "failed to get reactions")
 	}
 
@@ -66,39 +168,84 @@ func getReactionsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reaction: "+err.Error())
 	}
 
-	return c.JSON(http.StatusOK, reactions)
+	return streamJSONArray(c, http.StatusOK, reactions)
 }
 
-func postReactionHandler(c echo.Context) error {
+// ライブコメントに対するリアクション一覧
+// GET /api/livestream/:livestream_id/livecomment/:livecomment_id/reaction
+func getLivecommentReactionsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 
+	livecommentID, err := strconv.Atoi(c.Param("livecomment_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livecomment_id in path must be integer")
+	}
+
+	if err := assertBelongsToStream(ctx, "livecomments", int64(livecommentID), int64(livestreamID)); err != nil {
+		return err
+	}
+
+	reactionModels := []ReactionModel{}
+	if err := dbConn.SelectContext(ctx, &reactionModels, "SELECT * FROM reactions WHERE livestream_id = ? AND livecomment_id = ? ORDER BY created_at DESC", livestreamID, livecommentID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reactions: "+err.Error())
+	}
+
+	reactions, err := fillReactionResponseBulk(ctx, dbConn, reactionModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reaction: "+err.Error())
+	}
+
+	return streamJSONArray(c, http.StatusOK, reactions)
+}
+
+func postReactionHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
 	if err := verifyUserSession(c); err != nil {
 		// echo.NewHTTPErrorが返っているのでそのまま出力
 		return err
 	}
 
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
 	// error already checked
 	sess, _ := session.Get(defaultSessionIDKey, c)
 	// existence already checked
 	userID := sess.Values[defaultUserIDKey].(int64)
 
-	var req *PostReactionRequest
-	if err := json.UnmarshalRead(c.Request().Body, &req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	var req PostReactionRequest
+	if err := decodeJSON(c, &req); err != nil {
+		return err
 	}
 
 	reactionModel := ReactionModel{
 		UserID:       int64(userID),
 		LivestreamID: int64(livestreamID),
 		EmojiName:    req.EmojiName,
-		CreatedAt:    time.Now().Unix(),
+		CreatedAt:    nowFunc().Unix(),
+	}
+
+	if req.LivecommentID != nil {
+		if err := assertBelongsToStream(ctx, "livecomments", *req.LivecommentID, int64(livestreamID)); err != nil {
+			return err
+		}
+		reactionModel.LivecommentID = sql.NullInt64{Int64: *req.LivecommentID, Valid: true}
 	}
 
-	result, err := dbConn.NamedExecContext(ctx, "INSERT INTO reactions (user_id, livestream_id, emoji_name, created_at) VALUES (:user_id, :livestream_id, :emoji_name, :created_at)", reactionModel)
+	result, err := dbConn.NamedExecContext(ctx, "INSERT INTO reactions (user_id, livestream_id, livecomment_id, emoji_name, created_at) VALUES (:user_id, :livestream_id, :livecomment_id, :emoji_name, :created_at)", reactionModel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reaction: "+err.Error())
 	}
@@ -109,6 +256,10 @@ func postReactionHandler(c echo.Context) error {
 	}
 	reactionModel.ID = reactionID
 
+	if livestreamModel, ok := livestreamModelByIdCache.Get(reactionModel.LivestreamID); ok {
+		globalEmojiTally.add(livestreamModel.UserID, reactionModel.EmojiName)
+	}
+
 	reaction, err := fillReactionResponse(ctx, dbConn, reactionModel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reaction: "+err.Error())
@@ -118,9 +269,9 @@ func postReactionHandler(c echo.Context) error {
 }
 
 func fillReactionResponse(ctx context.Context, db *sqlx.DB, reactionModel ReactionModel) (Reaction, error) {
-	userModel, ok := userModelByIdCache.Get(reactionModel.UserID)
-	if !ok {
-		return Reaction{}, fmt.Errorf("failed to get user model by id: %d", reactionModel.UserID)
+	userModel, err := getUserModelByID(ctx, reactionModel.UserID)
+	if err != nil {
+		return Reaction{}, err
 	}
 	user, err := fillUserResponse(ctx, db, userModel)
 	if err != nil {
@@ -143,6 +294,9 @@ func fillReactionResponse(ctx context.Context, db *sqlx.DB, reactionModel Reacti
 		Livestream: livestream,
 		CreatedAt:  reactionModel.CreatedAt,
 	}
+	if reactionModel.LivecommentID.Valid {
+		reaction.LivecommentID = &reactionModel.LivecommentID.Int64
+	}
 
 	return reaction, nil
 }
@@ -154,9 +308,9 @@ func fillReactionResponseBulk(ctx context.Context, db *sqlx.DB, reactionModels [
 	var userModels []UserModel
 	livestreamIDs := make([]int64, len(reactionModels))
 	for i := range reactionModels {
-		userModel, ok := userModelByIdCache.Get(reactionModels[i].UserID)
-		if !ok {
-			return nil, fmt.Errorf("failed to get user model by id: %d", reactionModels[i].UserID)
+		userModel, err := getUserModelByID(ctx, reactionModels[i].UserID)
+		if err != nil {
+			return nil, err
 		}
 		userModels = append(userModels, userModel)
 		livestreamIDs[i] = reactionModels[i].LivestreamID
@@ -200,6 +354,9 @@ func fillReactionResponseBulk(ctx context.Context, db *sqlx.DB, reactionModels [
 			Livestream: livestreamsMap[reactionModels[i].LivestreamID],
 			CreatedAt:  reactionModels[i].CreatedAt,
 		}
+		if reactionModels[i].LivecommentID.Valid {
+			reaction.LivecommentID = &reactionModels[i].LivecommentID.Int64
+		}
 		reactions[i] = reaction
 	}
 
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/go-json-experiment/json"
+)
+
+func TestEmojiTallyFavorite(t *testing.T) {
+	tally := &emojiTally{counts: map[int64]map[string]int64{}}
+	if got := tally.favorite(1); got != "" {
+		t.Errorf("favorite without reactions = %q, want empty", got)
+	}
+
+	tally.add(1, "smile")
+	tally.add(1, "smile")
+	tally.add(1, "heart")
+	if got := tally.favorite(1); got != "smile" {
+		t.Errorf("favorite = %q, want %q", got, "smile")
+	}
+
+	// 他の配信者の分は混ざらない
+	tally.add(2, "heart")
+	tally.add(2, "heart")
+	tally.add(2, "heart")
+	if got := tally.favorite(1); got != "smile" {
+		t.Errorf("favorite after other streamer's reactions = %q, want %q", got, "smile")
+	}
+}
+
+func TestEmojiTallyFavoriteTieBreaksByNameDesc(t *testing.T) {
+	// ORDER BY COUNT(*) DESC, emoji_name DESC と同じく、同数なら名前の大きい方
+	for i := 0; i < 100; i++ {
+		tally := &emojiTally{counts: map[int64]map[string]int64{}}
+		for _, name := range []string{"apple", "zebra", "mango"} {
+			tally.add(1, name)
+			tally.add(1, name)
+		}
+		tally.add(1, "banana")
+		if got := tally.favorite(1); got != "zebra" {
+			t.Fatalf("favorite = %q, want %q", got, "zebra")
+		}
+	}
+}
+
+type fakeEmojiCountRow struct {
+	UserID    int64  `db:"user_id"`
+	EmojiName string `db:"emoji_name"`
+	Count     int64  `db:"count"`
+}
+
+func TestSeedEmojiTallyMatchesOrderBy(t *testing.T) {
+	f := setupHandlerTest(t)
+	// reactionsはutf8mb4_binなので、emoji_name DESCはバイト列の比較になる
+	rows := []fakeEmojiCountRow{
+		// 大文字小文字を区別しない照合順序ならZebraが選ばれる
+		{1, "Zebra", 2}, {1, "apple", 2}, {1, "mango", 1},
+		// マルチバイトの名前はASCIIより後ろに並ぶ
+		{2, "zzz", 3}, {2, "ä", 3},
+		{3, "tada", 5}, {3, "smile", 4},
+	}
+	models := make([]any, len(rows))
+	for i, row := range rows {
+		models[i] = row
+	}
+	f.rows("GROUP BY l.user_id, r.emoji_name", models...)
+	if err := seedEmojiTally(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// ORDER BY COUNT(*) DESC, emoji_name DESC LIMIT 1 と同じ順で並べた先頭
+	orderBy := func(userID int64) string {
+		var candidates []fakeEmojiCountRow
+		for _, row := range rows {
+			if row.UserID == userID {
+				candidates = append(candidates, row)
+			}
+		}
+		slices.SortFunc(candidates, func(a, b fakeEmojiCountRow) int {
+			if a.Count != b.Count {
+				return cmp.Compare(b.Count, a.Count)
+			}
+			return bytes.Compare([]byte(b.EmojiName), []byte(a.EmojiName))
+		})
+		return candidates[0].EmojiName
+	}
+	for userID, want := range map[int64]string{1: "apple", 2: "ä", 3: "tada"} {
+		if got := orderBy(userID); got != want {
+			t.Fatalf("user %d: ORDER BY = %q, want %q", userID, got, want)
+		}
+		if got := globalEmojiTally.favorite(userID); got != want {
+			t.Errorf("user %d: favorite = %q, want %q", userID, got, want)
+		}
+	}
+}
+
+func TestGetReactionsLimit(t *testing.T) {
+	setupTestDB(t)
+
+	user, livestreams := seedTestLivestreams(t, "reactions-test-user", 1)
+	livestreamID := livestreams[0].ID
+	for i := 0; i < 3; i++ {
+		seedTestReaction(t, ReactionModel{UserID: user.ID, LivestreamID: livestreamID, EmojiName: "smile", CreatedAt: int64(i)})
+	}
+
+	code, body, err := serveAs(user.ID, getReactionsHandler, http.MethodGet, "/?limit=2", "", "livestream_id", strconv.FormatInt(livestreamID, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+	var reactions []Reaction
+	if err := json.Unmarshal([]byte(body), &reactions); err != nil {
+		t.Fatal(err)
+	}
+	if len(reactions) != 2 {
+		t.Errorf("len(reactions) = %d, want 2", len(reactions))
+	}
+}
+
+func TestGetReactionsLimitIsBound(t *testing.T) {
+	f := setupHandlerTest(t)
+	var gotArgs []driver.Value
+	f.on("SELECT * FROM reactions WHERE livestream_id", func(args []driver.Value) fakeResponse {
+		gotArgs = args
+		return fakeResponse{}
+	})
+
+	code, _ := getReactionsAs(t, 1, 1, "since=10&limit=2")
+	if code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+	if q := f.lastQuery(); !strings.HasSuffix(q, "LIMIT ?") {
+		t.Errorf("query = %s, want a bound LIMIT", q)
+	}
+	if want := []driver.Value{int64(1), int64(10), int64(2)}; !slices.Equal(gotArgs, want) {
+		t.Errorf("args = %v, want %v", gotArgs, want)
+	}
+}
+
+func getReactionsAs(t *testing.T, userID, livestreamID int64, query string) (int, []Reaction) {
+	t.Helper()
+	code, body, err := serveAs(userID, getReactionsHandler, http.MethodGet, "/?"+query, "", "livestream_id", strconv.FormatInt(livestreamID, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reactions []Reaction
+	if code == http.StatusOK {
+		if err := json.Unmarshal([]byte(body), &reactions); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return code, reactions
+}
+
+func TestPostReactionToLivecomment(t *testing.T) {
+	f := setupHandlerTest(t)
+	fakeLivecommentTarget(f, LivestreamModel{ID: 1, UserID: 1}, 1)
+	// ライブコメント1は配信1、ライブコメント2は配信2へのもの
+	f.on("SELECT livestream_id FROM livecomments WHERE id", func(args []driver.Value) fakeResponse {
+		res := fakeResponse{columns: []string{"livestream_id"}}
+		if id := args[0].(int64); id == 1 || id == 2 {
+			res.rows = [][]driver.Value{{id}}
+		}
+		return res
+	})
+	f.exec("INSERT INTO reactions", 5)
+
+	tests := []struct {
+		name          string
+		body          string
+		wantCode      int
+		wantCommentID int64
+	}{
+		{"livestream", `{"emoji_name":"smile"}`, http.StatusCreated, 0},
+		{"livecomment", `{"emoji_name":"smile","livecomment_id":1}`, http.StatusCreated, 1},
+		{"livecomment of another livestream", `{"emoji_name":"smile","livecomment_id":2}`, http.StatusBadRequest, 0},
+		{"missing livecomment", `{"emoji_name":"smile","livecomment_id":99}`, http.StatusNotFound, 0},
+	}
+	for _, tt := range tests {
+		code, body, err := serveAs(1, postReactionHandler, http.MethodPost, "/", tt.body, "livestream_id", "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.wantCode {
+			t.Errorf("%s: status = %d, want %d", tt.name, code, tt.wantCode)
+			continue
+		}
+		if code != http.StatusCreated {
+			continue
+		}
+		var reaction Reaction
+		if err := json.Unmarshal([]byte(body), &reaction); err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case tt.wantCommentID == 0 && reaction.LivecommentID != nil:
+			t.Errorf("%s: livecomment_id = %d, want none", tt.name, *reaction.LivecommentID)
+		case tt.wantCommentID != 0 && (reaction.LivecommentID == nil || *reaction.LivecommentID != tt.wantCommentID):
+			t.Errorf("%s: livecomment_id = %v, want %d", tt.name, reaction.LivecommentID, tt.wantCommentID)
+		}
+	}
+	if n := f.count("INSERT INTO reactions"); n != 2 {
+		t.Errorf("inserted %d reactions, want 2", n)
+	}
+}
+
+func TestGetLivecommentReactions(t *testing.T) {
+	setupTestDB(t)
+	user, livestreams := seedTestLivestreams(t, "livecomment-reactions-test-user", 2)
+	livecomment := seedTestLivecomment(t, LivecommentModel{UserID: user.ID, LivestreamID: livestreams[0].ID, Comment: "react to me"})
+	other := seedTestLivecomment(t, LivecommentModel{UserID: user.ID, LivestreamID: livestreams[0].ID, Comment: "other"})
+	otherStream := seedTestLivecomment(t, LivecommentModel{UserID: user.ID, LivestreamID: livestreams[1].ID, Comment: "other stream"})
+
+	threaded := seedTestReaction(t, ReactionModel{UserID: user.ID, LivestreamID: livestreams[0].ID, LivecommentID: sql.NullInt64{Int64: livecomment.ID, Valid: true}, EmojiName: "smile"})
+	seedTestReaction(t, ReactionModel{UserID: user.ID, LivestreamID: livestreams[0].ID, LivecommentID: sql.NullInt64{Int64: other.ID, Valid: true}, EmojiName: "smile"})
+	seedTestReaction(t, ReactionModel{UserID: user.ID, LivestreamID: livestreams[0].ID, EmojiName: "smile"})
+
+	get := func(livestreamID, livecommentID int64) (int, []Reaction) {
+		t.Helper()
+		code, body, err := serveAs(user.ID, getLivecommentReactionsHandler, http.MethodGet, "/", "",
+			"livestream_id", strconv.FormatInt(livestreamID, 10),
+			"livecomment_id", strconv.FormatInt(livecommentID, 10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var reactions []Reaction
+		if code == http.StatusOK {
+			if err := json.Unmarshal([]byte(body), &reactions); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return code, reactions
+	}
+
+	code, reactions := get(livestreams[0].ID, livecomment.ID)
+	if code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+	if len(reactions) != 1 || reactions[0].ID != threaded.ID {
+		t.Errorf("reactions = %+v, want only %d", reactions, threaded.ID)
+	}
+	if code, _ := get(livestreams[0].ID, otherStream.ID); code != http.StatusBadRequest {
+		t.Errorf("livecomment of another livestream: status = %d, want %d", code, http.StatusBadRequest)
+	}
+	if code, _ := get(livestreams[0].ID, otherStream.ID+1000); code != http.StatusNotFound {
+		t.Errorf("missing livecomment: status = %d, want %d", code, http.StatusNotFound)
+	}
+
+	// 配信全体のリアクション一覧にはコメントへのリアクションも含まれる
+	if _, all := getReactionsAs(t, user.ID, livestreams[0].ID, ""); len(all) != 3 {
+		t.Errorf("len(livestream reactions) = %d, want 3", len(all))
+	}
+}
+
+// 指定した時刻のリアクションを作り、作ったIDを返す
+func seedTestReactionsAt(t *testing.T, user UserModel, livestreamID int64, createdAts ...int64) []int64 {
+	t.Helper()
+	ids := make([]int64, len(createdAts))
+	for i, createdAt := range createdAts {
+		ids[i] = seedTestReaction(t, ReactionModel{UserID: user.ID, LivestreamID: livestreamID, EmojiName: "smile", CreatedAt: createdAt}).ID
+	}
+	return ids
+}
+
+func reactionIDs(reactions []Reaction) []int64 {
+	ids := make([]int64, len(reactions))
+	for i, reaction := range reactions {
+		ids[i] = reaction.ID
+	}
+	return ids
+}
+
+func TestGetReactionsOrderQuery(t *testing.T) {
+	f := setupHandlerTest(t)
+	f.rows("SELECT * FROM reactions WHERE livestream_id")
+
+	tests := []struct {
+		query     string
+		wantCode  int
+		wantOrder string
+	}{
+		{"", http.StatusOK, "ORDER BY created_at DESC"},
+		{"order=desc", http.StatusOK, "ORDER BY created_at DESC"},
+		{"order=asc", http.StatusOK, "ORDER BY created_at ASC"},
+		{"order=random", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		code, _ := getReactionsAs(t, 1, 1, tt.query)
+		if code != tt.wantCode {
+			t.Errorf("%q: status = %d, want %d", tt.query, code, tt.wantCode)
+			continue
+		}
+		if code == http.StatusOK && !strings.HasSuffix(f.lastQuery(), tt.wantOrder) {
+			t.Errorf("%q: query = %s, want %s", tt.query, f.lastQuery(), tt.wantOrder)
+		}
+	}
+}
+
+func TestGetReactionsOrder(t *testing.T) {
+	setupTestDB(t)
+	user, livestreams := seedTestLivestreams(t, "reactions-order-test-user", 1)
+	ids := seedTestReactionsAt(t, user, livestreams[0].ID, 100, 300, 200)
+	oldestFirst := []int64{ids[0], ids[2], ids[1]}
+	newestFirst := []int64{ids[1], ids[2], ids[0]}
+
+	for _, tt := range []struct {
+		query string
+		want  []int64
+	}{
+		{"", newestFirst},
+		{"order=desc", newestFirst},
+		{"order=asc", oldestFirst},
+		{"order=asc&limit=2", oldestFirst[:2]},
+	} {
+		code, reactions := getReactionsAs(t, user.ID, livestreams[0].ID, tt.query)
+		if code != http.StatusOK {
+			t.Fatalf("%q: status = %d, want %d", tt.query, code, http.StatusOK)
+		}
+		if got := reactionIDs(reactions); !slices.Equal(got, tt.want) {
+			t.Errorf("%q: reactions = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestGetReactionsTimeWindowQuery(t *testing.T) {
+	f := setupHandlerTest(t)
+	var gotArgs []driver.Value
+	f.on("SELECT * FROM reactions WHERE livestream_id", func(args []driver.Value) fakeResponse {
+		gotArgs = args
+		return fakeResponse{}
+	})
+
+	tests := []struct {
+		query    string
+		wantCode int
+		wantArgs []driver.Value
+	}{
+		{"since=100&until=200", http.StatusOK, []driver.Value{int64(1), int64(100), int64(200)}},
+		{"since=100&until=100", http.StatusOK, []driver.Value{int64(1), int64(100), int64(100)}},
+		{"since=100", http.StatusOK, []driver.Value{int64(1), int64(100)}},
+		{"until=200&limit=5", http.StatusOK, []driver.Value{int64(1), int64(200), int64(5)}},
+		{"since=200&until=100", http.StatusBadRequest, nil},
+		{"since=abc", http.StatusBadRequest, nil},
+		{"until=1.5", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		gotArgs = nil
+		code, _ := getReactionsAs(t, 1, 1, tt.query)
+		if code != tt.wantCode {
+			t.Errorf("%q: status = %d, want %d", tt.query, code, tt.wantCode)
+			continue
+		}
+		if !slices.Equal(gotArgs, tt.wantArgs) {
+			t.Errorf("%q: args = %v, want %v", tt.query, gotArgs, tt.wantArgs)
+		}
+	}
+}
+
+func TestGetReactionsTimeWindow(t *testing.T) {
+	setupTestDB(t)
+	user, livestreams := seedTestLivestreams(t, "reactions-window-test-user", 1)
+	ids := seedTestReactionsAt(t, user, livestreams[0].ID, 100, 200, 300, 400)
+
+	for _, tt := range []struct {
+		query string
+		want  []int64
+	}{
+		// 境界の時刻も含む
+		{"since=200&until=300&order=asc", ids[1:3]},
+		{"since=300&order=asc", ids[2:]},
+		{"until=200&order=asc", ids[:2]},
+		{"since=100&until=400&order=asc&limit=3", ids[:3]},
+		{"since=250&until=260", []int64{}},
+	} {
+		code, reactions := getReactionsAs(t, user.ID, livestreams[0].ID, tt.query)
+		if code != http.StatusOK {
+			t.Fatalf("%q: status = %d, want %d", tt.query, code, http.StatusOK)
+		}
+		if got := reactionIDs(reactions); !slices.Equal(got, tt.want) {
+			t.Errorf("%q: reactions = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
@@ -1,14 +1,20 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"net/http"
 	"sort"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
 )
 
 type LivestreamStatistics struct {
@@ -35,6 +41,320 @@ func (r LivestreamRanking) Less(i, j int) bool {
 	}
 }
 
+// ランキングの再計算間隔
+var rankingCacheTTL = 1 * time.Second
+
+// 全ユーザ・全配信のランキングを保持しておき、統計取得のたびに集計しなくて済むようにする
+// rankingCacheTTL 経過後か invalidate された後の最初の参照で再計算する
+type rankingCache struct {
+	// 集計はmuの外で行い、同時に来た再計算はgroupで1回にまとめる
+	group          singleflight.Group
+	mu             sync.Mutex
+	computedAt     time.Time
+	stale          bool
+	generation     int64
+	users          UserRanking
+	userRank       map[string]int64
+	userCount      int64
+	livestreams    LivestreamRanking
+	livestreamRank map[int64]int64
+	livestreamCnt  int64
+}
+
+var globalRanking = &rankingCache{stale: true}
+
+func (rc *rankingCache) invalidate() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.stale = true
+	rc.generation++
+}
+
+func (rc *rankingCache) refresh(ctx context.Context) error {
+	rc.mu.Lock()
+	fresh := !rc.stale && nowFunc().Sub(rc.computedAt) < rankingCacheTTL
+	rc.mu.Unlock()
+	if fresh {
+		return nil
+	}
+
+	_, err, _ := rc.group.Do("ranking", func() (any, error) {
+		rc.mu.Lock()
+		generation := rc.generation
+		rc.mu.Unlock()
+
+		userRanking, err := computeUserRanking(ctx)
+		if err != nil {
+			return nil, err
+		}
+		livestreamRanking, err := computeLivestreamRanking(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		// 昇順に並んでいるので末尾が1位
+		userRank := make(map[string]int64, len(userRanking))
+		for i, entry := range userRanking {
+			userRank[entry.Username] = int64(len(userRanking) - i)
+		}
+		livestreamRank := make(map[int64]int64, len(livestreamRanking))
+		for i, entry := range livestreamRanking {
+			livestreamRank[entry.LivestreamID] = int64(len(livestreamRanking) - i)
+		}
+
+		rc.mu.Lock()
+		defer rc.mu.Unlock()
+		rc.userRank = userRank
+		rc.users = userRanking
+		rc.userCount = int64(len(userRanking))
+		rc.livestreamRank = livestreamRank
+		rc.livestreams = livestreamRanking
+		rc.livestreamCnt = int64(len(livestreamRanking))
+		rc.computedAt = nowFunc()
+		// 集計中にinvalidateされた場合は、次の参照で集計し直す
+		rc.stale = rc.generation != generation
+		return nil, nil
+	})
+	return err
+}
+
+// ランキングに載っていない場合は最下位の次として扱う
+func (rc *rankingCache) rankByUsername(ctx context.Context, username string) (int64, error) {
+	if err := rc.refresh(ctx); err != nil {
+		return 0, err
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rank, ok := rc.userRank[username]; ok {
+		return rank, nil
+	}
+	return rc.userCount + 1, nil
+}
+
+// スコア上位 limit 件のユーザを1位から順に返す
+func (rc *rankingCache) topUsers(ctx context.Context, limit int) (UserRanking, error) {
+	if err := rc.refresh(ctx); err != nil {
+		return nil, err
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if limit > len(rc.users) {
+		limit = len(rc.users)
+	}
+	top := make(UserRanking, 0, limit)
+	for i := len(rc.users) - 1; i >= len(rc.users)-limit; i-- {
+		top = append(top, rc.users[i])
+	}
+	return top, nil
+}
+
+// スコア上位 limit 件の配信を1位から順に返す
+func (rc *rankingCache) topLivestreams(ctx context.Context, limit int) (LivestreamRanking, error) {
+	if err := rc.refresh(ctx); err != nil {
+		return nil, err
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if limit > len(rc.livestreams) {
+		limit = len(rc.livestreams)
+	}
+	top := make(LivestreamRanking, 0, limit)
+	for i := len(rc.livestreams) - 1; i >= len(rc.livestreams)-limit; i-- {
+		top = append(top, rc.livestreams[i])
+	}
+	return top, nil
+}
+
+func (rc *rankingCache) rankByLivestreamID(ctx context.Context, livestreamID int64) (int64, error) {
+	if err := rc.refresh(ctx); err != nil {
+		return 0, err
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rank, ok := rc.livestreamRank[livestreamID]; ok {
+		return rank, nil
+	}
+	return rc.livestreamCnt + 1, nil
+}
+
+// スコア昇順のユーザランキング
+func computeUserRanking(ctx context.Context) (UserRanking, error) {
+	query := `
+	SELECT u.name, COUNT(r.id) AS reactions, IFNULL(SUM(l2.tip), 0) AS total_tips
+	FROM users u
+	LEFT JOIN livestreams l ON u.id = l.user_id
+	LEFT JOIN reactions r ON l.id = r.livestream_id
+	LEFT JOIN livecomments l2 ON l.id = l2.livestream_id AND l2.hidden = FALSE
+	GROUP BY u.id
+	`
+	var entries []*struct {
+		Username  string `db:"name"`
+		Reactions int64  `db:"reactions"`
+		TotalTips int64  `db:"total_tips"`
+	}
+	if err := readDB().SelectContext(ctx, &entries, query); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get users: "+err.Error())
+	}
+
+	ranking := make(UserRanking, 0, len(entries))
+	for _, entry := range entries {
+		ranking = append(ranking, UserRankingEntry{
+			Username: entry.Username,
+			Score:    entry.Reactions + entry.TotalTips,
+		})
+	}
+	sort.Sort(ranking)
+	return ranking, nil
+}
+
+// スコア昇順の配信ランキング
+func computeLivestreamRanking(ctx context.Context) (LivestreamRanking, error) {
+	query := `
+	SELECT l.id, COUNT(r.id) AS reactions, IFNULL(SUM(l2.tip), 0) AS total_tips
+	FROM livestreams l
+	LEFT JOIN reactions r ON l.id = r.livestream_id
+	LEFT JOIN livecomments l2 ON l.id = l2.livestream_id AND l2.hidden = FALSE
+	GROUP BY l.id
+	`
+	var entries []*struct {
+		LivestreamID int64 `db:"id"`
+		Reactions    int64 `db:"reactions"`
+		TotalTips    int64 `db:"total_tips"`
+	}
+	if err := readDB().SelectContext(ctx, &entries, query); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+
+	ranking := make(LivestreamRanking, 0, len(entries))
+	for _, entry := range entries {
+		ranking = append(ranking, LivestreamRankingEntry{
+			LivestreamID: entry.LivestreamID,
+			Score:        entry.Reactions + entry.TotalTips,
+		})
+	}
+	sort.Sort(ranking)
+	return ranking, nil
+}
+
+// ランキングで一度に返す最大件数
+const maxRankingLimit = 100
+
+type UserRankingResponseEntry struct {
+	Rank  int64 `json:"rank"`
+	Score int64 `json:"score"`
+	User  User  `json:"user"`
+}
+
+// 上位配信者のランキング
+// GET /api/ranking/users?limit=N
+func getUserRankingHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	limit := 10
+	if c.QueryParam("limit") != "" {
+		v, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || v < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be non-negative integer")
+		}
+		limit = v
+	}
+	if limit > maxRankingLimit {
+		limit = maxRankingLimit
+	}
+
+	top, err := globalRanking.topUsers(ctx, limit)
+	if err != nil {
+		return err
+	}
+
+	userModels := make([]UserModel, 0, len(top))
+	for _, entry := range top {
+		userModel, ok := userModelByNameCache.Get(entry.Username)
+		if !ok {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+entry.Username)
+		}
+		userModels = append(userModels, userModel)
+	}
+	users, err := fillUserResponseBulk(ctx, dbConn, userModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill users: "+err.Error())
+	}
+
+	entries := make([]UserRankingResponseEntry, len(top))
+	for i := range top {
+		entries[i] = UserRankingResponseEntry{
+			Rank:  int64(i + 1),
+			Score: top[i].Score,
+			User:  users[i],
+		}
+	}
+
+	return c.JSON(http.StatusOK, entries)
+}
+
+type LivestreamRankingResponseEntry struct {
+	Rank       int64      `json:"rank"`
+	Score      int64      `json:"score"`
+	Livestream Livestream `json:"livestream"`
+}
+
+// 上位配信のランキング
+// GET /api/ranking/livestreams?limit=N
+func getLivestreamRankingHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	limit := 10
+	if c.QueryParam("limit") != "" {
+		v, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || v < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be non-negative integer")
+		}
+		limit = v
+	}
+	if limit > maxRankingLimit {
+		limit = maxRankingLimit
+	}
+
+	top, err := globalRanking.topLivestreams(ctx, limit)
+	if err != nil {
+		return err
+	}
+
+	livestreamModels := make([]*LivestreamModel, 0, len(top))
+	for _, entry := range top {
+		livestreamModel, ok := livestreamModelByIdCache.Get(entry.LivestreamID)
+		if !ok {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+strconv.FormatInt(entry.LivestreamID, 10))
+		}
+		livestreamModels = append(livestreamModels, &livestreamModel)
+	}
+	livestreams, err := fillLivestreamResponseBulk(ctx, dbConn, livestreamModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestreams: "+err.Error())
+	}
+
+	entries := make([]LivestreamRankingResponseEntry, len(top))
+	for i := range top {
+		entries[i] = LivestreamRankingResponseEntry{
+			Rank:       int64(i + 1),
+			Score:      top[i].Score,
+			Livestream: livestreams[i],
+		}
+	}
+
+	return c.JSON(http.StatusOK, entries)
+}
+
 type UserStatistics struct {
 	Rank              int64  `json:"rank"`
 	ViewersCount      int64  `json:"viewers_count"`
@@ -69,68 +389,55 @@ func getUserStatisticsHandler(c echo.Context) error {
 	}
 
 	username := c.Param("username")
-	// ユーザごとに、紐づく配信について、累計リアクション数、累計ライブコメント数、累計売上金額を算出
-	// また、現在の合計視聴者数もだす
-
 	user, ok := userModelByNameCache.Get(username)
 	if !ok {
 		return echo.NewHTTPError(http.StatusBadRequest, "not found user that has the given username")
 	}
 
-	var ranking UserRanking
-
-	query := `
-	SELECT u.name, COUNT(r.id) AS reactions, IFNULL(SUM(l2.tip), 0) AS total_tips
-	FROM users u
-	LEFT JOIN livestreams l ON u.id = l.user_id
-	LEFT JOIN reactions r ON l.id = r.livestream_id
-	LEFT JOIN livecomments l2 ON l.id = l2.livestream_id
-	GROUP BY u.id
-	`
-	var entries []*struct {
-		Username  string `db:"name"`
-		Reactions int64  `db:"reactions"`
-		TotalTips int64  `db:"total_tips"`
-	}
-	if err := dbConn.SelectContext(ctx, &entries, query); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get users: "+err.Error())
+	stats, err := computeUserStatistics(ctx, user)
+	if err != nil {
+		return err
 	}
+	return c.JSON(http.StatusOK, stats)
+}
 
-	for _, entry := range entries {
-		ranking = append(ranking, UserRankingEntry{
-			Username: entry.Username,
-			Score:    entry.Reactions + entry.TotalTips,
-		})
+// 自分の統計情報 (セッションのユーザIDから直接引く)
+// GET /api/user/me/statistics
+func getMyStatisticsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
 	}
 
-	sort.Sort(ranking)
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
 
-	var rank int64 = 1
-	for i := len(ranking) - 1; i >= 0; i-- {
-		entry := ranking[i]
-		if entry.Username == username {
-			break
+	user, err := getUserModelByID(ctx, userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given id")
 		}
-		rank++
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
 	}
 
-	// リアクション数
-	var totalReactions int64
-	query = `SELECT COUNT(*) FROM users u
-    INNER JOIN livestreams l ON l.user_id = u.id
-    INNER JOIN reactions r ON r.livestream_id = l.id
-    WHERE u.name = ?
-	`
-	if err := dbConn.GetContext(ctx, &totalReactions, query, username); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total reactions: "+err.Error())
+	stats, err := computeUserStatistics(ctx, user)
+	if err != nil {
+		return err
 	}
+	return c.JSON(http.StatusOK, stats)
+}
 
-	// ライブコメント数、チップ合計
-	var totalLivecomments int64
-	var totalTip int64
-	livestreams, ok := livestreamModelByUserIDCache.Get(user.ID)
-	if !ok {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams")
+// ユーザごとに、紐づく配信について、累計リアクション数、累計ライブコメント数、累計売上金額を算出
+// また、現在の合計視聴者数もだす
+// エラーはecho.NewHTTPErrorで返す
+func computeUserStatistics(ctx context.Context, user UserModel) (UserStatistics, error) {
+	livestreams, err := getLivestreamModelsByUserID(ctx, user.ID)
+	if err != nil {
+		return UserStatistics{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 	}
 
 	livestreamIDs := make([]int64, len(livestreams))
@@ -138,58 +445,81 @@ func getUserStatisticsHandler(c echo.Context) error {
 		livestreamIDs[i] = livestreams[i].ID
 	}
 
-	query, args, err := sqlx.In("SELECT * FROM livecomments WHERE livestream_id IN (?)", livestreamIDs)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to build query: "+err.Error())
-	}
-	query = dbConn.Rebind(query)
-	var livecomments []*LivecommentModel
-	if err := dbConn.SelectContext(ctx, &livecomments, query, args...); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
-	}
+	// 各集計は互いに独立しているので並行に投げる
+	eg, egCtx := errgroup.WithContext(ctx)
 
-	for _, livecomment := range livecomments {
-		totalTip += livecomment.Tip
-		totalLivecomments++
-	}
+	var rank int64
+	eg.Go(func() error {
+		var err error
+		rank, err = globalRanking.rankByUsername(egCtx, user.Name)
+		return err
+	})
 
-	// 合計視聴者数
+	// リアクション数
+	var totalReactions int64
+	eg.Go(func() error {
+		query := `SELECT COUNT(*) FROM users u
+    INNER JOIN livestreams l ON l.user_id = u.id
+    INNER JOIN reactions r ON r.livestream_id = l.id
+    WHERE u.name = ?
+	`
+		if err := readDB().GetContext(egCtx, &totalReactions, query, user.Name); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total reactions: "+err.Error())
+		}
+		return nil
+	})
+
+	// ライブコメント数、チップ合計、合計視聴者数
+	var totalLivecomments int64
+	var totalTip int64
 	var viewersCount int64
+	// 配信が1件もなければ IN () のクエリが組み立てられないので、引かずに0とする
+	if len(livestreamIDs) > 0 {
+		eg.Go(func() error {
+			query, args, err := sqlx.In("SELECT * FROM livecomments WHERE livestream_id IN (?) AND hidden = FALSE", livestreamIDs)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to build query: "+err.Error())
+			}
+			query = readDB().Rebind(query)
+			var livecomments []*LivecommentModel
+			if err := readDB().SelectContext(egCtx, &livecomments, query, args...); err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
+			}
+
+			for _, livecomment := range livecomments {
+				totalTip += livecomment.Tip
+				totalLivecomments++
+			}
+			return nil
+		})
 
-	query, args, err = sqlx.In("SELECT COUNT(*) FROM livestream_viewers_history WHERE livestream_id IN (?)", livestreamIDs)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to build query: "+err.Error())
-	}
-	query = dbConn.Rebind(query)
-	if err := dbConn.GetContext(ctx, &viewersCount, query, args...); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream_view_history: "+err.Error())
+		eg.Go(func() error {
+			query, args, err := sqlx.In("SELECT COUNT(*) FROM livestream_viewers_history WHERE livestream_id IN (?)", livestreamIDs)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to build query: "+err.Error())
+			}
+			query = readDB().Rebind(query)
+			if err := readDB().GetContext(egCtx, &viewersCount, query, args...); err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream_view_history: "+err.Error())
+			}
+			return nil
+		})
 	}
 
-	// お気に入り絵文字
-	var favoriteEmoji string
-	query = `
-	SELECT r.emoji_name
-	FROM users u
-	INNER JOIN livestreams l ON l.user_id = u.id
-	INNER JOIN reactions r ON r.livestream_id = l.id
-	WHERE u.name = ?
-	GROUP BY emoji_name
-	ORDER BY COUNT(*) DESC, emoji_name DESC
-	LIMIT 1
-	`
-	if err := dbConn.GetContext(ctx, &favoriteEmoji, query, username); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to find favorite emoji: "+err.Error())
+	// 1リクエストあたり最大4コネクションなので SetMaxOpenConns(500) の範囲に収まる
+	if err := eg.Wait(); err != nil {
+		return UserStatistics{}, err
 	}
 
-	stats := UserStatistics{
+	return UserStatistics{
 		Rank:              rank,
 		ViewersCount:      viewersCount,
 		TotalReactions:    totalReactions,
 		TotalLivecomments: totalLivecomments,
 		TotalTip:          totalTip,
-		FavoriteEmoji:     favoriteEmoji,
-	}
-	return c.JSON(http.StatusOK, stats)
+		// お気に入り絵文字はメモリ上の集計から求める
+		FavoriteEmoji: globalEmojiTally.favorite(user.ID),
+	}, nil
 }
 
 func getLivestreamStatisticsHandler(c echo.Context) error {
@@ -206,38 +536,9 @@ func getLivestreamStatisticsHandler(c echo.Context) error {
 	livestreamID := int64(id)
 
 	// ランク算出
-	var ranking LivestreamRanking
-	query := `
-	SELECT l.id, COUNT(r.id) AS reactions, IFNULL(SUM(l2.tip), 0) AS total_tips
-	FROM livestreams l
-	LEFT JOIN reactions r ON l.id = r.livestream_id
-	LEFT JOIN livecomments l2 ON l.id = l2.livestream_id
-	GROUP BY l.id
-	`
-	var entries []*struct {
-		LivestreamID int64 `db:"id"`
-		Reactions    int64 `db:"reactions"`
-		TotalTips    int64 `db:"total_tips"`
-	}
-	if err := dbConn.SelectContext(ctx, &entries, query); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
-	}
-
-	for _, entry := range entries {
-		ranking = append(ranking, LivestreamRankingEntry{
-			LivestreamID: entry.LivestreamID,
-			Score:        entry.Reactions + entry.TotalTips,
-		})
-	}
-	sort.Sort(ranking)
-
-	var rank int64 = 1
-	for i := len(ranking) - 1; i >= 0; i-- {
-		entry := ranking[i]
-		if entry.LivestreamID == livestreamID {
-			break
-		}
-		rank++
+	rank, err := globalRanking.rankByLivestreamID(ctx, livestreamID)
+	if err != nil {
+		return err
 	}
 
 	type Stats struct {
@@ -248,10 +549,10 @@ func getLivestreamStatisticsHandler(c echo.Context) error {
 	}
 
 	var stats Stats
-	if err := dbConn.GetContext(ctx, &stats, `
+	if err := readDB().GetContext(ctx, &stats, `
 	SELECT
 		(SELECT COUNT(*) FROM livestreams l INNER JOIN livestream_viewers_history h ON h.livestream_id = l.id WHERE l.id = ?) AS viewers_count,
-		(SELECT IFNULL(MAX(tip), 0) FROM livestreams l INNER JOIN livecomments l2 ON l2.livestream_id = l.id WHERE l.id = ?) AS max_tip,
+		(SELECT IFNULL(MAX(tip), 0) FROM livestreams l INNER JOIN livecomments l2 ON l2.livestream_id = l.id WHERE l.id = ? AND l2.hidden = FALSE) AS max_tip,
 		(SELECT COUNT(*) FROM livestreams l INNER JOIN reactions r ON r.livestream_id = l.id WHERE l.id = ?) AS total_reactions,
 		(SELECT COUNT(*) FROM livestreams l INNER JOIN livecomment_reports r ON r.livestream_id = l.id WHERE l.id = ?) AS total_reports
 	`, livestreamID, livestreamID, livestreamID, livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-json-experiment/json"
+	"github.com/jmoiron/sqlx"
+)
+
+func benchmarkStatisticsUser(b *testing.B) (UserModel, []int64) {
+	b.Helper()
+	setupTestDB(b)
+
+	user, seeded := seedTestLivestreams(b, "stats-bench-user", 20)
+	for i, livestream := range seeded {
+		for j := 0; j < 10; j++ {
+			seedTestLivecomment(b, LivecommentModel{UserID: user.ID, LivestreamID: livestream.ID, Comment: "stats-bench", Tip: int64(j), CreatedAt: int64(i*10 + j)})
+			seedTestReaction(b, ReactionModel{UserID: user.ID, LivestreamID: livestream.ID, EmojiName: "smile", CreatedAt: int64(i*10 + j)})
+		}
+	}
+	livestreams, err := getLivestreamModelsByUserID(context.Background(), user.ID)
+	if err != nil {
+		b.Fatal(err)
+	}
+	livestreamIDs := make([]int64, len(livestreams))
+	for i := range livestreams {
+		livestreamIDs[i] = livestreams[i].ID
+	}
+	return user, livestreamIDs
+}
+
+func BenchmarkComputeUserStatisticsParallel(b *testing.B) {
+	user, _ := benchmarkStatisticsUser(b)
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := computeUserStatistics(ctx, user); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// computeUserStatisticsと同じクエリを順番に投げた場合との比較用
+func BenchmarkComputeUserStatisticsSequential(b *testing.B) {
+	user, livestreamIDs := benchmarkStatisticsUser(b)
+	ctx := context.Background()
+	livecommentsQuery, livecommentsArgs, err := sqlx.In("SELECT * FROM livecomments WHERE livestream_id IN (?) AND hidden = FALSE", livestreamIDs)
+	if err != nil {
+		b.Fatal(err)
+	}
+	viewersQuery, viewersArgs, err := sqlx.In("SELECT COUNT(*) FROM livestream_viewers_history WHERE livestream_id IN (?)", livestreamIDs)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := globalRanking.rankByUsername(ctx, user.Name); err != nil {
+			b.Fatal(err)
+		}
+		var totalReactions int64
+		if err := readDB().GetContext(ctx, &totalReactions, "SELECT COUNT(*) FROM users u INNER JOIN livestreams l ON l.user_id = u.id INNER JOIN reactions r ON r.livestream_id = l.id WHERE u.name = ?", user.Name); err != nil {
+			b.Fatal(err)
+		}
+		var livecomments []*LivecommentModel
+		if err := readDB().SelectContext(ctx, &livecomments, readDB().Rebind(livecommentsQuery), livecommentsArgs...); err != nil {
+			b.Fatal(err)
+		}
+		var viewersCount int64
+		if err := readDB().GetContext(ctx, &viewersCount, readDB().Rebind(viewersQuery), viewersArgs...); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+type fakeUserRankingRow struct {
+	Username  string `db:"name"`
+	Reactions int64  `db:"reactions"`
+	TotalTips int64  `db:"total_tips"`
+}
+
+type fakeLivestreamRankingRow struct {
+	LivestreamID int64 `db:"id"`
+	Reactions    int64 `db:"reactions"`
+	TotalTips    int64 `db:"total_tips"`
+}
+
+// userの統計に必要なクエリを登録する。livestreamsが空なら配信のないユーザになる
+func fakeUserStatistics(f *fakeDB, user UserModel, livestreams []any, livecomments []any) {
+	f.rowsWhere("FROM users WHERE id", "id", user)
+	f.rows("FROM livestreams WHERE user_id", livestreams...)
+	f.rows("SELECT * FROM livecomments WHERE livestream_id IN", livecomments...)
+	f.value("FROM livestream_viewers_history WHERE livestream_id IN", "COUNT(*)", int64(3))
+	f.value("INNER JOIN reactions r", "COUNT(*)", int64(5))
+	f.rows("LEFT JOIN livestreams l ON u.id = l.user_id",
+		fakeUserRankingRow{Username: user.Name, Reactions: 5, TotalTips: 30},
+		fakeUserRankingRow{Username: "stats-other-user", Reactions: 100})
+	f.rows("SELECT l.id, COUNT(r.id)", fakeLivestreamRankingRow{LivestreamID: 1})
+	userModelByNameCache.Set(user.Name, user)
+}
+
+// /api/user/me/statistics と /api/user/:username/statistics が同じ結果を返すこと
+func compareUserStatistics(t *testing.T, user UserModel) UserStatistics {
+	t.Helper()
+	code, me, err := serveAs(user.ID, getMyStatisticsHandler, http.MethodGet, "/api/user/me/statistics", "")
+	if err != nil || code != http.StatusOK {
+		t.Fatalf("me: status = %d (err=%v), want %d", code, err, http.StatusOK)
+	}
+	code, byName, err := serveAs(user.ID, getUserStatisticsHandler, http.MethodGet, "/", "", "username", user.Name)
+	if err != nil || code != http.StatusOK {
+		t.Fatalf("by username: status = %d (err=%v), want %d", code, err, http.StatusOK)
+	}
+	if me != byName {
+		t.Errorf("me = %s, by username = %s", me, byName)
+	}
+	var stats UserStatistics
+	if err := json.Unmarshal([]byte(me), &stats); err != nil {
+		t.Fatal(err)
+	}
+	return stats
+}
+
+func TestMyStatisticsMatchesUserStatistics(t *testing.T) {
+	f := setupHandlerTest(t)
+	user := UserModel{ID: 1, Name: "stats-test-user"}
+	fakeUserStatistics(f, user,
+		[]any{LivestreamModel{ID: 1, UserID: 1}, LivestreamModel{ID: 2, UserID: 1}},
+		[]any{LivecommentModel{ID: 1, LivestreamID: 1, Tip: 10}, LivecommentModel{ID: 2, LivestreamID: 2, Tip: 20}})
+
+	stats := compareUserStatistics(t, user)
+	want := UserStatistics{Rank: 2, ViewersCount: 3, TotalReactions: 5, TotalLivecomments: 2, TotalTip: 30}
+	if stats != want {
+		t.Errorf("stats = %+v, want %+v", stats, want)
+	}
+}
+
+func TestUserStatisticsWithoutLivestreams(t *testing.T) {
+	f := setupHandlerTest(t)
+	user := UserModel{ID: 1, Name: "stats-test-user"}
+	fakeUserStatistics(f, user, nil, nil)
+
+	stats := compareUserStatistics(t, user)
+	if stats.TotalLivecomments != 0 || stats.TotalTip != 0 || stats.ViewersCount != 0 {
+		t.Errorf("stats = %+v, want zero livecomments, tips and viewers", stats)
+	}
+	if n := f.count("livestream_id IN"); n != 0 {
+		t.Errorf("ran %d IN queries for a user without livestreams", n)
+	}
+}
+
+func TestPostReactionUpdatesFavoriteEmoji(t *testing.T) {
+	f := setupHandlerTest(t)
+	user := UserModel{ID: 1, Name: "stats-test-user"}
+	fakeLivecommentTarget(f, LivestreamModel{ID: 1, UserID: user.ID})
+	fakeUserStatistics(f, user, []any{LivestreamModel{ID: 1, UserID: user.ID}}, nil)
+	f.rowsWhere("FROM themes WHERE user_id", "user_id", ThemeModel{ID: 1, UserID: user.ID})
+	f.exec("INSERT INTO reactions", 1)
+
+	steps := []struct {
+		emoji string
+		want  string
+	}{
+		{"heart", "heart"},
+		// 同数なら名前の大きい方 (ORDER BY emoji_name DESC)
+		{"smile", "smile"},
+		{"heart", "heart"},
+		{"smile", "smile"},
+		{"tada", "smile"},
+		{"tada", "tada"},
+	}
+	for i, step := range steps {
+		body := `{"emoji_name":"` + step.emoji + `"}`
+		code, _, err := serveAs(user.ID, postReactionHandler, http.MethodPost, "/", body, "livestream_id", "1")
+		if err != nil || code != http.StatusCreated {
+			t.Fatalf("step %d: status = %d (err=%v), want %d", i, code, err, http.StatusCreated)
+		}
+		if got := compareUserStatistics(t, user).FavoriteEmoji; got != step.want {
+			t.Errorf("step %d (%s): favorite = %q, want %q", i, step.emoji, got, step.want)
+		}
+	}
+}
+
+func fakeRankings(f *fakeDB, users []any, livestreams []any) {
+	f.rows("LEFT JOIN livestreams l ON u.id = l.user_id", users...)
+	f.rows("SELECT l.id, COUNT(r.id)", livestreams...)
+}
+
+// キャッシュから引いた順位が、その場で集計し直した順位と一致すること
+func assertRankingMatchesFresh(t *testing.T) {
+	t.Helper()
+	ctx := context.Background()
+	userRanking, err := computeUserRanking(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, entry := range userRanking {
+		want := int64(len(userRanking) - i)
+		if got, err := globalRanking.rankByUsername(ctx, entry.Username); err != nil || got != want {
+			t.Errorf("rankByUsername(%q) = (%d, %v), want %d", entry.Username, got, err, want)
+		}
+	}
+	livestreamRanking, err := computeLivestreamRanking(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, entry := range livestreamRanking {
+		want := int64(len(livestreamRanking) - i)
+		if got, err := globalRanking.rankByLivestreamID(ctx, entry.LivestreamID); err != nil || got != want {
+			t.Errorf("rankByLivestreamID(%d) = (%d, %v), want %d", entry.LivestreamID, got, err, want)
+		}
+	}
+}
+
+func TestRankingCacheMatchesFreshRanking(t *testing.T) {
+	f := setupHandlerTest(t)
+	fakeRankings(f,
+		[]any{
+			fakeUserRankingRow{Username: "a", Reactions: 1},
+			fakeUserRankingRow{Username: "b", Reactions: 5, TotalTips: 10},
+			fakeUserRankingRow{Username: "c", Reactions: 5, TotalTips: 10},
+			fakeUserRankingRow{Username: "d"},
+		},
+		[]any{
+			fakeLivestreamRankingRow{LivestreamID: 1, Reactions: 3},
+			fakeLivestreamRankingRow{LivestreamID: 2},
+			fakeLivestreamRankingRow{LivestreamID: 3, Reactions: 3},
+		})
+	assertRankingMatchesFresh(t)
+
+	// スコアが変わっても、invalidateすれば集計し直した結果と一致する
+	fakeRankings(f,
+		[]any{
+			fakeUserRankingRow{Username: "a", Reactions: 100},
+			fakeUserRankingRow{Username: "b"},
+			fakeUserRankingRow{Username: "c", TotalTips: 1},
+			fakeUserRankingRow{Username: "d", Reactions: 2},
+		},
+		[]any{
+			fakeLivestreamRankingRow{LivestreamID: 1},
+			fakeLivestreamRankingRow{LivestreamID: 2, TotalTips: 50},
+			fakeLivestreamRankingRow{LivestreamID: 3, Reactions: 1},
+		})
+	globalRanking.invalidate()
+	assertRankingMatchesFresh(t)
+	if got, _ := globalRanking.rankByUsername(context.Background(), "a"); got != 1 {
+		t.Errorf("rank of a after invalidate = %d, want 1", got)
+	}
+}
+
+func TestRankingCacheRefreshesOnceForConcurrentCalls(t *testing.T) {
+	f := setupHandlerTest(t)
+	fakeRankings(f, []any{fakeUserRankingRow{Username: "a"}}, []any{fakeLivestreamRankingRow{LivestreamID: 1}})
+	f.delay = 50 * time.Millisecond
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := globalRanking.rankByUsername(context.Background(), "a"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := f.count("LEFT JOIN livestreams l ON u.id = l.user_id"); n != 1 {
+		t.Errorf("computed the user ranking %d times, want 1", n)
+	}
+}
+
+// 集計中はロックを握っていないので、その間のinvalidateで止まらず、次の参照で集計し直す
+func TestRankingCacheInvalidateDuringRefresh(t *testing.T) {
+	f := setupHandlerTest(t)
+	fakeRankings(f, []any{fakeUserRankingRow{Username: "a"}}, []any{fakeLivestreamRankingRow{LivestreamID: 1}})
+	invalidated := false
+	f.on("LEFT JOIN livestreams l ON u.id = l.user_id", func([]driver.Value) fakeResponse {
+		if !invalidated {
+			invalidated = true
+			globalRanking.invalidate()
+		}
+		return rowsOf(fakeUserRankingRow{Username: "a"})
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		globalRanking.rankByUsername(context.Background(), "a")
+		globalRanking.rankByUsername(context.Background(), "a")
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("rankByUsername did not return (deadlock?)")
+	}
+
+	if n := f.count("LEFT JOIN livestreams l ON u.id = l.user_id"); n != 2 {
+		t.Errorf("computed the user ranking %d times, want 2", n)
+	}
+}
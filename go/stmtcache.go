@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 頻繁に投げるクエリのプリペアドステートメントを接続先とクエリ文字列ごとに使い回す
+// LIMITなどの値はプレースホルダで渡すので、クエリ文字列の種類は有限に収まる
+type stmtCacheKey struct {
+	db    *sqlx.DB
+	query string
+}
+
+var (
+	stmtCacheMu sync.RWMutex
+	stmtCache   = make(map[stmtCacheKey]*sqlx.Stmt)
+)
+
+func preparedStmt(ctx context.Context, db *sqlx.DB, query string) (*sqlx.Stmt, error) {
+	key := stmtCacheKey{db: db, query: query}
+	stmtCacheMu.RLock()
+	stmt, ok := stmtCache[key]
+	stmtCacheMu.RUnlock()
+	if ok {
+		return stmt, nil
+	}
+
+	stmtCacheMu.Lock()
+	defer stmtCacheMu.Unlock()
+	if stmt, ok := stmtCache[key]; ok {
+		return stmt, nil
+	}
+	stmt, err := db.PreparexContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	stmtCache[key] = stmt
+	return stmt, nil
+}
+
+// dbで準備したステートメントを閉じてキャッシュから外す (dbを閉じる前に呼ぶ)
+func closePreparedStmts(db *sqlx.DB) {
+	stmtCacheMu.Lock()
+	defer stmtCacheMu.Unlock()
+	for key, stmt := range stmtCache {
+		if key.db == db {
+			stmt.Close()
+			delete(stmtCache, key)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+const benchmarkStmtQuery = "SELECT * FROM livecomments WHERE livestream_id = ? AND hidden = FALSE ORDER BY created_at DESC LIMIT ?"
+
+func TestPreparedStmtReusesStatement(t *testing.T) {
+	useFakeDB(t)
+	ctx := context.Background()
+
+	first, err := preparedStmt(ctx, dbConn, benchmarkStmtQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := preparedStmt(ctx, dbConn, benchmarkStmtQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Error("preparedStmt prepared the same query twice")
+	}
+}
+
+// 接続先が変わったら、前の接続先で準備したステートメントを返さない
+func TestPreparedStmtPerDB(t *testing.T) {
+	ctx := context.Background()
+	useFakeDB(t)
+	first := dbConn
+	useFakeDB(t)
+	second := dbConn
+
+	a, err := preparedStmt(ctx, first, benchmarkStmtQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := preparedStmt(ctx, second, benchmarkStmtQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == b {
+		t.Fatal("preparedStmt shared a statement between two databases")
+	}
+
+	closePreparedStmts(first)
+	again, err := preparedStmt(ctx, first, benchmarkStmtQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again == a {
+		t.Error("closed statement is still cached")
+	}
+	if got, _ := preparedStmt(ctx, second, benchmarkStmtQuery); got != b {
+		t.Error("closing one database dropped the other database's statement")
+	}
+}
+
+func BenchmarkPreparedStmtCache(b *testing.B) {
+	setupTestDB(b)
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		stmt, err := preparedStmt(ctx, dbConn, benchmarkStmtQuery)
+		if err != nil {
+			b.Fatal(err)
+		}
+		var livecommentModels []LivecommentModel
+		if err := stmt.SelectContext(ctx, &livecommentModels, 1, 10); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// キャッシュせずに毎回プリペアする場合との比較用
+func BenchmarkPreparedStmtEachTime(b *testing.B) {
+	setupTestDB(b)
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		stmt, err := dbConn.PreparexContext(ctx, benchmarkStmtQuery)
+		if err != nil {
+			b.Fatal(err)
+		}
+		var livecommentModels []LivecommentModel
+		if err := stmt.SelectContext(ctx, &livecommentModels, 1, 10); err != nil {
+			b.Fatal(err)
+		}
+		stmt.Close()
+	}
+}
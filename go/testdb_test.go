@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+// MySQLを使うテストはこの環境変数を設定したときだけ動かす
+// 設定されているのにつながらない場合はスキップせずに失敗させる
+const testMySQLEnvKey = "ISUCON13_TEST_MYSQL"
+
+var testDBSeq atomic.Int64
+
+// テストごとに空のデータベースを作ってスキーマを流し、dbConnをそこに向ける
+// 終わったらデータベースごと削除するので、他のテストや初期データには影響しない
+func setupTestDB(t testing.TB) {
+	t.Helper()
+	if os.Getenv(testMySQLEnvKey) == "" {
+		t.Skipf("set %s=1 to run tests against mysql", testMySQLEnvKey)
+	}
+	schema, err := os.ReadFile(filepath.Join("..", "sql", "initdb.d", "10_schema.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := echo.New().Logger
+	t.Setenv("ISUCON13_MYSQL_DIALCONFIG_DATABASE", "")
+	admin, err := connectDB(logger, "")
+	if err != nil {
+		t.Fatalf("failed to connect to mysql: %v", err)
+	}
+	t.Cleanup(func() { admin.Close() })
+
+	name := fmt.Sprintf("isupipe_test_%d_%d", os.Getpid(), testDBSeq.Add(1))
+	if _, err := admin.Exec("CREATE DATABASE `" + name + "`"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec("DROP DATABASE IF EXISTS `" + name + "`"); err != nil {
+			t.Errorf("failed to drop %s: %v", name, err)
+		}
+	})
+
+	t.Setenv("ISUCON13_MYSQL_DIALCONFIG_DATABASE", name)
+	conn, err := connectDB(logger, "")
+	if err != nil {
+		t.Fatalf("failed to connect to %s: %v", name, err)
+	}
+	t.Cleanup(func() {
+		closePreparedStmts(conn)
+		conn.Close()
+	})
+	for _, stmt := range schemaStatements(string(schema)) {
+		if _, err := conn.Exec(stmt); err != nil {
+			t.Fatalf("failed to apply schema: %v\n%s", err, stmt)
+		}
+	}
+
+	prevDB, prevReplica := dbConn, replicaConn
+	dbConn, replicaConn = conn, nil
+	t.Cleanup(func() { dbConn, replicaConn = prevDB, prevReplica })
+	resetCaches(t)
+}
+
+// スキーマを1文ずつに分ける。接続先のデータベースを使うのでUSE文は除く
+func schemaStatements(schema string) []string {
+	var stmts []string
+	for _, stmt := range strings.Split(schema, ";") {
+		var lines []string
+		for _, line := range strings.Split(stmt, "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "--") {
+				lines = append(lines, line)
+			}
+		}
+		if len(lines) == 0 || strings.HasPrefix(strings.ToUpper(lines[0]), "USE ") {
+			continue
+		}
+		stmts = append(stmts, strings.Join(lines, "\n"))
+	}
+	return stmts
+}
+
+// 配信者とその配信を作る
+func seedTestLivestreams(t testing.TB, name string, n int) (UserModel, []LivestreamModel) {
+	t.Helper()
+	user := UserModel{Name: name, DisplayName: name, Description: name, HashedPassword: "password"}
+	rs, err := dbConn.NamedExec("INSERT INTO users (name, display_name, description, password) VALUES (:name, :display_name, :description, :password)", user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID, err = rs.LastInsertId(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dbConn.Exec("INSERT INTO themes (user_id, dark_mode) VALUES (?, FALSE)", user.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	livestreams := make([]LivestreamModel, n)
+	for i := range livestreams {
+		livestreams[i] = LivestreamModel{
+			UserID:       user.ID,
+			Title:        fmt.Sprintf("%s-%d", name, i),
+			Description:  "test",
+			PlaylistUrl:  "https://media.xiidec.com/whoami/playlist.m3u8",
+			ThumbnailUrl: "https://media.xiidec.com/whoami/thumbnail.jpg",
+			StartAt:      1704067200 + int64(i)*3600,
+			EndAt:        1704070800 + int64(i)*3600,
+		}
+		rs, err := dbConn.NamedExec("INSERT INTO livestreams (user_id, title, description, playlist_url, thumbnail_url, start_at, end_at) VALUES (:user_id, :title, :description, :playlist_url, :thumbnail_url, :start_at, :end_at)", livestreams[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if livestreams[i].ID, err = rs.LastInsertId(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return user, livestreams
+}
+
+func seedTestLivecomment(t testing.TB, l LivecommentModel) LivecommentModel {
+	t.Helper()
+	rs, err := dbConn.NamedExec("INSERT INTO livecomments (user_id, livestream_id, comment, tip, hidden, created_at) VALUES (:user_id, :livestream_id, :comment, :tip, :hidden, :created_at)", l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.ID, err = rs.LastInsertId(); err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func seedTestReaction(t testing.TB, r ReactionModel) ReactionModel {
+	t.Helper()
+	rs, err := dbConn.NamedExec("INSERT INTO reactions (user_id, livestream_id, livecomment_id, emoji_name, created_at) VALUES (:user_id, :livestream_id, :livecomment_id, :emoji_name, :created_at)", r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ID, err = rs.LastInsertId(); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestSchemaStatements(t *testing.T) {
+	schema, err := os.ReadFile(filepath.Join("..", "sql", "initdb.d", "10_schema.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stmts := schemaStatements(string(schema))
+	if len(stmts) == 0 || !strings.HasPrefix(stmts[0], "CREATE TABLE `users`") {
+		t.Fatalf("first statement = %q, want CREATE TABLE `users`", stmts[:min(1, len(stmts))])
+	}
+	for _, stmt := range stmts {
+		if strings.HasPrefix(strings.ToUpper(stmt), "USE ") {
+			t.Errorf("USE statement is not removed: %q", stmt)
+		}
+	}
+}
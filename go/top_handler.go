@@ -1,7 +1,16 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/labstack/echo/v4"
 )
@@ -20,6 +29,43 @@ type TagsResponse struct {
 	Tags []*Tag `json:"tags"`
 }
 
+// tagsテーブルを読み直してtagModelCacheを更新する間隔 (0なら無効)
+var tagCacheRefreshInterval time.Duration
+
+// アプリ外からtagsに追加された場合に備えて、定期的にtagModelCacheを読み直す
+func refreshTagCachePeriodically(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			var tagModels []TagModel
+			if err := dbConn.SelectContext(ctx, &tagModels, "SELECT * FROM tags"); err != nil {
+				log.Printf("failed to refresh tag cache: %v", err)
+				continue
+			}
+			tags := make(map[int64]TagModel, len(tagModels))
+			for _, tagModel := range tagModels {
+				tags[tagModel.ID] = tagModel
+			}
+			tagModelCache.Replace(tags)
+		}
+	}
+}
+
+// 他のサーバで作られたばかりのタグはまだ載っていないことがあるので、なければDBから読む
+func getTagModelByID(ctx context.Context, id int64) (TagModel, error) {
+	return tagModelCache.GetOrSet(id, func() (TagModel, error) {
+		var tagModel TagModel
+		if err := dbConn.GetContext(ctx, &tagModel, "SELECT * FROM tags WHERE id = ?", id); err != nil {
+			return TagModel{}, err
+		}
+		return tagModel, nil
+	})
+}
+
 func getTagHandler(c echo.Context) error {
 	tagModels := tagModelCache.All()
 	tags := make([]*Tag, len(tagModels))
@@ -34,6 +80,202 @@ func getTagHandler(c echo.Context) error {
 	})
 }
 
+type PostTagRequest struct {
+	Name string `json:"name"`
+}
+
+// タグ名の最大長 (tags.nameのカラム長)
+const maxTagNameLength = 255
+
+// タグ追加API (管理者のみ)
+// POST /api/tag
+func postTagHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyAdminSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	var req PostTagRequest
+	if err := decodeJSON(c, &req); err != nil {
+		return err
+	}
+	if req.Name == "" || utf8.RuneCountInString(req.Name) > maxTagNameLength {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("name must be 1 to %d characters", maxTagNameLength))
+	}
+
+	rs, err := dbConn.ExecContext(ctx, "INSERT INTO tags (name) VALUES (?)", req.Name)
+	if err != nil {
+		if isDuplicateEntryError(err) {
+			return echo.NewHTTPError(http.StatusConflict, "tag already exists")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert tag: "+err.Error())
+	}
+
+	tagID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted tag id: "+err.Error())
+	}
+	// 他のサーバにはまだ載っていないので破棄を伝える必要はなく、getTagModelByIDか定期的な読み直しで載る
+	tagModelCache.Set(tagID, TagModel{
+		ID:   tagID,
+		Name: req.Name,
+	})
+	// 人気タグの集計はキャッシュにないタグを飛ばしているので、載せたタグが入るように集計し直させる
+	globalPopularTags.invalidate()
+
+	return c.JSON(http.StatusCreated, &Tag{
+		ID:   tagID,
+		Name: req.Name,
+	})
+}
+
+type PopularTag struct {
+	ID              int64  `json:"id"`
+	Name            string `json:"name"`
+	LivestreamCount int64  `json:"livestream_count"`
+}
+
+const (
+	// 人気タグの集計結果を使い回す期間
+	popularTagsCacheTTL = 10 * time.Second
+	maxPopularTagsLimit = 100
+)
+
+// 人気タグはあまり変わらないので短時間キャッシュする
+type popularTagsCache struct {
+	mu         sync.Mutex
+	computedAt time.Time
+	stale      bool
+	tags       []PopularTag
+}
+
+var globalPopularTags = &popularTagsCache{stale: true}
+
+func (pc *popularTagsCache) invalidate() {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.stale = true
+}
+
+// 利用している配信数の多い順にlimit件返す
+func (pc *popularTagsCache) top(ctx context.Context, limit int) ([]PopularTag, error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if pc.stale || nowFunc().Sub(pc.computedAt) >= popularTagsCacheTTL {
+		var counts []struct {
+			TagID int64 `db:"tag_id"`
+			Count int64 `db:"count"`
+		}
+		if err := readDB().SelectContext(ctx, &counts, "SELECT tag_id, COUNT(*) AS count FROM livestream_tags GROUP BY tag_id ORDER BY count DESC, tag_id ASC"); err != nil {
+			return nil, err
+		}
+
+		tags := make([]PopularTag, 0, len(counts))
+		for _, count := range counts {
+			tagModel, ok := tagModelCache.Get(count.TagID)
+			if !ok {
+				continue
+			}
+			tags = append(tags, PopularTag{
+				ID:              tagModel.ID,
+				Name:            tagModel.Name,
+				LivestreamCount: count.Count,
+			})
+		}
+		pc.tags = tags
+		pc.computedAt = nowFunc()
+		pc.stale = false
+	}
+
+	if limit > len(pc.tags) {
+		limit = len(pc.tags)
+	}
+	return pc.tags[:limit], nil
+}
+
+// 利用している配信数の多いタグ一覧
+// GET /api/tag/popular?limit=10
+func getPopularTagsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	limit := 10
+	if c.QueryParam("limit") != "" {
+		v, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || v < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be non-negative integer")
+		}
+		limit = v
+	}
+	if limit > maxPopularTagsLimit {
+		limit = maxPopularTagsLimit
+	}
+
+	tags, err := globalPopularTags.top(ctx, limit)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get popular tags: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, tags)
+}
+
+type TagStatistics struct {
+	TagID            int64   `json:"tag_id"`
+	LivestreamCount  int64   `json:"livestream_count"`
+	AverageReactions float64 `json:"average_reactions"`
+	AverageTips      float64 `json:"average_tips"`
+}
+
+// タグが付いた配信あたりの平均リアクション数・平均チップ額
+// GET /api/tag/:tag_id/stats
+func getTagStatisticsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	tagID, err := strconv.Atoi(c.Param("tag_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "tag_id in path must be integer")
+	}
+
+	if _, err := getTagModelByID(ctx, int64(tagID)); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found tag that has the given id")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tag: "+err.Error())
+	}
+
+	var stats struct {
+		LivestreamCount int64 `db:"livestream_count"`
+		TotalReactions  int64 `db:"total_reactions"`
+		TotalTips       int64 `db:"total_tips"`
+	}
+	if err := readDB().GetContext(ctx, &stats, `
+	SELECT
+		(SELECT COUNT(DISTINCT livestream_id) FROM livestream_tags WHERE tag_id = ?) AS livestream_count,
+		(SELECT COUNT(*) FROM reactions WHERE livestream_id IN (SELECT livestream_id FROM livestream_tags WHERE tag_id = ?)) AS total_reactions,
+		(SELECT IFNULL(SUM(tip), 0) FROM livecomments WHERE hidden = FALSE AND livestream_id IN (SELECT livestream_id FROM livestream_tags WHERE tag_id = ?)) AS total_tips
+	`, tagID, tagID, tagID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tag stats: "+err.Error())
+	}
+
+	res := TagStatistics{
+		TagID:           int64(tagID),
+		LivestreamCount: stats.LivestreamCount,
+	}
+	if stats.LivestreamCount > 0 {
+		res.AverageReactions = float64(stats.TotalReactions) / float64(stats.LivestreamCount)
+		res.AverageTips = float64(stats.TotalTips) / float64(stats.LivestreamCount)
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
 // 配信者のテーマ取得API
 // GET /api/user/:username/theme
 func getStreamerThemeHandler(c echo.Context) error {
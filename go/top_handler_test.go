@@ -0,0 +1,146 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/go-json-experiment/json"
+)
+
+type fakeTagCountRow struct {
+	TagID int64 `db:"tag_id"`
+	Count int64 `db:"count"`
+}
+
+func TestPostTagShowsUpInTagsAndPopularTags(t *testing.T) {
+	f := setupHandlerTest(t)
+	f.exec("INSERT INTO tags", 50)
+	// 他のサーバで作られた配信に、まだこのサーバが知らないタグが付いている
+	f.rows("FROM livestream_tags GROUP BY tag_id", fakeTagCountRow{TagID: 50, Count: 3})
+
+	popularTags := func() []PopularTag {
+		code, body, err := serveAs(1, getPopularTagsHandler, http.MethodGet, "/api/tag/popular", "")
+		if err != nil || code != http.StatusOK {
+			t.Fatalf("popular tags: status = %d (err=%v), want %d", code, err, http.StatusOK)
+		}
+		var tags []PopularTag
+		if err := json.Unmarshal([]byte(body), &tags); err != nil {
+			t.Fatal(err)
+		}
+		return tags
+	}
+	if tags := popularTags(); len(tags) != 0 {
+		t.Fatalf("popular tags before creating the tag = %+v, want none", tags)
+	}
+
+	if code, _ := serveAsAdmin(t, postTagHandler, http.MethodPost, "/api/tag", `{"name":"new-tag"}`); code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d", code, http.StatusCreated)
+	}
+
+	code, body, err := serveAs(1, getTagHandler, http.MethodGet, "/api/tag", "")
+	if err != nil || code != http.StatusOK {
+		t.Fatalf("tags: status = %d (err=%v), want %d", code, err, http.StatusOK)
+	}
+	var res TagsResponse
+	if err := json.Unmarshal([]byte(body), &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Tags) != 1 || *res.Tags[0] != (Tag{ID: 50, Name: "new-tag"}) {
+		t.Errorf("tags = %s, want only new-tag", body)
+	}
+
+	want := PopularTag{ID: 50, Name: "new-tag", LivestreamCount: 3}
+	if tags := popularTags(); len(tags) != 1 || tags[0] != want {
+		t.Errorf("popular tags = %+v, want [%+v]", tags, want)
+	}
+}
+
+type fakeTagStatsRow struct {
+	LivestreamCount int64 `db:"livestream_count"`
+	TotalReactions  int64 `db:"total_reactions"`
+	TotalTips       int64 `db:"total_tips"`
+}
+
+func getTagStatisticsAs(t *testing.T, tagID int64) (int, TagStatistics) {
+	t.Helper()
+	code, body, err := serveAs(1, getTagStatisticsHandler, http.MethodGet, "/", "", "tag_id", strconv.FormatInt(tagID, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats TagStatistics
+	if code == http.StatusOK {
+		if err := json.Unmarshal([]byte(body), &stats); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return code, stats
+}
+
+func TestGetTagStatistics(t *testing.T) {
+	f := setupHandlerTest(t)
+	f.rowsWhere("FROM tags WHERE id", "id", TagModel{ID: 1, Name: "used"}, TagModel{ID: 2, Name: "unused"})
+	f.on("AS livestream_count", func(args []driver.Value) fakeResponse {
+		if args[0] == int64(1) {
+			return rowsOf(fakeTagStatsRow{LivestreamCount: 2, TotalReactions: 4, TotalTips: 150})
+		}
+		return rowsOf(fakeTagStatsRow{})
+	})
+
+	tests := []struct {
+		tagID    int64
+		wantCode int
+		want     TagStatistics
+	}{
+		{1, http.StatusOK, TagStatistics{TagID: 1, LivestreamCount: 2, AverageReactions: 2, AverageTips: 75}},
+		{2, http.StatusOK, TagStatistics{TagID: 2}},
+		{999, http.StatusNotFound, TagStatistics{}},
+	}
+	for _, tt := range tests {
+		code, stats := getTagStatisticsAs(t, tt.tagID)
+		if code != tt.wantCode {
+			t.Errorf("tag %d: status = %d, want %d", tt.tagID, code, tt.wantCode)
+			continue
+		}
+		if stats != tt.want {
+			t.Errorf("tag %d: stats = %+v, want %+v", tt.tagID, stats, tt.want)
+		}
+	}
+}
+
+func TestGetTagStatisticsWithMySQL(t *testing.T) {
+	setupTestDB(t)
+	for _, name := range []string{"used", "unused"} {
+		if _, err := dbConn.Exec("INSERT INTO tags (name) VALUES (?)", name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	user, livestreams := seedTestLivestreams(t, "tag-stats-test-user", 3)
+	for _, livestream := range livestreams[:2] {
+		if _, err := dbConn.Exec("INSERT INTO livestream_tags (livestream_id, tag_id) VALUES (?, 1)", livestream.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// タグ付きの配信に3件と1件、タグのない配信に5件のリアクション
+	for i, n := range []int{3, 1, 5} {
+		for j := 0; j < n; j++ {
+			seedTestReaction(t, ReactionModel{UserID: user.ID, LivestreamID: livestreams[i].ID, EmojiName: "innocent"})
+		}
+	}
+	seedTestLivecomment(t, LivecommentModel{UserID: user.ID, LivestreamID: livestreams[0].ID, Comment: "tip", Tip: 100})
+	seedTestLivecomment(t, LivecommentModel{UserID: user.ID, LivestreamID: livestreams[1].ID, Comment: "tip", Tip: 50})
+	// 非表示のチップとタグのない配信へのチップは含めない
+	seedTestLivecomment(t, LivecommentModel{UserID: user.ID, LivestreamID: livestreams[1].ID, Comment: "hidden", Tip: 1000, Hidden: true})
+	seedTestLivecomment(t, LivecommentModel{UserID: user.ID, LivestreamID: livestreams[2].ID, Comment: "untagged", Tip: 1000})
+
+	if code, stats := getTagStatisticsAs(t, 1); code != http.StatusOK || stats != (TagStatistics{TagID: 1, LivestreamCount: 2, AverageReactions: 2, AverageTips: 75}) {
+		t.Errorf("used tag: status = %d, stats = %+v", code, stats)
+	}
+	if code, stats := getTagStatisticsAs(t, 2); code != http.StatusOK || stats != (TagStatistics{TagID: 2}) {
+		t.Errorf("unused tag: status = %d, stats = %+v", code, stats)
+	}
+	if code, _ := getTagStatisticsAs(t, 999); code != http.StatusNotFound {
+		t.Errorf("unknown tag: status = %d, want %d", code, http.StatusNotFound)
+	}
+}
@@ -3,16 +3,19 @@ package main
 import (
 	"context"
 	"crypto/sha256"
+	"database/sql"
 	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
 	"os"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/bwmarrin/snowflake"
-	"github.com/go-json-experiment/json"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/sessions"
@@ -56,6 +59,8 @@ type User struct {
 	Description string `json:"description,omitempty"`
 	Theme       Theme  `json:"theme,omitempty"`
 	IconHash    string `json:"icon_hash,omitempty"`
+	// 独自のアイコンを設定しているか (falseならデフォルト画像)
+	HasIcon bool `json:"has_icon"`
 }
 
 type Theme struct {
@@ -88,12 +93,39 @@ type LoginRequest struct {
 	Password string `json:"password"`
 }
 
+type SessionResponse struct {
+	Authenticated bool  `json:"authenticated"`
+	UserID        int64 `json:"user_id"`
+	ExpiresAt     int64 `json:"expires_at"`
+}
+
 type PostIconRequest struct {
 	Image []byte `json:"image"`
 }
 
+type IconHashesRequest struct {
+	Usernames []string `json:"usernames"`
+}
+
+// 一度にまとめて取得できるユーザ数
+const maxUsersBatchSize = 100
+
+type UsersBatchRequest struct {
+	Usernames []string `json:"usernames"`
+	IDs       []int64  `json:"ids"`
+}
+
+type UsersBatchResponse struct {
+	Users             []User   `json:"users"`
+	NotFoundUsernames []string `json:"not_found_usernames"`
+	NotFoundIDs       []int64  `json:"not_found_ids"`
+}
+
 type PostIconResponse struct {
+	// IDはアップロードごとに払い出すランダムなID (互換性のため残している)
 	ID int64 `json:"id"`
+	// IconHashはアップロードした画像のsha256で、同じ画像なら同じ値になる
+	IconHash string `json:"icon_hash"`
 }
 
 func getIconHandler(c echo.Context) error {
@@ -111,6 +143,18 @@ func getIconHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
 	}
 
+	// アイコンファイルの更新時刻で If-Modified-Since を判定する
+	// If-None-Match が送られている場合はそちらを優先し、If-Modified-Since は見ない (RFC 9110 13.1.3)
+	if stat, err := os.Stat(iconPath(user.ID)); err == nil {
+		modTime := stat.ModTime().UTC().Truncate(time.Second)
+		c.Response().Header().Set(echo.HeaderLastModified, modTime.Format(http.TimeFormat))
+		if c.Request().Header.Get("If-None-Match") == "" {
+			if since, err := http.ParseTime(c.Request().Header.Get(echo.HeaderIfModifiedSince)); err == nil && !modTime.After(since) {
+				return c.NoContent(http.StatusNotModified)
+			}
+		}
+	}
+
 	image, err := getIcon(user.ID)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
@@ -123,8 +167,113 @@ func getIconHandler(c echo.Context) error {
 	return c.Blob(http.StatusOK, "image/jpeg", image)
 }
 
+// 複数ユーザのアイコンハッシュをまとめて返す (存在しないユーザは含めない)
+// POST /api/users/icon-hashes
+func postIconHashesHandler(c echo.Context) error {
+	var req IconHashesRequest
+	if err := decodeJSON(c, &req); err != nil {
+		return err
+	}
+	if len(req.Usernames) > maxUsersBatchSize {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("at most %d users can be requested at once", maxUsersBatchSize))
+	}
+
+	iconHashes := make(map[string]string, len(req.Usernames))
+	for _, username := range req.Usernames {
+		if v, ok := hashCache.Get(username); ok {
+			iconHashes[username] = fmt.Sprintf("%x", v)
+			continue
+		}
+
+		user, ok := userModelByNameCache.Get(username)
+		if !ok {
+			continue
+		}
+		iconHash, err := computeIconHash(user.ID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user icon: "+err.Error())
+		}
+		hashCache.Set(username, iconHash)
+		iconHashes[username] = fmt.Sprintf("%x", iconHash)
+	}
+
+	return c.JSON(http.StatusOK, iconHashes)
+}
+
+// 登録できないユーザ名か
+func isReservedUsername(username string) bool {
+	return username == "pipe"
+}
+
+type UsernameAvailability struct {
+	Available bool `json:"available"`
+}
+
+// ユーザ名が登録可能か (キャッシュのみを見る)
+// GET /api/user/:username/available
+func getUsernameAvailabilityHandler(c echo.Context) error {
+	username := c.Param("username")
+	_, exists := userModelByNameCache.Get(username)
+	return c.JSON(http.StatusOK, UsernameAvailability{
+		Available: !exists && !isReservedUsername(username),
+	})
+}
+
+// 複数ユーザをまとめて返す (存在しないユーザはnot_found_*に入れる)
+// POST /api/users/batch
+func postUsersBatchHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	var req UsersBatchRequest
+	if err := decodeJSON(c, &req); err != nil {
+		return err
+	}
+	if len(req.Usernames)+len(req.IDs) > maxUsersBatchSize {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("at most %d users can be requested at once", maxUsersBatchSize))
+	}
+
+	res := UsersBatchResponse{
+		NotFoundUsernames: []string{},
+		NotFoundIDs:       []int64{},
+	}
+	userModels := make([]UserModel, 0, len(req.Usernames)+len(req.IDs))
+	for _, username := range req.Usernames {
+		userModel, ok := userModelByNameCache.Get(username)
+		if !ok {
+			res.NotFoundUsernames = append(res.NotFoundUsernames, username)
+			continue
+		}
+		userModels = append(userModels, userModel)
+	}
+	for _, id := range req.IDs {
+		userModel, ok := userModelByIdCache.Get(id)
+		if !ok {
+			res.NotFoundIDs = append(res.NotFoundIDs, id)
+			continue
+		}
+		userModels = append(userModels, userModel)
+	}
+
+	users, err := fillUserResponseBulk(ctx, dbConn, userModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill users: "+err.Error())
+	}
+	res.Users = users
+
+	return c.JSON(http.StatusOK, res)
+}
+
+func iconPath(userId int64) string {
+	return iconDir + fmt.Sprintf("%d.jpg", userId)
+}
+
 func getIcon(userId int64) ([]byte, error) {
-	file, err := os.ReadFile(iconDir + fmt.Sprintf("%d.jpg", userId))
+	file, err := os.ReadFile(iconPath(userId))
 	if err != nil {
 		return nil, err
 	}
@@ -132,8 +281,84 @@ func getIcon(userId int64) ([]byte, error) {
 	return file, nil
 }
 
+// アイコンが存在しない場合はfallbackImageHashを返す
+func computeIconHash(userId int64) ([32]byte, error) {
+	image, err := getIcon(userId)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fallbackImageHash, nil
+		}
+		return [32]byte{}, err
+	}
+	return sha256.Sum256(image), nil
+}
+
+// 全ユーザのアイコンハッシュを事前に計算してhashCacheに載せる
+// 同時に読み込むファイル数はworkersで制限する
+func precomputeIconHashes(userModels []UserModel, workers int) error {
+	sem := make(chan struct{}, workers)
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		gErr error
+	)
+	for _, userModel := range userModels {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(userModel UserModel) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			iconHash, err := computeIconHash(userModel.ID)
+			if err != nil {
+				mu.Lock()
+				gErr = err
+				mu.Unlock()
+				return
+			}
+			hashCache.Set(userModel.Name, iconHash)
+		}(userModel)
+	}
+	wg.Wait()
+	return gErr
+}
+
+var (
+	muIconHashWarmup sync.Mutex
+	// 直近のアイコンハッシュの事前計算が終わるとcloseされる
+	iconHashWarmupDoneCh = func() chan struct{} {
+		ch := make(chan struct{})
+		close(ch)
+		return ch
+	}()
+)
+
+func iconHashWarmupDone() <-chan struct{} {
+	muIconHashWarmup.Lock()
+	defer muIconHashWarmup.Unlock()
+	return iconHashWarmupDoneCh
+}
+
+// アイコンハッシュの事前計算を非同期に始める
+func startIconHashWarmup(userModels []UserModel, workers int) <-chan struct{} {
+	done := make(chan struct{})
+	muIconHashWarmup.Lock()
+	iconHashWarmupDoneCh = done
+	muIconHashWarmup.Unlock()
+
+	go func() {
+		defer close(done)
+		if err := precomputeIconHashes(userModels, workers); err != nil {
+			log.Printf("failed to precompute icon hashes: %v", err)
+		}
+	}()
+	return done
+}
+
+// アイコンの書き込み (テストでディスクフルなどを再現できるように変数にしておく)
+var writeIconFile = os.WriteFile
+
 func saveIcon(userId int64, image []byte) error {
-	return os.WriteFile(iconDir+fmt.Sprintf("%d.jpg", userId), image, 0666)
+	return writeIconFile(iconPath(userId), image, 0666)
 }
 
 func initIconDir() error {
@@ -152,6 +377,7 @@ func initIconDir() error {
 }
 
 func postIconHandler(c echo.Context) error {
+	ctx := c.Request().Context()
 
 	if err := verifyUserSession(c); err != nil {
 		// echo.NewHTTPErrorが返っているのでそのまま出力
@@ -163,33 +389,80 @@ func postIconHandler(c echo.Context) error {
 	// existence already checked
 	userID := sess.Values[defaultUserIDKey].(int64)
 
-	var req *PostIconRequest
-	if err := json.UnmarshalRead(c.Request().Body, &req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	req, err := readPostIconRequest(c)
+	if err != nil {
+		return err
 	}
 
-	if err := saveIcon(userID, req.Image); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save icon: "+err.Error())
+	// 他のサーバで登録されたユーザはキャッシュにないことがあるのでDBも見る
+	user, err := getUserModelByID(ctx, userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given userid")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
 	}
 
-	user, ok := userModelByIdCache.Get(userID)
-	if !ok {
-		return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given userid")
+	if err := saveIcon(userID, req.Image); err != nil {
+		c.Logger().Warnf("failed to save icon: path=%s size=%d err=%s", iconPath(userID), len(req.Image), err.Error())
+		switch {
+		case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT):
+			return echo.NewHTTPError(http.StatusInsufficientStorage, "failed to save icon: insufficient storage")
+		case errors.Is(err, os.ErrPermission):
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to save icon: permission denied")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save icon: "+err.Error())
 	}
 
-	hashCache.Delete(user.Name)
+	iconHash := sha256.Sum256(req.Image)
+	hashCache.Set(user.Name, iconHash)
+	hashCache.Invalidate(user.Name)
 
 	return c.JSON(http.StatusCreated, &PostIconResponse{
-		ID: randomId(),
+		ID:       randomId(),
+		IconHash: fmt.Sprintf("%x", iconHash),
 	})
 }
 
-func randomId() int64 {
+// multipart/form-dataならimageパートを、それ以外はJSONとして読む
+func readPostIconRequest(c echo.Context) (*PostIconRequest, error) {
+	defer c.Request().Body.Close()
+
+	if strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEMultipartForm) {
+		fileHeader, err := c.FormFile("image")
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "failed to get image from multipart form: "+err.Error())
+		}
+		file, err := fileHeader.Open()
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "failed to open uploaded image: "+err.Error())
+		}
+		defer file.Close()
+		image, err := io.ReadAll(file)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "failed to read uploaded image: "+err.Error())
+		}
+		return &PostIconRequest{Image: image}, nil
+	}
+
+	var req PostIconRequest
+	if err := decodeJSON(c, &req); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+// NewNodeは起動時に一度だけ呼ぶ
+var snowflakeNode = func() *snowflake.Node {
 	node, err := snowflake.NewNode(1)
 	if err != nil {
 		panic(err)
 	}
-	return int64(node.Generate())
+	return node
+}()
+
+func randomId() int64 {
+	return int64(snowflakeNode.Generate())
 }
 
 func getMeHandler(c echo.Context) error {
@@ -205,9 +478,12 @@ func getMeHandler(c echo.Context) error {
 	// existence already checked
 	userID := sess.Values[defaultUserIDKey].(int64)
 
-	userModel, ok := userModelByIdCache.Get(userID)
-	if !ok {
-		return echo.NewHTTPError(http.StatusNotFound, "not found user that has the userid in session")
+	userModel, err := getUserModelByID(ctx, userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the userid in session")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
 	}
 
 	user, err := fillUserResponse(ctx, dbConn, userModel)
@@ -218,18 +494,97 @@ func getMeHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, user)
 }
 
+type LivestreamRevenue struct {
+	LivestreamID int64 `json:"livestream_id" db:"livestream_id"`
+	TotalTip     int64 `json:"total_tip" db:"total_tip"`
+}
+
+type UserRevenue struct {
+	TotalTip    int64               `json:"total_tip"`
+	Livestreams []LivestreamRevenue `json:"livestreams"`
+}
+
+// ログインユーザの配信で得たチップの合計
+// GET /api/user/me/revenue
+func getMyRevenueHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamModels, err := getLivestreamModelsByUserID(ctx, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+
+	revenue := UserRevenue{Livestreams: []LivestreamRevenue{}}
+	if len(livestreamModels) == 0 {
+		return c.JSON(http.StatusOK, revenue)
+	}
+
+	livestreamIDs := make([]int64, len(livestreamModels))
+	for i := range livestreamModels {
+		livestreamIDs[i] = livestreamModels[i].ID
+	}
+
+	query, args, err := sqlx.In("SELECT livestream_id, IFNULL(SUM(tip), 0) AS total_tip FROM livecomments WHERE livestream_id IN (?) AND hidden = FALSE GROUP BY livestream_id ORDER BY livestream_id", livestreamIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to build query: "+err.Error())
+	}
+	if err := dbConn.SelectContext(ctx, &revenue.Livestreams, dbConn.Rebind(query), args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
+	}
+
+	for _, l := range revenue.Livestreams {
+		revenue.TotalTip += l.TotalTip
+	}
+
+	return c.JSON(http.StatusOK, revenue)
+}
+
+// セッション確認API
+// GET /api/session
+func getSessionHandler(c echo.Context) error {
+	if err := verifyUserSession(c); err != nil {
+		// セッションがないときverifyUserSessionは403を返すが、未ログインはすべて401にそろえる
+		var he *echo.HTTPError
+		if errors.As(err, &he) {
+			return echo.NewHTTPError(http.StatusUnauthorized, he.Message)
+		}
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+	expiresAt := sess.Values[defaultSessionExpiresKey].(int64)
+
+	return c.JSON(http.StatusOK, &SessionResponse{
+		Authenticated: true,
+		UserID:        userID,
+		ExpiresAt:     expiresAt,
+	})
+}
+
 // ユーザ登録API
 // POST /api/register
 func registerHandler(c echo.Context) error {
 	ctx := c.Request().Context()
-	defer c.Request().Body.Close()
 
 	req := PostUserRequest{}
-	if err := json.UnmarshalRead(c.Request().Body, &req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	if err := decodeJSON(c, &req); err != nil {
+		return err
 	}
 
-	if req.Name == "pipe" {
+	if isReservedUsername(req.Name) {
 		return echo.NewHTTPError(http.StatusBadRequest, "the username 'pipe' is reserved")
 	}
 
@@ -260,10 +615,6 @@ func registerHandler(c echo.Context) error {
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted user id: "+err.Error())
 	}
-	userModel.ID = userID
-	userModelByIdCache.Set(userModel.ID, userModel)
-	userModelByNameCache.Set(userModel.Name, userModel)
-
 	userModel.ID = userID
 
 	themeModel := ThemeModel{
@@ -273,14 +624,24 @@ func registerHandler(c echo.Context) error {
 	if _, err := tx.NamedExecContext(ctx, "INSERT INTO themes (user_id, dark_mode) VALUES(:user_id, :dark_mode)", themeModel); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert user theme: "+err.Error())
 	}
-	themeCache.Delete(req.Name)
-
-	addSubdomain(req.Name + ".u.isucon.dev.")
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	// コミットに失敗したユーザーがキャッシュから引けてしまわないように、ここで載せる
+	userModelByIdCache.Set(userModel.ID, userModel)
+	userModelByNameCache.Set(userModel.Name, userModel)
+	userModelByIdCache.Invalidate(userModel.ID)
+	userModelByNameCache.Invalidate(userModel.Name)
+	themeCache.Delete(req.Name)
+
+	// コミットに失敗したユーザーのサブドメインが残らないようにコミット後に登録する
+	// ユーザーは既に作られているので、登録し続けて失敗しても登録自体は成功させて警告だけ残す
+	if err := registerSubdomainWithRetry(ctx, userSubdomain(req.Name)); err != nil {
+		c.Logger().Warnf("failed to register subdomain: %s", err.Error())
+	}
+
 	user, err := fillUserResponse(ctx, dbConn, userModel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
@@ -292,11 +653,10 @@ func registerHandler(c echo.Context) error {
 // ユーザログインAPI
 // POST /api/login
 func loginHandler(c echo.Context) error {
-	defer c.Request().Body.Close()
 
 	req := LoginRequest{}
-	if err := json.UnmarshalRead(c.Request().Body, &req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	if err := decodeJSON(c, &req); err != nil {
+		return err
 	}
 
 	// usernameはUNIQUEなので、whereで一意に特定できる
@@ -313,7 +673,7 @@ func loginHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to compare hash and password: "+err.Error())
 	}
 
-	sessionEndAt := time.Now().Add(1 * time.Hour)
+	sessionEndAt := nowFunc().Add(1 * time.Hour)
 
 	sessionID := uuid.NewString()
 
@@ -363,6 +723,18 @@ func getUserHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, user)
 }
 
+// キャッシュになければDBから取得してキャッシュに載せる
+func getUserModelByID(ctx context.Context, id int64) (UserModel, error) {
+	return userModelByIdCache.GetOrSet(id, func() (UserModel, error) {
+		var userModel UserModel
+		if err := dbConn.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ?", id); err != nil {
+			return UserModel{}, fmt.Errorf("failed to get user model by id: %d: %w", id, err)
+		}
+		userModelByNameCache.Set(userModel.Name, userModel)
+		return userModel, nil
+	})
+}
+
 func verifyUserSession(c echo.Context) error {
 	sess, err := session.Get(defaultSessionIDKey, c)
 	if err != nil {
@@ -379,7 +751,7 @@ func verifyUserSession(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusUnauthorized, "failed to get USERID value from session")
 	}
 
-	now := time.Now()
+	now := nowFunc()
 	if now.Unix() > sessionExpires.(int64) {
 		return echo.NewHTTPError(http.StatusUnauthorized, "session has expired")
 	}
@@ -407,14 +779,11 @@ func fillUserResponse(ctx context.Context, db *sqlx.DB, userModel UserModel) (Us
 	if v, ok := hashCache.Get(userModel.Name); ok {
 		iconHash = v
 	} else {
-		if image, err := getIcon(userModel.ID); err != nil {
-			if !errors.Is(err, os.ErrNotExist) {
-				return User{}, err
-			}
-			iconHash = fallbackImageHash
-		} else {
-			iconHash = sha256.Sum256(image)
+		v, err := computeIconHash(userModel.ID)
+		if err != nil {
+			return User{}, err
 		}
+		iconHash = v
 		hashCache.Set(userModel.Name, iconHash)
 	}
 
@@ -425,6 +794,7 @@ func fillUserResponse(ctx context.Context, db *sqlx.DB, userModel UserModel) (Us
 		Description: userModel.Description,
 		Theme:       theme,
 		IconHash:    fmt.Sprintf("%x", iconHash),
+		HasIcon:     iconHash != fallbackImageHash,
 	}
 
 	return user, nil
@@ -456,7 +826,10 @@ func fillUserResponseBulk(ctx context.Context, db *sqlx.DB, userModels []UserMod
 			return nil, err
 		}
 		query = db.Rebind(query)
-		if err := db.SelectContext(ctx, &themeModels, query, args...); err != nil {
+		spanCtx, span := tracer.Start(ctx, "SELECT themes")
+		err = db.SelectContext(spanCtx, &themeModels, query, args...)
+		span.End()
+		if err != nil {
 			return nil, err
 		}
 
@@ -479,40 +852,39 @@ func fillUserResponseBulk(ctx context.Context, db *sqlx.DB, userModels []UserMod
 	}
 
 	if len(requestIconHashUserIDs) > 0 {
-		images := make([]struct {
-			UserID int64  `db:"user_id"`
-			Image  []byte `db:"image"`
-		}, len(requestIconHashUserIDs))
-		for i := range requestIconHashUserIDs {
-			image, err := getIcon(requestIconHashUserIDs[i])
-			if err != nil {
-				if errors.Is(err, os.ErrNotExist) {
-					image, err = os.ReadFile(fallbackImage)
-					if err != nil {
-						return nil, err
-					}
-				} else {
-					return nil, err
-				}
-			}
-			images[i] = struct {
-				UserID int64  `db:"user_id"`
-				Image  []byte `db:"image"`
-			}{
-				UserID: requestIconHashUserIDs[i],
-				Image:  image,
-			}
-		}
-
-		wg := sync.WaitGroup{}
-		for _, image := range images {
+		// ファイルの読み込みとハッシュ計算をまとめてワーカーに任せ、I/OとCPUを重ねる
+		// mapへの並行書き込みを避けるため、各ワーカーは自分の添字にだけ書き込む
+		iconHashes := make([][32]byte, len(requestIconHashUserIDs))
+		sem := make(chan struct{}, iconHashWorkers)
+		var (
+			wg   sync.WaitGroup
+			mu   sync.Mutex
+			gErr error
+		)
+		for i, userID := range requestIconHashUserIDs {
 			wg.Add(1)
-			go func(userID int64, image []byte) {
+			sem <- struct{}{}
+			go func(i int, userID int64) {
 				defer wg.Done()
-				iconHashMap[userID] = sha256.Sum256(image)
-			}(image.UserID, image.Image)
+				defer func() { <-sem }()
+				iconHash, err := computeIconHash(userID)
+				if err != nil {
+					mu.Lock()
+					gErr = err
+					mu.Unlock()
+					return
+				}
+				iconHashes[i] = iconHash
+			}(i, userID)
 		}
 		wg.Wait()
+		if gErr != nil {
+			return nil, gErr
+		}
+
+		for i, userID := range requestIconHashUserIDs {
+			iconHashMap[userID] = iconHashes[i]
+		}
 
 		for userID, iconHash := range iconHashMap {
 			hashCache.Set(userModelsMap[userID].Name, iconHash)
@@ -529,6 +901,7 @@ func fillUserResponseBulk(ctx context.Context, db *sqlx.DB, userModels []UserMod
 			Description: userModel.Description,
 			Theme:       themeMap[userModel.ID],
 			IconHash:    fmt.Sprintf("%x", iconHashMap[userModel.ID]),
+			HasIcon:     iconHashMap[userModel.ID] != fallbackImageHash,
 		}
 
 		users = append(users, user)
@@ -0,0 +1,588 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"maps"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/snowflake"
+	"github.com/go-json-experiment/json"
+	"github.com/labstack/echo/v4"
+)
+
+func setupIconTest(t *testing.T) UserModel {
+	t.Helper()
+	prevDir := iconDir
+	iconDir = t.TempDir() + string(filepath.Separator)
+	t.Cleanup(func() { iconDir = prevDir })
+
+	user := UserModel{ID: 1, Name: "icon-test-user"}
+	userModelByNameCache.Set(user.Name, user)
+	t.Cleanup(func() { userModelByNameCache.deleteLocal(user.Name) })
+
+	if err := os.WriteFile(iconPath(user.ID), []byte("icon"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func getIconStatus(t *testing.T, user UserModel, header http.Header) int {
+	t.Helper()
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header = header
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("username")
+	c.SetParamValues(user.Name)
+	if err := getIconHandler(c); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code
+}
+
+func TestGetIconIfModifiedSince(t *testing.T) {
+	user := setupIconTest(t)
+	future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+
+	header := http.Header{}
+	header.Set(echo.HeaderIfModifiedSince, future)
+	if code := getIconStatus(t, user, header); code != http.StatusNotModified {
+		t.Errorf("status = %d, want %d", code, http.StatusNotModified)
+	}
+}
+
+func TestGetIconIfModifiedSinceInPast(t *testing.T) {
+	user := setupIconTest(t)
+	// アイコンを書き込むより前の時刻なので、更新されているとみなす
+	past := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+
+	header := http.Header{}
+	header.Set(echo.HeaderIfModifiedSince, past)
+	if code := getIconStatus(t, user, header); code != http.StatusOK {
+		t.Errorf("status = %d, want %d", code, http.StatusOK)
+	}
+}
+
+func TestGetIconIgnoresIfModifiedSinceWithIfNoneMatch(t *testing.T) {
+	user := setupIconTest(t)
+	future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+
+	// If-None-Match が一致しなければ、If-Modified-Since が新しくても304にしない
+	header := http.Header{}
+	header.Set("If-None-Match", `"stale-hash"`)
+	header.Set(echo.HeaderIfModifiedSince, future)
+	if code := getIconStatus(t, user, header); code != http.StatusOK {
+		t.Errorf("status = %d, want %d", code, http.StatusOK)
+	}
+}
+
+func postIconHashes(t *testing.T, usernames []string) (int, error) {
+	t.Helper()
+	body := `{"usernames":["` + strings.Join(usernames, `","`) + `"]}`
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodPost, "/api/users/icon-hashes", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	err := postIconHashesHandler(e.NewContext(req, rec))
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		return he.Code, nil
+	}
+	return rec.Code, err
+}
+
+func TestPostIconHashesBatchSize(t *testing.T) {
+	usernames := make([]string, maxUsersBatchSize+1)
+	for i := range usernames {
+		usernames[i] = fmt.Sprintf("no-such-user-%d", i)
+	}
+
+	if code, err := postIconHashes(t, usernames[:maxUsersBatchSize]); err != nil || code != http.StatusOK {
+		t.Errorf("status for %d usernames = %d (err=%v), want %d", maxUsersBatchSize, code, err, http.StatusOK)
+	}
+	if code, err := postIconHashes(t, usernames); err != nil || code != http.StatusBadRequest {
+		t.Errorf("status for %d usernames = %d (err=%v), want %d", len(usernames), code, err, http.StatusBadRequest)
+	}
+}
+
+// テーマをキャッシュに載せておき、DBを使わずにアイコンハッシュの計算だけを走らせる
+func setupFillUserBulkTest(tb testing.TB, n int) []UserModel {
+	tb.Helper()
+	prevDir := iconDir
+	iconDir = tb.TempDir() + string(filepath.Separator)
+	tb.Cleanup(func() { iconDir = prevDir })
+
+	userModels := make([]UserModel, n)
+	for i := range userModels {
+		userModels[i] = UserModel{ID: int64(i + 1), Name: fmt.Sprintf("fill-bulk-user-%d", i+1)}
+		themeCache.Set(userModels[i].Name, Theme{ID: int64(i + 1)})
+		// 半分のユーザだけアイコンを持たせ、残りはデフォルト画像にする
+		if i%2 == 0 {
+			if err := os.WriteFile(iconPath(userModels[i].ID), []byte(userModels[i].Name), 0o644); err != nil {
+				tb.Fatal(err)
+			}
+		}
+	}
+	tb.Cleanup(func() {
+		for _, userModel := range userModels {
+			themeCache.deleteLocal(userModel.Name)
+			hashCache.deleteLocal(userModel.Name)
+		}
+	})
+	return userModels
+}
+
+// go test -race で iconHashMap への並行書き込みを検出する
+func TestFillUserResponseBulkConcurrentIconHashes(t *testing.T) {
+	userModels := setupFillUserBulkTest(t, 500)
+
+	users, err := fillUserResponseBulk(context.Background(), nil, userModels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != len(userModels) {
+		t.Fatalf("len(users) = %d, want %d", len(users), len(userModels))
+	}
+	for i, user := range users {
+		want := fallbackImageHash
+		if i%2 == 0 {
+			want = sha256.Sum256([]byte(userModels[i].Name))
+		}
+		if user.IconHash != fmt.Sprintf("%x", want) {
+			t.Errorf("users[%d].IconHash = %s, want %x", i, user.IconHash, want)
+		}
+		if user.HasIcon != (i%2 == 0) {
+			t.Errorf("users[%d].HasIcon = %v, want %v", i, user.HasIcon, i%2 == 0)
+		}
+	}
+}
+
+func BenchmarkFillUserResponseBulk1000(b *testing.B) {
+	userModels := setupFillUserBulkTest(b, 1000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		for _, userModel := range userModels {
+			hashCache.deleteLocal(userModel.Name)
+		}
+		b.StartTimer()
+		if _, err := fillUserResponseBulk(context.Background(), nil, userModels); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestRandomIdUnique(t *testing.T) {
+	seen := make(map[int64]struct{}, 10000)
+	for i := 0; i < 10000; i++ {
+		id := randomId()
+		if _, ok := seen[id]; ok {
+			t.Fatalf("randomId returned duplicate id %d", id)
+		}
+		seen[id] = struct{}{}
+	}
+}
+
+func BenchmarkRandomId(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		randomId()
+	}
+}
+
+// 以前の実装のように毎回ノードを作った場合との比較用
+func BenchmarkRandomIdNewNode(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		node, err := snowflake.NewNode(1)
+		if err != nil {
+			b.Fatal(err)
+		}
+		node.Generate()
+	}
+}
+
+func registerUser(t *testing.T, name string) int {
+	t.Helper()
+	body := `{"name":"` + name + `","display_name":"test","description":"test","password":"test","theme":{"dark_mode":true}}`
+	code, _, err := serveAs(0, registerHandler, http.MethodPost, "/api/register", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestRegisterCommitFailureLeavesNoUser(t *testing.T) {
+	f := setupHandlerTest(t)
+	resetSubdomains()
+	t.Cleanup(resetSubdomains)
+	f.exec("INSERT INTO users", 1001)
+	f.exec("INSERT INTO themes", 1)
+	f.commitErr = errors.New("commit failed")
+
+	if code := registerUser(t, "register-test-user"); code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want %d", code, http.StatusInternalServerError)
+	}
+	if _, ok := userModelByIdCache.Get(1001); ok {
+		t.Error("rolled back user is in userModelByIdCache")
+	}
+	if _, ok := userModelByNameCache.Get("register-test-user"); ok {
+		t.Error("rolled back user is in userModelByNameCache")
+	}
+	if hasSubdomain(userSubdomain("register-test-user")) {
+		t.Error("subdomain of the rolled back user is registered")
+	}
+}
+
+func TestRegisterCachesUserAfterCommit(t *testing.T) {
+	f := setupHandlerTest(t)
+	resetSubdomains()
+	t.Cleanup(resetSubdomains)
+	f.exec("INSERT INTO users", 1001)
+	f.exec("INSERT INTO themes", 1)
+	f.rowsWhere("FROM themes WHERE user_id", "user_id", ThemeModel{ID: 1, UserID: 1001, DarkMode: true})
+
+	if code := registerUser(t, "register-test-user"); code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d", code, http.StatusCreated)
+	}
+	if u, ok := userModelByIdCache.Get(1001); !ok || u.Name != "register-test-user" {
+		t.Errorf("userModelByIdCache[1001] = (%+v, %v), want register-test-user", u, ok)
+	}
+	if _, ok := userModelByNameCache.Get("register-test-user"); !ok {
+		t.Error("new user is not in userModelByNameCache")
+	}
+	if !hasSubdomain(userSubdomain("register-test-user")) {
+		t.Error("subdomain of the new user is not registered")
+	}
+}
+
+// サブドメインの登録に失敗し続けても、ユーザーはコミット済みなので登録は成功させる
+func TestRegisterSucceedsWhenSubdomainFails(t *testing.T) {
+	f := setupHandlerTest(t)
+	resetSubdomains()
+	t.Cleanup(resetSubdomains)
+	calls := stubRegisterSubdomain(t, 10)
+	subdomainRetryAttempts = 3
+	f.exec("INSERT INTO users", 1001)
+	f.exec("INSERT INTO themes", 1)
+	f.rowsWhere("FROM themes WHERE user_id", "user_id", ThemeModel{ID: 1, UserID: 1001})
+
+	if code := registerUser(t, "register-test-user"); code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d", code, http.StatusCreated)
+	}
+	if *calls != 3 {
+		t.Errorf("registerSubdomain ran %d times, want 3", *calls)
+	}
+	if f.commits != 1 {
+		t.Errorf("commits = %d, want 1", f.commits)
+	}
+}
+
+func postIconAs(t *testing.T, userID int64, image []byte) PostIconResponse {
+	t.Helper()
+	body, err := json.Marshal(PostIconRequest{Image: image})
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, resBody, err := serveAs(userID, postIconHandler, http.MethodPost, "/api/icon", string(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d", code, http.StatusCreated)
+	}
+	var res PostIconResponse
+	if err := json.Unmarshal([]byte(resBody), &res); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestPostIconHashIsReproducible(t *testing.T) {
+	setupHandlerTest(t)
+	userModelByIdCache.Set(1, UserModel{ID: 1, Name: "icon-test-user"})
+
+	image := []byte("same image")
+	first := postIconAs(t, 1, image)
+	second := postIconAs(t, 1, image)
+
+	if first.IconHash != second.IconHash {
+		t.Errorf("icon_hash differs for the same upload: %s, %s", first.IconHash, second.IconHash)
+	}
+	if want := fmt.Sprintf("%x", sha256.Sum256(image)); first.IconHash != want {
+		t.Errorf("icon_hash = %s, want %s", first.IconHash, want)
+	}
+	if other := postIconAs(t, 1, []byte("other image")); other.IconHash == first.IconHash {
+		t.Error("icon_hash is the same for a different image")
+	}
+}
+
+func TestGetSession(t *testing.T) {
+	expiresAt := time.Now().Add(time.Hour).Unix()
+	tests := []struct {
+		name     string
+		values   map[any]any
+		wantCode int
+	}{
+		{"valid", map[any]any{defaultUserIDKey: int64(7), defaultSessionExpiresKey: expiresAt}, http.StatusOK},
+		{"expired", map[any]any{defaultUserIDKey: int64(7), defaultSessionExpiresKey: time.Now().Add(-time.Minute).Unix()}, http.StatusUnauthorized},
+		{"missing", map[any]any{defaultSessionExpiresKey: nil}, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body, err := serveWithSession(tt.values, getSessionHandler, http.MethodGet, "/api/session", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", code, tt.wantCode)
+			}
+			if code != http.StatusOK {
+				return
+			}
+			var res SessionResponse
+			if err := json.Unmarshal([]byte(body), &res); err != nil {
+				t.Fatal(err)
+			}
+			if want := (SessionResponse{Authenticated: true, UserID: 7, ExpiresAt: expiresAt}); res != want {
+				t.Errorf("response = %+v, want %+v", res, want)
+			}
+		})
+	}
+}
+
+// nowFuncをnowに固定する
+func setNow(t *testing.T, now time.Time) {
+	t.Helper()
+	prev := nowFunc
+	nowFunc = func() time.Time { return now }
+	t.Cleanup(func() { nowFunc = prev })
+}
+
+func TestVerifyUserSessionExpiresWithNowFunc(t *testing.T) {
+	loggedInAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	values := map[any]any{defaultUserIDKey: int64(1), defaultSessionExpiresKey: loggedInAt.Add(time.Hour).Unix()}
+	tests := []struct {
+		elapsed  time.Duration
+		wantCode int
+	}{
+		{59 * time.Minute, http.StatusOK},
+		{time.Hour, http.StatusOK},
+		{time.Hour + time.Second, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		setNow(t, loggedInAt.Add(tt.elapsed))
+		code, _, err := serveWithSession(values, getSessionHandler, http.MethodGet, "/api/session", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.wantCode {
+			t.Errorf("after %s: status = %d, want %d", tt.elapsed, code, tt.wantCode)
+		}
+	}
+}
+
+func TestPostIconHashesMatchStoredIcons(t *testing.T) {
+	setupHandlerTest(t)
+	for _, user := range []UserModel{{ID: 1, Name: "with-icon"}, {ID: 2, Name: "without-icon"}} {
+		userModelByIdCache.Set(user.ID, user)
+		userModelByNameCache.Set(user.Name, user)
+	}
+	if err := saveIcon(1, []byte("stored icon")); err != nil {
+		t.Fatal(err)
+	}
+
+	iconHashes := func() map[string]string {
+		t.Helper()
+		code, body, err := serveWithSession(nil, postIconHashesHandler, http.MethodPost, "/api/users/icon-hashes", `{"usernames":["with-icon","without-icon","no-such-user"]}`)
+		if err != nil || code != http.StatusOK {
+			t.Fatalf("status = %d (err=%v), want %d", code, err, http.StatusOK)
+		}
+		var res map[string]string
+		if err := json.Unmarshal([]byte(body), &res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	want := map[string]string{
+		"with-icon":    fmt.Sprintf("%x", sha256.Sum256([]byte("stored icon"))),
+		"without-icon": fmt.Sprintf("%x", fallbackImageHash),
+	}
+	if got := iconHashes(); !maps.Equal(got, want) {
+		t.Errorf("icon hashes = %v, want %v", got, want)
+	}
+
+	// アイコンを変えたら新しいハッシュが返る
+	posted := postIconAs(t, 1, []byte("new icon"))
+	want["with-icon"] = posted.IconHash
+	if got := iconHashes(); !maps.Equal(got, want) {
+		t.Errorf("icon hashes after upload = %v, want %v", got, want)
+	}
+}
+
+func TestGetUserModelByIDColdCache(t *testing.T) {
+	f := setupHandlerTest(t)
+	f.rowsWhere("FROM users WHERE id", "id", UserModel{ID: 1, Name: "cold-user"})
+
+	for i := 0; i < 2; i++ {
+		user, err := getUserModelByID(context.Background(), 1)
+		if err != nil || user.Name != "cold-user" {
+			t.Fatalf("getUserModelByID(1) = (%+v, %v), want cold-user", user, err)
+		}
+	}
+	if n := f.count("FROM users WHERE id"); n != 1 {
+		t.Errorf("queried users %d times, want 1", n)
+	}
+	if _, ok := userModelByNameCache.Get("cold-user"); !ok {
+		t.Error("cold-user is not in userModelByNameCache")
+	}
+
+	if _, err := getUserModelByID(context.Background(), 2); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("getUserModelByID(2) error = %v, want sql.ErrNoRows", err)
+	}
+}
+
+// 他のサーバで登録されたユーザが、キャッシュにないままアイコンを上げたりmeを引いたりする
+func TestUserHandlersFallBackToDB(t *testing.T) {
+	f := setupHandlerTest(t)
+	f.rowsWhere("FROM users WHERE id", "id", UserModel{ID: 1, Name: "cold-user"})
+	f.rowsWhere("FROM themes WHERE user_id", "user_id", ThemeModel{ID: 1, UserID: 1})
+
+	if posted := postIconAs(t, 1, []byte("icon")); posted.IconHash != fmt.Sprintf("%x", sha256.Sum256([]byte("icon"))) {
+		t.Errorf("icon_hash = %s", posted.IconHash)
+	}
+	code, body, err := serveAs(1, getMeHandler, http.MethodGet, "/api/user/me", "")
+	if err != nil || code != http.StatusOK {
+		t.Fatalf("me: status = %d (err=%v), want %d", code, err, http.StatusOK)
+	}
+	var me User
+	if err := json.Unmarshal([]byte(body), &me); err != nil {
+		t.Fatal(err)
+	}
+	if me.Name != "cold-user" {
+		t.Errorf("me = %+v, want cold-user", me)
+	}
+
+	for _, h := range []echo.HandlerFunc{getMeHandler, postIconHandler} {
+		code, _, err := serveAs(2, h, http.MethodPost, "/", `{"image":"aWNvbg=="}`)
+		if err != nil || code != http.StatusNotFound {
+			t.Errorf("unknown user: status = %d (err=%v), want %d", code, err, http.StatusNotFound)
+		}
+	}
+	if _, err := os.Stat(iconPath(2)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("saved an icon for an unknown user: %v", err)
+	}
+}
+
+func TestPostIconWriteErrors(t *testing.T) {
+	setupHandlerTest(t)
+	userModelByIdCache.Set(1, UserModel{ID: 1, Name: "icon-test-user"})
+	prev := writeIconFile
+	t.Cleanup(func() { writeIconFile = prev })
+
+	tests := []struct {
+		name     string
+		err      error
+		wantCode int
+	}{
+		{"disk full", syscall.ENOSPC, http.StatusInsufficientStorage},
+		{"quota exceeded", syscall.EDQUOT, http.StatusInsufficientStorage},
+		{"permission denied", syscall.EACCES, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		writeIconFile = func(name string, _ []byte, _ os.FileMode) error {
+			return &os.PathError{Op: "open", Path: name, Err: tt.err}
+		}
+		code, _, err := serveAs(1, postIconHandler, http.MethodPost, "/api/icon", `{"image":"aWNvbg=="}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.wantCode {
+			t.Errorf("%s: status = %d, want %d", tt.name, code, tt.wantCode)
+		}
+		if _, ok := hashCache.Get("icon-test-user"); ok {
+			t.Errorf("%s: icon hash is cached though the icon was not saved", tt.name)
+		}
+	}
+}
+
+func multipartIconRequest(t *testing.T, field string, image []byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	part, err := w.CreateFormFile(field, "icon.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := part.Write(image); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/api/icon", &body)
+	req.Header.Set(echo.HeaderContentType, w.FormDataContentType())
+	return req
+}
+
+func TestPostIconJSONAndMultipart(t *testing.T) {
+	setupHandlerTest(t)
+	userModelByIdCache.Set(1, UserModel{ID: 1, Name: "icon-test-user"})
+	sessionValues := map[any]any{defaultUserIDKey: int64(1)}
+	image := []byte("\xff\xd8\xff binary icon \x00")
+
+	jsonBody, err := json.Marshal(PostIconRequest{Image: image})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonReq := httptest.NewRequest(http.MethodPost, "/api/icon", bytes.NewReader(jsonBody))
+	jsonReq.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+
+	for name, req := range map[string]*http.Request{
+		"json":      jsonReq,
+		"multipart": multipartIconRequest(t, "image", image),
+	} {
+		os.Remove(iconPath(1))
+		code, body, err := serveRequestWithSession(sessionValues, postIconHandler, req)
+		if err != nil || code != http.StatusCreated {
+			t.Fatalf("%s: status = %d (err=%v), want %d", name, code, err, http.StatusCreated)
+		}
+		var res PostIconResponse
+		if err := json.Unmarshal([]byte(body), &res); err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("%x", sha256.Sum256(image)); res.IconHash != want {
+			t.Errorf("%s: icon_hash = %s, want %s", name, res.IconHash, want)
+		}
+		if saved, err := os.ReadFile(iconPath(1)); err != nil || !bytes.Equal(saved, image) {
+			t.Errorf("%s: saved icon = %q (err=%v), want %q", name, saved, err, image)
+		}
+	}
+
+	for name, req := range map[string]*http.Request{
+		"multipart without image": multipartIconRequest(t, "file", image),
+		"malformed json":          httptest.NewRequest(http.MethodPost, "/api/icon", strings.NewReader(`{"image":`)),
+	} {
+		if req.Header.Get(echo.HeaderContentType) == "" {
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		}
+		if code, _, err := serveRequestWithSession(sessionValues, postIconHandler, req); err != nil || code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d (err=%v), want %d", name, code, err, http.StatusBadRequest)
+		}
+	}
+}
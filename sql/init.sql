@@ -2,6 +2,7 @@ TRUNCATE TABLE themes;
 TRUNCATE TABLE icons;
 TRUNCATE TABLE reservation_slots;
 TRUNCATE TABLE livestream_viewers_history;
+TRUNCATE TABLE livestream_view_durations;
 TRUNCATE TABLE livecomment_reports;
 TRUNCATE TABLE ng_words;
 TRUNCATE TABLE reactions;
@@ -16,6 +17,7 @@ ALTER TABLE `icons` auto_increment = 1;
 ALTER TABLE `reservation_slots` auto_increment = 1;
 ALTER TABLE `livestream_tags` auto_increment = 1;
 ALTER TABLE `livestream_viewers_history` auto_increment = 1;
+ALTER TABLE `livestream_view_durations` auto_increment = 1;
 ALTER TABLE `livecomment_reports` auto_increment = 1;
 ALTER TABLE `ng_words` auto_increment = 1;
 ALTER TABLE `reactions` auto_increment = 1;
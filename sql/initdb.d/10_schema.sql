@@ -40,6 +40,7 @@ CREATE TABLE `livestreams` (
 CREATE TABLE `reservation_slots` (
   `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
   `slot` BIGINT NOT NULL,
+  `capacity` BIGINT NOT NULL DEFAULT 0,
   `start_at` BIGINT NOT NULL,
   `end_at` BIGINT NOT NULL
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
@@ -66,6 +67,16 @@ CREATE TABLE `livestream_viewers_history` (
   `created_at` BIGINT NOT NULL
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
+-- ライブ配信の視聴時間 (視聴終了時に記録)
+CREATE TABLE `livestream_view_durations` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `livestream_id` BIGINT NOT NULL,
+  `duration` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  INDEX `livestream_view_durations_livestream_idx` (`livestream_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
 -- ライブ配信に対するライブコメント
 CREATE TABLE `livecomments` (
   `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
@@ -73,6 +84,8 @@ CREATE TABLE `livecomments` (
   `livestream_id` BIGINT NOT NULL,
   `comment` VARCHAR(255) NOT NULL,
   `tip` BIGINT NOT NULL DEFAULT 0,
+  -- NGワードに引っかかったコメントは削除せずに非表示にする
+  `hidden` BOOLEAN NOT NULL DEFAULT FALSE,
   `created_at` BIGINT NOT NULL
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
@@ -82,7 +95,9 @@ CREATE TABLE `livecomment_reports` (
   `user_id` BIGINT NOT NULL,
   `livestream_id` BIGINT NOT NULL,
   `livecomment_id` BIGINT NOT NULL,
-  `created_at` BIGINT NOT NULL
+  `resolved` BOOLEAN NOT NULL DEFAULT FALSE,
+  `created_at` BIGINT NOT NULL,
+  UNIQUE `livecomment_reports_user_livecomment_uniq` (`user_id`, `livecomment_id`)
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
 -- 配信者からのNGワード登録
@@ -100,6 +115,8 @@ CREATE TABLE `reactions` (
   `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
   `user_id` BIGINT NOT NULL,
   `livestream_id` BIGINT NOT NULL,
+  -- ライブコメントに対するリアクションの場合のみ設定される
+  `livecomment_id` BIGINT NULL,
   -- :innocent:, :tada:, etc...
   `emoji_name` VARCHAR(255) NOT NULL,
   `created_at` BIGINT NOT NULL